@@ -1,6 +1,16 @@
 package eos_txsigner
 
-/*
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/big"
+
+	"github.com/blocktree/go-owcrypt"
+)
+
+// secp256k1曲线的阶
+var curveOrder, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141", 16)
+
 func int2octets(v *big.Int, rolen int) []byte {
 	out := v.Bytes()
 
@@ -22,7 +32,7 @@ func int2octets(v *big.Int, rolen int) []byte {
 }
 
 func hashToInt(hash []byte) *big.Int {
-	orderBits := new(big.Int).SetBytes(owcrypt.GetCurveOrder(owcrypt.ECC_CURVE_SECP256K1)).BitLen()
+	orderBits := curveOrder.BitLen()
 	orderBytes := (orderBits + 7) / 8
 	if len(hash) > orderBytes {
 		hash = hash[:orderBytes]
@@ -38,14 +48,16 @@ func hashToInt(hash []byte) *big.Int {
 
 func bits2octets(in []byte, rolen int) []byte {
 	z1 := hashToInt(in)
-	z2 := new(big.Int).Sub(z1, new(big.Int).SetBytes(owcrypt.GetCurveOrder(owcrypt.ECC_CURVE_SECP256K1)))
+	z2 := new(big.Int).Sub(z1, curveOrder)
 	if z2.Sign() < 0 {
 		return int2octets(z1, rolen)
 	}
 	return int2octets(z2, rolen)
 }
 
-func generateRandomFromNonce(privateKey, hash []byte, nonce int) []byte {
+// generateRandomFromNonce 按RFC6979生成确定性随机数k，nonce大于0时在哈希后追加nonce个0重新哈希，
+// 用于签名不规范时重试
+func generateRandomFromNonce(privateKey, hash []byte, nonce int) *big.Int {
 	privkey := new(big.Int).SetBytes(privateKey)
 	if nonce > 0 {
 		moreHash := sha256.New()
@@ -54,7 +66,7 @@ func generateRandomFromNonce(privateKey, hash []byte, nonce int) []byte {
 		hash = moreHash.Sum(nil)
 	}
 
-	q := new(big.Int).SetBytes(owcrypt.GetCurveOrder(owcrypt.ECC_CURVE_SECP256K1))
+	q := curveOrder
 	x := privkey
 
 	qlen := q.BitLen()
@@ -94,12 +106,9 @@ func generateRandomFromNonce(privateKey, hash []byte, nonce int) []byte {
 		// Step H3
 		secret := hashToInt(t)
 		if secret.Cmp(big.NewInt(1)) >= 0 && secret.Cmp(q) < 0 {
-			return secret.Bytes()
+			return secret
 		}
 		k = owcrypt.Hmac(k, append(v, 0x00), owcrypt.HMAC_SHA256_ALG)
 		v = owcrypt.Hmac(k, v, owcrypt.HMAC_SHA256_ALG)
 	}
 }
-
-
-*/
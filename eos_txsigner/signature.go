@@ -1,60 +1,66 @@
 package eos_txsigner
 
-/*
+import (
+	"bytes"
+	"errors"
+	"math/big"
 
+	"github.com/blocktree/go-owcrypt"
+	"github.com/eoscanada/eos-go/ecc"
+)
 
+// 查找规范签名的最大重试次数
+const maxCanonicalRetries = 25
 
-func signRFC6979(privateKey, hash []byte, nonce int) ([]byte, error) {
+// signRFC6979 使用RFC6979确定性随机数签名，返回r+s和公钥恢复标识v，s取低位值
+func signRFC6979(privateKey, hash []byte, nonce int) ([]byte, byte, error) {
 	k := generateRandomFromNonce(privateKey, hash, nonce)
 
-	if owcrypt.PreprocessRandomNum(k) != owcrypt.SUCCESS {
-		return nil, errors.New("Failed to set random!")
+	point := owcrypt.Point_mulBaseG(int2octets(k, 32), owcrypt.ECC_CURVE_SECP256K1)
+	if len(point) != 33 {
+		return nil, 0, errors.New("Failed to compute random point!")
 	}
-	sig, ret := owcrypt.Signature(privateKey, nil, 0, hash, 32, owcrypt.ECC_CURVE_SECP256K1|owcrypt.NOUNCE_OUTSIDE_FLAG)
-	if ret != owcrypt.SUCCESS {
-		return nil, errors.New("Failed to signature!")
+	v := point[0] - 2 //压缩点前缀02/03表示y的奇偶
+
+	r := new(big.Int).SetBytes(point[1:])
+	if r.Cmp(curveOrder) >= 0 {
+		r.Sub(r, curveOrder)
+		v |= 2
+	}
+	if r.Sign() == 0 {
+		return nil, 0, errors.New("calculated R is zero")
 	}
-	return sig, nil
-}
 
-func equals(a, b []byte) bool {
-	if len(a) != len(b) {
-		return false
+	d := new(big.Int).SetBytes(privateKey)
+	s := new(big.Int).Mul(d, r)
+	s.Add(s, hashToInt(hash))
+	s.Mul(s, new(big.Int).ModInverse(k, curveOrder))
+	s.Mod(s, curveOrder)
+	if s.Sign() == 0 {
+		return nil, 0, errors.New("calculated S is zero")
 	}
-	for index := 0; index < len(a); index++ {
-		if a[index] != b[index] {
-			return false
-		}
+
+	//s取低位值，对应的R点y取反
+	if s.Cmp(new(big.Int).Rsh(curveOrder, 1)) > 0 {
+		s.Sub(curveOrder, s)
+		v ^= 1
 	}
-	return true
+
+	return append(int2octets(r, 32), int2octets(s, 32)...), v, nil
 }
 
+// makeCompact 查找能恢复出公钥的v值，公钥可以是压缩或未压缩格式，返回节点使用的压缩签名 (27+4+v)+r+s
 func makeCompact(sig, publicKey, hash []byte) ([]byte, error) {
-	for i := 0; i < 2; i++ {
-		tmp := append(sig, byte(i))
+	if len(publicKey) != 33 {
+		publicKey = owcrypt.PointCompress(publicKey, owcrypt.ECC_CURVE_SECP256K1)
+	}
+	for i := 0; i < 4; i++ {
+		tmp := append(sig[:64:64], byte(i))
 		pk, ret := owcrypt.RecoverPubkey(tmp, hash, owcrypt.ECC_CURVE_SECP256K1)
-		if ret == owcrypt.SUCCESS && equals(pk, publicKey) {
+		if ret == owcrypt.SUCCESS && bytes.Equal(owcrypt.PointCompress(pk, owcrypt.ECC_CURVE_SECP256K1), publicKey) {
 			result := make([]byte, 1, 2*32+1)
-			result[0] = 27 + byte(i)
-			result[0] += 4
-			// Not sure this needs rounding but safer to do so.
-			curvelen := (256 + 7) / 8
-
-			// Pad R and S to curvelen if needed.
-			bytelen := (256 + 7) / 8
-			if bytelen < curvelen {
-				result = append(result,
-					make([]byte, curvelen-bytelen)...)
-			}
-			result = append(result, sig[:32]...)
-
-			bytelen = (256 + 7) / 8
-			if bytelen < curvelen {
-				result = append(result,
-					make([]byte, curvelen-bytelen)...)
-			}
-			result = append(result, sig[32:]...)
-
+			result[0] = 27 + 4 + byte(i)
+			result = append(result, sig[:64]...)
 			return result, nil
 		}
 	}
@@ -62,6 +68,7 @@ func makeCompact(sig, publicKey, hash []byte) ([]byte, error) {
 	return nil, errors.New("no valid solution for pubkey found")
 }
 
+// isCanonical 节点要求的规范签名，r和s的最高位不能为1，且不能有多余的前导零
 func isCanonical(compactSig []byte) bool {
 	d := compactSig
 	t1 := (d[1] & 0x80) == 0
@@ -71,29 +78,32 @@ func isCanonical(compactSig []byte) bool {
 	return t1 && t2 && t3 && t4
 }
 
+// SignCanonical 签名交易哈希，签名不规范时更换确定性随机数重试，返回压缩签名 (27+4+v)+r+s
 func SignCanonical(privateKey, hash []byte) ([]byte, error) {
 
-	for i := 0; i < 25; i++ {
-		sig, err := signRFC6979(privateKey, hash, i)
-		if err != nil {
-			return nil, err
-		}
-
-		publicKey, ret := owcrypt.GenPubkey(privateKey, owcrypt.ECC_CURVE_SECP256K1)
-		if ret != owcrypt.SUCCESS {
-			return nil, errors.New("Invalid private key!")
-		}
+	if len(hash) != 32 {
+		return nil, errors.New("hash should be 32 bytes")
+	}
 
-		compactSig, err := makeCompact(sig, publicKey, hash)
+	for i := 0; i < maxCanonicalRetries; i++ {
+		sig, v, err := signRFC6979(privateKey, hash, i)
 		if err != nil {
-			continue
+			return nil, err
 		}
 
+		compactSig := append([]byte{27 + 4 + v}, sig...)
 		if isCanonical(compactSig) {
-			return sig, nil
+			return compactSig, nil
 		}
 	}
 	return nil, errors.New("couldn't find a canonical signature")
 }
 
-*/
+// SignatureToString 压缩签名编码为节点使用的SIG_K1_字符串
+func SignatureToString(compactSig []byte) (string, error) {
+	sig, err := ecc.NewSignatureFromData(append([]byte{byte(ecc.CurveK1)}, compactSig...))
+	if err != nil {
+		return "", err
+	}
+	return sig.String(), nil
+}
@@ -1,28 +1,42 @@
 package eos_txsigner
 
+import (
+	"fmt"
+
+	"github.com/blocktree/go-owcrypt"
+)
+
 var Default = &TransactionSigner{}
 
 type TransactionSigner struct {
 }
 
-// SignTransactionHash 交易哈希签名算法
-// Deprecated
+// SignTransactionHash 交易哈希签名算法，返回规范签名 r+s+v
 func (singer *TransactionSigner) SignTransactionHash(msg []byte, privateKey []byte, eccType uint32) ([]byte, error) {
-	//return SignCanonical(privateKey, msg)
-	return nil, nil
+	if eccType != owcrypt.ECC_CURVE_SECP256K1 {
+		return nil, fmt.Errorf("unsupported ecc type: %x", eccType)
+	}
+	compactSig, err := SignCanonical(privateKey, msg)
+	if err != nil {
+		return nil, err
+	}
+	return append(compactSig[1:], compactSig[0]-27-4), nil
 }
 
-// Deprecated
+// VerifyAndCombineSignature 验证签名 r+s 或 r+s+v 是否由公钥签名且规范，返回节点使用的压缩签名
 func (singer *TransactionSigner) VerifyAndCombineSignature(msg, publicKey, signature []byte) (bool, []byte, error) {
-	//compactSig, err := makeCompact(signature, publicKey, msg)
-	//if err != nil {
-	//	return false, nil, err
-	//}
-	//
-	//if !isCanonical(compactSig) {
-	//	return false, nil, fmt.Errorf("it is not canonical signature")
-	//}
-
-	//return true, compactSig, nil
-	return false, nil, nil
+	if len(signature) != 64 && len(signature) != 65 {
+		return false, nil, fmt.Errorf("invalid signature length: %d", len(signature))
+	}
+
+	compactSig, err := makeCompact(signature, publicKey, msg)
+	if err != nil {
+		return false, nil, err
+	}
+
+	if !isCanonical(compactSig) {
+		return false, nil, fmt.Errorf("it is not canonical signature")
+	}
+
+	return true, compactSig, nil
 }
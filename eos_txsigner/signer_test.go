@@ -0,0 +1,106 @@
+package eos_txsigner
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+
+	"github.com/blocktree/go-owcrypt"
+	"github.com/eoscanada/eos-go/btcsuite/btcutil"
+	"github.com/eoscanada/eos-go/ecc"
+)
+
+func TestSignCanonical(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		key, err := ecc.NewRandomPrivateKey()
+		if err != nil {
+			t.Fatalf("create private key failed: %v", err)
+		}
+		hash := sha256.Sum256([]byte(fmt.Sprintf("transaction %d", i)))
+		privateKey := testPrivateKeyBytes(t, key)
+
+		compactSig, err := SignCanonical(privateKey, hash[:])
+		if err != nil {
+			t.Fatalf("sign canonical failed: %v", err)
+		}
+		if !isCanonical(compactSig) {
+			t.Fatalf("signature is not canonical: %x", compactSig)
+		}
+
+		//与eos-go的RFC6979规范签名一致
+		want, _ := key.Sign(hash[:])
+		if !bytes.Equal(compactSig, want.Content) {
+			t.Fatalf("signature = %x, want %x", compactSig, want.Content)
+		}
+
+		//确定性签名
+		again, _ := SignCanonical(privateKey, hash[:])
+		if !bytes.Equal(compactSig, again) {
+			t.Fatalf("signature is not deterministic")
+		}
+
+		//SIG_K1字符串可以被节点解析并恢复公钥
+		str, err := SignatureToString(compactSig)
+		if err != nil {
+			t.Fatalf("encode signature failed: %v", err)
+		}
+		if str != want.String() {
+			t.Fatalf("signature string = %s, want %s", str, want.String())
+		}
+		sig, err := ecc.NewSignature(str)
+		if err != nil {
+			t.Fatalf("decode signature failed: %v", err)
+		}
+		if !sig.Verify(hash[:], key.PublicKey()) {
+			t.Fatalf("signature does not verify")
+		}
+	}
+}
+
+func TestTransactionSigner(t *testing.T) {
+	key, _ := ecc.NewRandomPrivateKey()
+	privateKey := testPrivateKeyBytes(t, key)
+	hash := sha256.Sum256([]byte("transaction"))
+
+	signature, err := Default.SignTransactionHash(hash[:], privateKey, owcrypt.ECC_CURVE_SECP256K1)
+	if err != nil {
+		t.Fatalf("sign transaction hash failed: %v", err)
+	}
+	if len(signature) != 65 {
+		t.Fatalf("signature length = %d, want 65", len(signature))
+	}
+
+	//签名最后一字节v可以恢复公钥
+	pub, ret := owcrypt.RecoverPubkey(signature, hash[:], owcrypt.ECC_CURVE_SECP256K1)
+	if ret != owcrypt.SUCCESS || !bytes.Equal(owcrypt.PointCompress(pub, owcrypt.ECC_CURVE_SECP256K1), key.PublicKey().Content) {
+		t.Fatalf("recovered public key does not match")
+	}
+
+	valid, compactSig, err := Default.VerifyAndCombineSignature(hash[:], key.PublicKey().Content, signature[:64])
+	if err != nil || !valid {
+		t.Fatalf("verify signature failed: %v", err)
+	}
+	if compactSig[0] != signature[64]+27+4 || !bytes.Equal(compactSig[1:], signature[:64]) {
+		t.Errorf("compact signature = %x", compactSig)
+	}
+
+	//其他公钥验证失败
+	other, _ := ecc.NewRandomPrivateKey()
+	if valid, _, _ := Default.VerifyAndCombineSignature(hash[:], other.PublicKey().Content, signature); valid {
+		t.Errorf("signature of other key should not verify")
+	}
+
+	if _, err := Default.SignTransactionHash(hash[:], privateKey, owcrypt.ECC_CURVE_SECP256R1); err == nil {
+		t.Errorf("unsupported ecc type should fail")
+	}
+}
+
+//testPrivateKeyBytes 私钥的32字节原始数据
+func testPrivateKeyBytes(t *testing.T, key *ecc.PrivateKey) []byte {
+	wif, err := btcutil.DecodeWIF(key.String())
+	if err != nil {
+		t.Fatalf("decode private key failed: %v", err)
+	}
+	return wif.PrivKey.Serialize()
+}
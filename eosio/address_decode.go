@@ -16,7 +16,11 @@
 package eosio
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/blocktree/eosio-adapter/addrdec"
+	"github.com/blocktree/openwallet/v2/openwallet"
 	"github.com/eoscanada/eos-go"
 )
 
@@ -64,3 +68,33 @@ func (decoder *addressDecoder) AddressVerify(address string, opts ...interface{}
 	}
 	return true
 }
+
+// CustomCreateAddress 备注充值模式下，为资产账户创建唯一的充值备注地址
+func (decoder *addressDecoder) CustomCreateAddress(account *openwallet.AssetsAccount, newIndex uint64) (*openwallet.Address, error) {
+
+	depositAccount := decoder.wm.Config.MemoDepositAccount
+	if len(depositAccount) == 0 {
+		return nil, fmt.Errorf("memo deposit account is not setup")
+	}
+
+	memo := NewDepositMemo(account.AccountID, newIndex)
+
+	address := &openwallet.Address{
+		AccountID:   account.AccountID,
+		Address:     memo,
+		Alias:       depositAccount,
+		Index:       newIndex,
+		Symbol:      decoder.wm.Symbol(),
+		IsMemo:      true,
+		Memo:        memo,
+		WatchOnly:   true,
+		CreatedTime: time.Now().Unix(),
+	}
+
+	return address, nil
+}
+
+// SupportCustomCreateAddressFunction 配置了备注充值账户时，使用备注作为充值地址
+func (decoder *addressDecoder) SupportCustomCreateAddressFunction() bool {
+	return len(decoder.wm.Config.MemoDepositAccount) > 0
+}
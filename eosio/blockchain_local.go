@@ -0,0 +1,241 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	//当前区块头
+	currentBlockHeaderBucket = "current_block_header"
+	//默认保留的本地区块头数量
+	defaultMaxBlockCache = 1000
+	//storm在每个bucket中保存的元数据键
+	stormMetadataKey = "__storm_metadata"
+	//每保存多少个区块头清理一次旧的区块头
+	localBlockPruneInterval = 100
+)
+
+// ErrKeyNotFound KeyValueStore.GetValue没有找到键时返回的错误，与storm.ErrNotFound相同
+var ErrKeyNotFound = storm.ErrNotFound
+
+// KeyValueStore 键值数据的持久化接口，保存回填进度等扫描器状态。
+// GetValue没有找到键时必须返回ErrKeyNotFound，扫描器据此区分键不存在和读取失败；
+// DeleteValue删除不存在的键时返回nil；Keys在bucket不存在时返回空列表
+type KeyValueStore interface {
+	SetValue(bucket string, key string, value interface{}) error
+	GetValue(bucket string, key string, to interface{}) error
+	DeleteValue(bucket string, key string) error
+	Keys(bucket string) ([]string, error)
+}
+
+//localBlockHeader 本地区块头记录
+type localBlockHeader struct {
+	ID     string `storm:"id"`
+	Symbol string `storm:"index"`
+	Height uint64 `storm:"index"`
+	Header *openwallet.BlockHeader
+}
+
+// LocalBlockchainDAI 基于本地文件的区块链数据访问实现，没有外部设置BlockchainDAI时使用
+type LocalBlockchainDAI struct {
+	openwallet.BlockchainDAIBase
+	db            *storm.DB
+	maxBlockCache uint64            //保留的本地区块头数量，0为不清理
+	prunedHeight  map[string]uint64 //各币种上次清理旧区块头时的高度
+	pruneLock     sync.Mutex
+}
+
+// NewLocalBlockchainDAI 打开本地区块链数据库文件，目录不存在时自动创建
+func NewLocalBlockchainDAI(dbFile string) (*LocalBlockchainDAI, error) {
+
+	if err := os.MkdirAll(filepath.Dir(dbFile), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	db, err := storm.Open(dbFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalBlockchainDAI{db: db, maxBlockCache: defaultMaxBlockCache, prunedHeight: make(map[string]uint64)}, nil
+}
+
+// Close 关闭数据库文件
+func (dai *LocalBlockchainDAI) Close() error {
+	return dai.db.Close()
+}
+
+// SaveCurrentBlockHead 保存当前扫描的区块头
+func (dai *LocalBlockchainDAI) SaveCurrentBlockHead(header *openwallet.BlockHeader) error {
+	return dai.db.Set(currentBlockHeaderBucket, header.Symbol, header)
+}
+
+// GetCurrentBlockHead 获取当前扫描的区块头，没有记录时返回空的区块头
+func (dai *LocalBlockchainDAI) GetCurrentBlockHead(symbol string) (*openwallet.BlockHeader, error) {
+	var header openwallet.BlockHeader
+	err := dai.db.Get(currentBlockHeaderBucket, symbol, &header)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return &header, nil
+}
+
+// SaveLocalBlockHead 保存本地区块头，同一高度的记录被覆盖。每保存localBlockPruneInterval个区块清理一次
+// 超过缓存数量的旧区块头，清理之间最多多保留localBlockPruneInterval个
+func (dai *LocalBlockchainDAI) SaveLocalBlockHead(header *openwallet.BlockHeader) error {
+
+	record := &localBlockHeader{
+		ID:     fmt.Sprintf("%s_%d", header.Symbol, header.Height),
+		Symbol: header.Symbol,
+		Height: header.Height,
+		Header: header,
+	}
+
+	err := dai.db.Save(record)
+	if err != nil {
+		return err
+	}
+
+	if dai.maxBlockCache == 0 || header.Height <= dai.maxBlockCache || !dai.shouldPrune(header.Symbol, header.Height) {
+		return nil
+	}
+
+	//清理旧的区块头
+	err = dai.db.Select(q.Eq("Symbol", header.Symbol), q.Lte("Height", header.Height-dai.maxBlockCache)).Delete(new(localBlockHeader))
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	return nil
+}
+
+//shouldPrune 距上次清理超过localBlockPruneInterval个区块时清理，回滚到上次清理高度以下时重新计算
+func (dai *LocalBlockchainDAI) shouldPrune(symbol string, height uint64) bool {
+	dai.pruneLock.Lock()
+	defer dai.pruneLock.Unlock()
+
+	last, ok := dai.prunedHeight[symbol]
+	if ok && height >= last && height < last+localBlockPruneInterval {
+		return false
+	}
+	if ok && height < last {
+		dai.prunedHeight[symbol] = height
+		return false
+	}
+	dai.prunedHeight[symbol] = height
+	return true
+}
+
+// GetLocalBlockHeadByHeight 获取本地区块头
+func (dai *LocalBlockchainDAI) GetLocalBlockHeadByHeight(height uint64, symbol string) (*openwallet.BlockHeader, error) {
+	var record localBlockHeader
+	err := dai.db.One("ID", fmt.Sprintf("%s_%d", symbol, height), &record)
+	if err != nil {
+		return nil, err
+	}
+	return record.Header, nil
+}
+
+// SaveUnscanRecord 保存未扫记录
+func (dai *LocalBlockchainDAI) SaveUnscanRecord(record *openwallet.UnscanRecord) error {
+	if record == nil {
+		return fmt.Errorf("the unscan record to save is nil")
+	}
+	return dai.db.Save(record)
+}
+
+// DeleteUnscanRecordByHeight 删除指定高度的未扫记录
+func (dai *LocalBlockchainDAI) DeleteUnscanRecordByHeight(height uint64, symbol string) error {
+	err := dai.db.Select(q.Eq("BlockHeight", height), q.Eq("Symbol", symbol)).Delete(new(openwallet.UnscanRecord))
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// DeleteUnscanRecordByID 删除指定ID的未扫记录
+func (dai *LocalBlockchainDAI) DeleteUnscanRecordByID(id string, symbol string) error {
+	var record openwallet.UnscanRecord
+	err := dai.db.One("ID", id, &record)
+	if err != nil {
+		return err
+	}
+	return dai.db.DeleteStruct(&record)
+}
+
+// GetUnscanRecords 获取所有未扫记录
+func (dai *LocalBlockchainDAI) GetUnscanRecords(symbol string) ([]*openwallet.UnscanRecord, error) {
+	var list []*openwallet.UnscanRecord
+	err := dai.db.Select(q.Eq("Symbol", symbol)).Find(&list)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return list, nil
+}
+
+// SetMaxBlockCache 设置保留的本地区块头数量
+func (dai *LocalBlockchainDAI) SetMaxBlockCache(max uint64, symbol string) error {
+	dai.maxBlockCache = max
+	return nil
+}
+
+// SetValue 保存键值数据，用于扫描器的其他持久化状态
+func (dai *LocalBlockchainDAI) SetValue(bucket string, key string, value interface{}) error {
+	return dai.db.Set(bucket, key, value)
+}
+
+// GetValue 获取键值数据，不存在时返回ErrKeyNotFound
+func (dai *LocalBlockchainDAI) GetValue(bucket string, key string, to interface{}) error {
+	return dai.db.Get(bucket, key, to)
+}
+
+// DeleteValue 删除键值数据
+func (dai *LocalBlockchainDAI) DeleteValue(bucket string, key string) error {
+	err := dai.db.Delete(bucket, key)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// Keys 列出bucket中的所有键
+func (dai *LocalBlockchainDAI) Keys(bucket string) ([]string, error) {
+	keys := make([]string, 0)
+	err := dai.db.Bolt.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			//跳过storm的元数据
+			if key := string(k); key != stormMetadataKey {
+				keys = append(keys, key)
+			}
+			return nil
+		})
+	})
+	return keys, err
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/asdine/storm"
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func TestLocalBlockchainDAI_BlockHead(t *testing.T) {
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+
+	//没有记录时返回空的区块头
+	header, err := dai.GetCurrentBlockHead("EOS")
+	if err != nil || header.Height != 0 {
+		t.Fatalf("empty block head = %+v, err: %v", header, err)
+	}
+
+	dai.SaveCurrentBlockHead(&openwallet.BlockHeader{Height: 100, Hash: "hash100", Symbol: "EOS"})
+	dai.SaveCurrentBlockHead(&openwallet.BlockHeader{Height: 7, Hash: "hash7", Symbol: "WAX"})
+
+	header, _ = dai.GetCurrentBlockHead("EOS")
+	if header.Height != 100 || header.Hash != "hash100" {
+		t.Errorf("EOS block head = %+v", header)
+	}
+	header, _ = dai.GetCurrentBlockHead("WAX")
+	if header.Height != 7 {
+		t.Errorf("WAX block head = %+v", header)
+	}
+}
+
+func TestLocalBlockchainDAI_PruneBlockHeaders(t *testing.T) {
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	dai.SetMaxBlockCache(10, "EOS")
+
+	for height := uint64(1); height <= 250; height++ {
+		err := dai.SaveLocalBlockHead(&openwallet.BlockHeader{Height: height, Hash: fmt.Sprintf("hash%d", height), Symbol: "EOS"})
+		if err != nil {
+			t.Fatalf("save block head failed: %v", err)
+		}
+	}
+	//分叉后同一高度覆盖
+	dai.SaveLocalBlockHead(&openwallet.BlockHeader{Height: 250, Hash: "fork250", Symbol: "EOS"})
+
+	//每100个区块清理一次，上次在区块211清理到201之前
+	if _, err := dai.GetLocalBlockHeadByHeight(201, "EOS"); err != storm.ErrNotFound {
+		t.Errorf("block 201 should be pruned, err: %v", err)
+	}
+	header, err := dai.GetLocalBlockHeadByHeight(202, "EOS")
+	if err != nil || header.Hash != "hash202" {
+		t.Errorf("block 202 = %+v, err: %v", header, err)
+	}
+	header, _ = dai.GetLocalBlockHeadByHeight(250, "EOS")
+	if header.Hash != "fork250" {
+		t.Errorf("block 250 hash = %s, want fork250", header.Hash)
+	}
+
+	var total []localBlockHeader
+	dai.db.All(&total)
+	if len(total) != 49 {
+		t.Errorf("block headers size = %d, want 49", len(total))
+	}
+}
+
+func TestLocalBlockchainDAI_UnscanRecords(t *testing.T) {
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+
+	dai.SaveUnscanRecord(openwallet.NewUnscanRecord(100, "tx1", "", "EOS"))
+	dai.SaveUnscanRecord(openwallet.NewUnscanRecord(100, "tx2", "", "EOS"))
+	dai.SaveUnscanRecord(openwallet.NewUnscanRecord(101, "", "", "EOS"))
+	dai.SaveUnscanRecord(openwallet.NewUnscanRecord(100, "", "", "WAX"))
+
+	records, _ := dai.GetUnscanRecords("EOS")
+	if len(records) != 3 {
+		t.Fatalf("EOS unscan records size = %d, want 3", len(records))
+	}
+
+	dai.DeleteUnscanRecordByHeight(100, "EOS")
+	records, _ = dai.GetUnscanRecords("EOS")
+	if len(records) != 1 || records[0].BlockHeight != 101 {
+		t.Errorf("EOS unscan records after delete = %d, want only block 101", len(records))
+	}
+	records, _ = dai.GetUnscanRecords("WAX")
+	if len(records) != 1 {
+		t.Errorf("WAX unscan records should not be deleted")
+	}
+
+	if err := dai.DeleteUnscanRecordByID(records[0].ID, "WAX"); err != nil {
+		t.Errorf("delete unscan record by id failed: %v", err)
+	}
+}
+
+func TestLocalBlockchainDAI_Value(t *testing.T) {
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+
+	var value uint64
+	if err := dai.GetValue("cursor", "backfill", &value); err != ErrKeyNotFound {
+		t.Errorf("get missing value err = %v", err)
+	}
+	dai.SetValue("cursor", "backfill", uint64(1024))
+	if err := dai.GetValue("cursor", "backfill", &value); err != nil || value != 1024 {
+		t.Errorf("value = %d, err: %v", value, err)
+	}
+	dai.DeleteValue("cursor", "backfill")
+	if err := dai.DeleteValue("cursor", "backfill"); err != nil {
+		t.Errorf("delete missing value err = %v", err)
+	}
+}
@@ -16,14 +16,16 @@
 package eosio
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/blocktree/openwallet/v2/common"
 
-	"github.com/blocktree/openwallet/v2/log"
 	"github.com/blocktree/openwallet/v2/openwallet"
 	"github.com/eoscanada/eos-go"
 )
@@ -39,21 +41,53 @@ type EOSBlockScanner struct {
 	*openwallet.BlockScannerBase
 
 	CurrentBlockHeight   uint64          //当前区块高度
-	extractingCH         chan struct{}   //扫描工作令牌
 	wm                   *WalletManager  //钱包管理者
 	IsScanMemPool        bool            //是否扫描交易池
 	RescanLastBlockCount uint64          //重扫上N个区块数量
 	MonitorActions       map[string]bool //监控的操作
+	//订阅的合约操作，格式为 contract::action，action为*时订阅合约所有操作
+	MonitorContractActions map[string]bool
+	//受信任的代币登记表
+	TokenRegistry *TokenRegistry
+	//充值备注路由，为空时以备注作为地址通过ScanTargetFunc查找
+	MemoResolver MemoResolverFunc
+	//扫描器状态的持久化存储，为空时使用实现了KeyValueStore的BlockchainDAI
+	StateStore KeyValueStore
+	//区块数据来源，为空时通过节点RPC获取
+	BlockSource BlockSource
+
+	finalizing       map[uint64]*finalizingBlock //等待不可逆的区块提取数据
+	finalizedHeight  uint64                      //已发送确认通知的高度
+	finalizingLoaded bool                        //是否已从持久化存储加载
+	finalizingLock   sync.Mutex
+
+	tracking         map[string]*TrackedTransaction //没有持久化存储时跟踪中的已广播交易
+	trackingLock     sync.Mutex
+	trackingChecking int32 //后台查询跟踪交易的任务是否在运行
+
+	lastDeliveredPrune time.Time //上次清理送达记录的时间
+	deliverLocks       keyLocks  //按通知键串行投递
+
+	shipRescan     *ShipClient //重扫区块复用的state history连接
+	shipRescanLock sync.Mutex
+
+	ctx     context.Context    //扫描任务的上下文
+	cancel  context.CancelFunc //取消扫描任务
+	ctxLock sync.Mutex
 }
 
 //ExtractResult extract result
 type ExtractResult struct {
-	extractData map[string][]*openwallet.TxExtractData
-	TxID        string
-	BlockHash   string
-	BlockHeight uint64
-	BlockTime   int64
-	Success     bool
+	extractData         map[string][]*openwallet.TxExtractData
+	extractContractData map[string][]*openwallet.SmartContractReceipt //每个源标识每个合约一个回执
+	scanTargetFuncV2    openwallet.BlockScanTargetFuncV2              //查找合约的扫描对象，为空时使用ScanTargetFuncV2
+	TxID                string
+	BlockHash           string
+	BlockHeight         uint64
+	BlockTime           int64
+	BlockProducer       string                       //出块节点
+	receipt             eos.TransactionReceiptHeader //交易回执，包含执行状态和资源使用量
+	Success             bool
 }
 
 //SaveResult result
@@ -69,13 +103,16 @@ func NewEOSBlockScanner(wm *WalletManager) *EOSBlockScanner {
 		BlockScannerBase: openwallet.NewBlockScannerBase(),
 	}
 
-	bs.extractingCH = make(chan struct{}, maxExtractingSize)
 	bs.wm = wm
 	bs.IsScanMemPool = true
 	bs.RescanLastBlockCount = 2
 	bs.MonitorActions = map[string]bool{
 		"transfer": true,
 	}
+	bs.MonitorContractActions = make(map[string]bool)
+	bs.TokenRegistry = NewTokenRegistry()
+	bs.finalizing = make(map[uint64]*finalizingBlock)
+	bs.tracking = make(map[string]*TrackedTransaction)
 
 	// set task
 	bs.SetTask(bs.ScanBlockTask)
@@ -86,9 +123,17 @@ func NewEOSBlockScanner(wm *WalletManager) *EOSBlockScanner {
 // ScanBlockTask scan block task
 func (bs *EOSBlockScanner) ScanBlockTask() {
 
+	//配置了state history，通过websocket推送扫描
+	if len(bs.wm.Config.ShipAPI) > 0 {
+		bs.ScanShipBlockTask()
+		return
+	}
+
 	var (
+		ctx           = bs.context()
 		currentHeight uint32
 		currentHash   string
+		retries       uint32
 	)
 
 	// get local block header
@@ -99,19 +144,21 @@ func (bs *EOSBlockScanner) ScanBlockTask() {
 	}
 
 	if currentHeight == 0 {
-		bs.wm.Log.Std.Info("No records found in local, get current block as the local!")
-
-		headBlock, err := bs.GetGlobalHeadBlock()
-		if err != nil {
-			bs.wm.Log.Std.Info("get head block error, err=%v", err)
+		for {
+			currentHeight, currentHash, err = bs.initialBlockHead()
+			if err == nil {
+				break
+			}
+			bs.wm.Log.Std.Info("get start block error, err=%v", err)
+			if !bs.waitRetry(ctx, &retries) {
+				return
+			}
 		}
-
-		currentHash = headBlock.Previous.String()
-		currentHeight = headBlock.BlockNum - 1
+		retries = 0
 	}
 
 	for {
-		if !bs.Scanning {
+		if ctx.Err() != nil {
 			// stop scan
 			return
 		}
@@ -119,10 +166,17 @@ func (bs *EOSBlockScanner) ScanBlockTask() {
 		infoResp, err := bs.GetChainInfo()
 		if err != nil {
 			bs.wm.Log.Errorf("get chain info failed, err=%v", err)
-			break
+			//节点异常时退避重试，不放弃本轮扫描
+			if !bs.waitRetry(ctx, &retries) {
+				break
+			}
+			continue
 		}
 
-		maxBlockHeight := infoResp.HeadBlockNum
+		maxBlockHeight := bs.scanMaxBlockHeight(infoResp)
+
+		//发送已进入不可逆区块的确认通知
+		bs.notifyFinalizedData(uint64(infoResp.LastIrreversibleBlockNum))
 
 		bs.wm.Log.Info("current block height:", currentHeight, " maxBlockHeight:", maxBlockHeight)
 		if currentHeight >= maxBlockHeight {
@@ -130,78 +184,45 @@ func (bs *EOSBlockScanner) ScanBlockTask() {
 			break
 		}
 
-		// next block
-		currentHeight = currentHeight + 1
-
-		bs.wm.Log.Std.Info("block scanner scanning height: %d ...", currentHeight)
-		block, err := bs.wm.Api.GetBlockByNum(currentHeight)
-
+		//并发预取区块，按高度顺序提交
+		currentHeight, currentHash, err = bs.scanBlocks(ctx, currentHeight+1, maxBlockHeight, currentHash)
 		if err != nil {
-			bs.wm.Log.Std.Info("block scanner can not get new block data by rpc; unexpected error: %v", err)
-			break
-		}
-
-		if currentHash != block.Previous.String() {
-			bs.wm.Log.Std.Info("block has been fork on height: %d.", currentHeight)
-			bs.wm.Log.Std.Info("block height: %d local hash = %s ", currentHeight-1, currentHash)
-			bs.wm.Log.Std.Info("block height: %d mainnet hash = %s ", currentHeight-1, block.Previous.String())
-			bs.wm.Log.Std.Info("delete recharge records on block height: %d.", currentHeight-1)
-
-			// get local fork bolck
-			forkBlock, _ := bs.GetLocalBlock(currentHeight - 1)
-			// delete last unscan block
-			bs.DeleteUnscanRecord(currentHeight - 1)
-			currentHeight = currentHeight - 2 // scan back to last 2 block
-			if currentHeight <= 0 {
-				currentHeight = 1
-			}
-			localBlock, err := bs.GetLocalBlock(currentHeight)
-			if err != nil {
-				bs.wm.Log.Std.Error("block scanner can not get local block; unexpected error: %v", err)
-				//get block from rpc
-				bs.wm.Log.Info("block scanner prev block height:", currentHeight)
-				curBlock, err := bs.wm.Api.GetBlockByNum(currentHeight)
-				if err != nil {
-					bs.wm.Log.Std.Error("block scanner can not get prev block by rpc; unexpected error: %v", err)
-					break
-				}
-				currentHash = curBlock.ID.String()
-			} else {
-				//重置当前区块的hash
-				currentHash = localBlock.Hash
-			}
-			bs.wm.Log.Std.Info("rescan block on height: %d, hash: %s .", currentHeight, currentHash)
-
-			//重新记录一个新扫描起点
-			bs.SaveLocalBlockHead(currentHeight, currentHash)
-
-			if forkBlock != nil {
-				//通知分叉区块给观测者，异步处理
-				bs.forkBlockNotify(forkBlock)
+			if ctx.Err() != nil || !bs.waitRetry(ctx, &retries) {
+				break
 			}
+			continue
+		}
+		retries = 0
+	}
 
-		} else {
-			currentHash = block.ID.String()
-			err := bs.BatchExtractTransactions(uint64(currentHeight), currentHash, block.Timestamp.Unix(), block.Transactions)
-			if err != nil {
-				bs.wm.Log.Std.Error("block scanner ran BatchExtractTransactions occured unexpected error: %v", err)
-			}
+	if ctx.Err() != nil {
+		return
+	}
 
-			//保存本地新高度
-			bs.SaveLocalBlockHead(currentHeight, currentHash)
-			bs.SaveLocalBlock(ParseBlock(block))
-			//通知新区块给观测者，异步处理
-			bs.newBlockNotify(block)
+	//重扫前N个块，为保证记录找到，不可逆区块不会分叉，无需重扫
+	if bs.wm.Config.ScanMode != ScanModeIrreversible {
+		for i := currentHeight - uint32(bs.RescanLastBlockCount); i <= currentHeight; i++ {
+			bs.scanBlock(uint64(i))
 		}
 	}
 
-	//重扫前N个块，为保证记录找到
-	for i := currentHeight - uint32(bs.RescanLastBlockCount); i <= currentHeight; i++ {
-		bs.scanBlock(uint64(i))
-	}
+	bs.runRetryTasks()
+}
+
+//runRetryTasks 扫描任务的周期性工作
+func (bs *EOSBlockScanner) runRetryTasks() {
 
 	//重扫失败区块
 	bs.RescanFailedRecord()
+
+	//重试失败的通知
+	bs.RetryFailedNotifications()
+
+	//查询已广播交易的状态，在后台执行
+	bs.startTrackedTransactionsCheck()
+
+	//清理不可逆区块之前的送达记录
+	bs.pruneDelivered()
 }
 
 //newBlockNotify 获得新区块后，通知给观测者
@@ -219,13 +240,17 @@ func (bs *EOSBlockScanner) newBlockNotify(block *eos.BlockResp) {
 
 // BatchExtractTransactions 批量提取交易单
 func (bs *EOSBlockScanner) BatchExtractTransactions(blockHeight uint64, blockHash string, blockTime int64, transactions []eos.TransactionReceipt) error {
+	return bs.batchExtractTransactions(blockHeight, blockHash, blockTime, "", transactions, nil)
+}
 
-	var (
-		quit       = make(chan struct{})
-		done       = 0 //完成标记
-		failed     = 0
-		shouldDone = len(transactions) //需要完成的总数
-	)
+//batchExtractBlock 批量提取区块中的交易单
+func (bs *EOSBlockScanner) batchExtractBlock(block *eos.BlockResp, traces map[string][]*ActionTrace) error {
+	return bs.batchExtractTransactions(uint64(block.BlockNum), block.ID.String(), block.Timestamp.Unix(), string(block.Producer), block.Transactions, traces)
+}
+
+//batchExtractTransactions 批量提取交易单，producer为出块节点，traces为区块已包含的交易追踪，例如SHiP推送的追踪。
+//交易并发提取，按交易在区块中的顺序通知
+func (bs *EOSBlockScanner) batchExtractTransactions(blockHeight uint64, blockHash string, blockTime int64, producer string, transactions []eos.TransactionReceipt, traces map[string][]*ActionTrace) error {
 
 	if len(transactions) == 0 {
 		return nil
@@ -233,62 +258,37 @@ func (bs *EOSBlockScanner) BatchExtractTransactions(blockHeight uint64, blockHas
 
 	bs.wm.Log.Std.Info("block scanner ready extract transactions total: %d ", len(transactions))
 
-	//生产通道
-	producer := make(chan ExtractResult)
-	defer close(producer)
-
-	//消费通道
-	worker := make(chan ExtractResult)
-	defer close(worker)
-
-	//保存工作
-	saveWork := func(height uint64, result chan ExtractResult) {
-		//回收创建的地址
-		for gets := range result {
-
-			if gets.Success {
-				notifyErr := bs.newExtractDataNotify(height, gets.extractData)
-				if notifyErr != nil {
-					failed++ //标记保存失败数
-					bs.wm.Log.Std.Info("newExtractDataNotify unexpected error: %v", notifyErr)
-				}
-			} else {
-				//记录未扫区块
-				unscanRecord := openwallet.NewUnscanRecord(height, "", "", bs.wm.Symbol())
-				bs.SaveUnscanRecord(unscanRecord)
-				failed++ //标记保存失败数
-			}
-			//累计完成的线程数
-			done++
-			if done == shouldDone {
-				close(quit) //关闭通道，等于给通道传入nil
-			}
-		}
+	//每笔交易一个结果通道，由固定数量的工作协程提取，结果通道有缓冲，工作协程不会阻塞
+	results := make([]chan ExtractResult, len(transactions))
+	jobs := make(chan int, len(transactions))
+	for i := range results {
+		results[i] = make(chan ExtractResult, 1)
+		jobs <- i
 	}
+	close(jobs)
 
-	//提取工作
-	extractWork := func(eblockHeight uint64, eBlockHash string, eBlockTime int64, mTransactions []eos.TransactionReceipt, eProducer chan ExtractResult) {
-		for _, tx := range mTransactions {
-			bs.extractingCH <- struct{}{}
-			go func(mBlockHeight uint64, mTx eos.TransactionReceipt, end chan struct{}, mProducer chan<- ExtractResult) {
+	workers := maxExtractingSize
+	if len(transactions) < workers {
+		workers = len(transactions)
+	}
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range jobs {
+				mTx := transactions[i]
 				//导出提出的交易
-				mProducer <- bs.ExtractTransaction(mBlockHeight, eBlockHash, eBlockTime, mTx, bs.ScanTargetFunc)
-				//释放
-				<-end
+				txTraces, ok := traces[mTx.Transaction.ID.String()]
+				results[i] <- bs.extractTransaction(blockHeight, blockHash, blockTime, producer, mTx, txTraces, ok, bs.ScanTargetFunc)
+			}
+		}()
+	}
 
-			}(eblockHeight, tx, bs.extractingCH, eProducer)
+	//按交易顺序保存
+	failed := 0
+	for _, result := range results {
+		if err := bs.saveExtractResult(blockHeight, <-result); err != nil {
+			failed++ //标记保存失败数
 		}
 	}
-	/*	开启导出的线程	*/
-
-	//独立线程运行消费
-	go saveWork(blockHeight, worker)
-
-	//独立线程运行生产
-	go extractWork(blockHeight, blockHash, blockTime, transactions, producer)
-
-	//以下使用生产消费模式
-	bs.extractRuntime(producer, worker, quit)
 
 	if failed > 0 {
 		return fmt.Errorf("block scanner saveWork failed")
@@ -297,53 +297,71 @@ func (bs *EOSBlockScanner) BatchExtractTransactions(blockHeight uint64, blockHas
 	return nil
 }
 
-//extractRuntime 提取运行时
-func (bs *EOSBlockScanner) extractRuntime(producer chan ExtractResult, worker chan ExtractResult, quit chan struct{}) {
+// ExtractTransaction 提取交易单
+func (bs *EOSBlockScanner) ExtractTransaction(blockHeight uint64, blockHash string, blockTime int64, transaction eos.TransactionReceipt, scanTargetFunc openwallet.BlockScanTargetFunc) ExtractResult {
+	return bs.extractTransaction(blockHeight, blockHash, blockTime, "", transaction, nil, false, scanTargetFunc)
+}
 
+//extractTransaction 提取交易单，hasTraces为true时使用已获取的交易追踪traces提取
+func (bs *EOSBlockScanner) extractTransaction(blockHeight uint64, blockHash string, blockTime int64, producer string, transaction eos.TransactionReceipt, traces []*ActionTrace, hasTraces bool, scanTargetFunc openwallet.BlockScanTargetFunc) ExtractResult {
 	var (
-		values = make([]ExtractResult, 0)
+		result = ExtractResult{
+			BlockHash:     blockHash,
+			BlockHeight:   blockHeight,
+			TxID:          transaction.Transaction.ID.String(),
+			extractData:   make(map[string][]*openwallet.TxExtractData),
+			BlockTime:     blockTime,
+			BlockProducer: producer,
+			receipt:       transaction.TransactionReceiptHeader,
+		}
 	)
 
-	for {
-		var activeWorker chan<- ExtractResult
-		var activeValue ExtractResult
-		//当数据队列有数据时，释放顶部，传输给消费者
-		if len(values) > 0 {
-			activeWorker = worker
-			activeValue = values[0]
-		}
-		select {
-		//生成者不断生成数据，插入到数据队列尾部
-		case pa := <-producer:
-			values = append(values, pa)
-		case <-quit:
-			//退出
-			return
-		case activeWorker <- activeValue:
-			values = values[1:]
+	if transaction.Status != eos.TransactionStatusExecuted {
+		return bs.extractFailedTransaction(&result, transaction, scanTargetFunc)
+	}
+
+	if scanTargetFunc == nil {
+		bs.wm.Log.Std.Error("scanTargetFunc is not configurated")
+		return ExtractResult{Success: false}
+	}
+
+	if hasTraces {
+		return bs.ExtractTransactionTraces(&result, traces, scanTargetFunc)
+	}
+
+	//通过交易追踪提取，包含内联转账
+	if bs.wm.Config.ScanActionTraces {
+		traces, err := bs.GetTransactionTraces(result.TxID)
+		if err != nil {
+			bs.wm.Log.Std.Error("get transaction: %s traces failed, err: %v", result.TxID, err)
+			return ExtractResult{Success: false}
 		}
+		return bs.ExtractTransactionTraces(&result, traces, scanTargetFunc)
 	}
-	//return
+
+	return bs.extractPackedTransaction(&result, transaction, scanTargetFunc)
 }
 
-// ExtractTransaction 提取交易单
-func (bs *EOSBlockScanner) ExtractTransaction(blockHeight uint64, blockHash string, blockTime int64, transaction eos.TransactionReceipt, scanTargetFunc openwallet.BlockScanTargetFunc) ExtractResult {
-	var (
-		success = true
-		result  = ExtractResult{
-			BlockHash:   blockHash,
-			BlockHeight: blockHeight,
-			TxID:        transaction.Transaction.ID.String(),
-			extractData: make(map[string][]*openwallet.TxExtractData),
-			BlockTime:   blockTime,
-		}
-	)
+//extractFailedTransaction 未成功执行的交易。配置了上报失败交易时，提取打包交易中的转账，状态为失败，
+//延迟执行的交易和只有交易ID的回执无法提取
+func (bs *EOSBlockScanner) extractFailedTransaction(result *ExtractResult, transaction eos.TransactionReceipt, scanTargetFunc openwallet.BlockScanTargetFunc) ExtractResult {
 
-	if transaction.Status != eos.TransactionStatusExecuted {
+	if !bs.wm.Config.ReportFailedTransactions || transaction.Status == eos.TransactionStatusDelayed || transaction.Transaction.Packed == nil {
 		bs.wm.Log.Std.Debug("transaction did not executed: %s", transaction.Transaction.ID)
 		return ExtractResult{Success: true}
 	}
 
+	if scanTargetFunc == nil {
+		bs.wm.Log.Std.Error("scanTargetFunc is not configurated")
+		return ExtractResult{Success: false}
+	}
+
+	return bs.extractPackedTransaction(result, transaction, scanTargetFunc)
+}
+
+//extractPackedTransaction 提取打包交易中的操作，不包含内联转账
+func (bs *EOSBlockScanner) extractPackedTransaction(result *ExtractResult, transaction eos.TransactionReceipt, scanTargetFunc openwallet.BlockScanTargetFunc) ExtractResult {
+
 	//提出交易单明细
 	if transaction.Transaction.Packed == nil {
 		bs.wm.Log.Std.Debug("trx packed empty: %s", transaction.Transaction.ID)
@@ -355,62 +373,228 @@ func (bs *EOSBlockScanner) ExtractTransaction(blockHeight uint64, blockHash stri
 		return ExtractResult{Success: true}
 	}
 
-	for _, action := range signedTransaction.Actions {
+	for i, action := range signedTransaction.Actions {
+		if err := bs.extractAction(action, uint64(i), 0, result, scanTargetFunc); err != nil {
+			bs.wm.Log.Std.Error("extract action failed, err: %v", err)
+			return ExtractResult{Success: false}
+		}
+	}
+	result.Success = true
+	return *result
+}
 
-		if _, exist := bs.MonitorActions[string(action.Name)]; exist {
-			//if action.Name == "transfer" {
+// ExtractTransactionTraces 提取交易追踪中所有已执行的操作，包括内联操作，traces为FlattenActionTraces的结果
+func (bs *EOSBlockScanner) ExtractTransactionTraces(result *ExtractResult, traces []*ActionTrace, scanTargetFunc openwallet.BlockScanTargetFunc) ExtractResult {
 
-			abiInfo, err := bs.wm.ContractDecoder.GetABIInfo(string(action.Account))
-			if err != nil {
-				bs.wm.Log.Std.Error("get ABI: %s", err)
-				return ExtractResult{Success: false}
-			}
-			// use abi to get data bytes
-			abi, ok := abiInfo.ABI.(*eos.ABI)
-			if !ok {
-				bs.wm.Log.Std.Error("convert abi error")
-				return ExtractResult{Success: false}
-			}
-			bytes, err := abi.DecodeAction(action.HexData, action.Name)
-			if err != nil {
-				bs.wm.Log.Std.Error("decode action error: %s", err)
-				return ExtractResult{Success: true}
-			}
+	for _, trace := range traces {
+		if err := bs.extractAction(trace.Action, trace.ordinal(), uint64(trace.Receipt.GlobalSequence), result, scanTargetFunc); err != nil {
+			bs.wm.Log.Std.Error("extract action trace failed, err: %v", err)
+			return ExtractResult{Success: false}
+		}
+	}
+	result.Success = true
+	return *result
+}
 
-			var data TransferData
+// GetTransactionTraces 获取交易的操作追踪，按执行顺序返回合约自身执行的追踪，忽略通知接收者的追踪
+func (bs *EOSBlockScanner) GetTransactionTraces(txid string) ([]*ActionTrace, error) {
+	resp, err := bs.GetTransactionTraceResp(txid)
+	if err != nil {
+		return nil, err
+	}
 
-			_err := json.Unmarshal(bytes, &data)
-			if _err != nil {
-				bs.wm.Log.Std.Info("parse data error: %s", _err)
-				return ExtractResult{Success: true}
-			}
+	return FlattenActionTraces(resp.Traces), nil
+}
+
+// GetTransactionTraceResp 通过history插件查询交易，操作追踪包含节点分配的操作序号
+func (bs *EOSBlockScanner) GetTransactionTraceResp(txid string) (*TransactionTraceResp, error) {
+	api := bs.wm.TraceApi
+	if api == nil {
+		api = bs.wm.Api
+	}
+
+	raw, err := api.GetTransactionRaw(txid)
+	if err != nil {
+		return nil, err
+	}
 
-			if scanTargetFunc == nil {
-				bs.wm.Log.Std.Error("scanTargetFunc is not configurated")
-				return ExtractResult{Success: false}
+	var resp TransactionTraceResp
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// FlattenActionTraces 展开内联追踪，按global_sequence去重排序，只保留合约自身执行的追踪。
+// 1.8之前的节点没有操作序号，按节点分配序号的规则补充：顶层操作依次为1~N，与打包交易的下标一致，内联操作按执行顺序排在之后
+func FlattenActionTraces(traces []ActionTrace) []*ActionTrace {
+	var (
+		seen   = make(map[uint64]bool)
+		inline = make(map[uint64]bool)
+		result = make([]*ActionTrace, 0)
+		walk   func(trace *ActionTrace, nested bool)
+	)
+
+	walk = func(trace *ActionTrace, nested bool) {
+		if trace == nil {
+			return
+		}
+		seq := uint64(trace.Receipt.GlobalSequence)
+		//history插件会同时返回展开的追踪，出现在内联追踪中的都是内联操作
+		if nested {
+			inline[seq] = true
+		}
+		if !seen[seq] {
+			seen[seq] = true
+			//通知接收者的追踪与合约执行的是同一个操作，跳过避免重复
+			if trace.Action != nil && trace.Receipt.Receiver == trace.Action.Account {
+				result = append(result, trace)
 			}
+		}
+		//1.8之前的节点以嵌套返回内联追踪，没有操作序号
+		for _, it := range trace.InlineTraces {
+			if it != nil {
+				walk(&ActionTrace{ActionTrace: *it}, true)
+			}
+		}
+	}
 
-			//订阅地址为交易单中的发送者
-			accountID1, ok1 := scanTargetFunc(openwallet.ScanTarget{Alias: data.From, Symbol: bs.wm.Symbol(), BalanceModelType: openwallet.BalanceModelTypeAccount})
-			//订阅地址为交易单中的接收者
-			accountID2, ok2 := scanTargetFunc(openwallet.ScanTarget{Alias: data.To, Symbol: bs.wm.Symbol(), BalanceModelType: openwallet.BalanceModelTypeAccount})
-			if accountID1 == accountID2 && len(accountID1) > 0 && len(accountID2) > 0 {
-				bs.InitExtractResult(accountID1, TransferAction{action, data}, &result, 0)
-			} else {
-				if ok1 {
-					bs.InitExtractResult(accountID1, TransferAction{action, data}, &result, 1)
-				}
+	for i := range traces {
+		trace := traces[i]
+		walk(&trace, false)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Receipt.GlobalSequence < result[j].Receipt.GlobalSequence
+	})
 
-				if ok2 {
-					bs.InitExtractResult(accountID2, TransferAction{action, data}, &result, 2)
+	for _, trace := range result {
+		if trace.ActionOrdinal > 0 {
+			continue
+		}
+		ordinal := uint32(0)
+		for _, nested := range []bool{false, true} {
+			for _, trace := range result {
+				if inline[uint64(trace.Receipt.GlobalSequence)] == nested {
+					ordinal++
+					trace.ActionOrdinal = ordinal
 				}
 			}
-
 		}
+		break
 	}
-	result.Success = success
+
 	return result
+}
+
+//extractAction 提取操作中的转账数据，ordinal为操作在交易中的序号，返回错误表示需要重扫
+func (bs *EOSBlockScanner) extractAction(action *eos.Action, ordinal, globalSequence uint64, result *ExtractResult, scanTargetFunc openwallet.BlockScanTargetFunc) error {
+
+	if action == nil {
+		return nil
+	}
+
+	//订阅的合约操作，失败交易的操作没有被执行，不通知
+	if result.receipt.Status == eos.TransactionStatusExecuted {
+		if err := bs.extractContractAction(action, result); err != nil {
+			return err
+		}
+	}
+
+	if _, exist := bs.MonitorActions[string(action.Name)]; !exist {
+		return nil
+	}
+
+	data, err := bs.decodeTransferData(action)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return nil
+	}
+
+	//严格模式丢弃未登记或精度不一致的代币转账
+	if err := bs.checkTrustedToken(string(action.Account), data.Quantity.Symbol); err != nil && bs.wm.Config.StrictTokenMode {
+		bs.wm.Log.Std.Info("drop untrusted token transfer: %v", err)
+		return nil
+	}
+
+	transfer := TransferAction{Action: action, TransferData: *data, Ordinal: ordinal, GlobalSequence: globalSequence}
+
+	//订阅地址为交易单中的发送者
+	accountID1, ok1 := scanTargetFunc(openwallet.ScanTarget{Alias: data.From, Symbol: bs.wm.Symbol(), BalanceModelType: openwallet.BalanceModelTypeAccount})
+	//订阅地址为交易单中的接收者，接收者为充值账户时按备注路由
+	accountID2, ok2 := bs.resolveReceiver(&transfer, scanTargetFunc)
+	if accountID1 == accountID2 && len(accountID1) > 0 && len(accountID2) > 0 {
+		bs.InitExtractResult(accountID1, transfer, result, 0)
+	} else {
+		if ok1 {
+			bs.InitExtractResult(accountID1, transfer, result, 1)
+		}
+
+		if ok2 {
+			bs.InitExtractResult(accountID2, transfer, result, 2)
+		}
+	}
 
+	return nil
+}
+
+//decodeTransferData 通过ABI解析转账数据，无法解析的数据返回nil
+func (bs *EOSBlockScanner) decodeTransferData(action *eos.Action) (*TransferData, error) {
+
+	var (
+		data TransferData
+	)
+
+	bytes, err := bs.decodeActionData(action)
+	if err != nil {
+		return nil, err
+	}
+	if bytes == nil {
+		return nil, nil
+	}
+
+	err = json.Unmarshal(bytes, &data)
+	if err != nil {
+		bs.wm.Log.Std.Info("parse data error: %s", err)
+		return nil, nil
+	}
+
+	//没有代币数量的不是代币转账，例如NFT合约的transfer
+	if len(data.Quantity.Symbol.Symbol) == 0 {
+		return nil, nil
+	}
+
+	return &data, nil
+}
+
+//decodeActionData 通过ABI解析操作数据为json，无法解析的数据返回nil
+func (bs *EOSBlockScanner) decodeActionData(action *eos.Action) ([]byte, error) {
+
+	if len(action.HexData) > 0 {
+		abiInfo, err := bs.wm.ContractDecoder.GetABIInfo(string(action.Account))
+		if err != nil {
+			return nil, fmt.Errorf("get ABI: %s", err)
+		}
+		// use abi to get data bytes
+		abi, ok := abiInfo.ABI.(*eos.ABI)
+		if !ok {
+			return nil, fmt.Errorf("convert abi error")
+		}
+		bytes, err := abi.DecodeAction(action.HexData, action.Name)
+		if err != nil {
+			bs.wm.Log.Std.Error("decode action error: %s", err)
+			return nil, nil
+		}
+		return bytes, nil
+	} else if action.Data != nil {
+		//追踪接口返回已解析的data
+		bytes, _ := json.Marshal(action.Data)
+		return bytes, nil
+	}
+
+	return nil, nil
 }
 
 //InitExtractResult optType = 0: 输入输出提取，1: 输入提取，2：输出提取
@@ -428,6 +612,12 @@ func (bs *EOSBlockScanner) InitExtractResult(sourceKey string, action TransferAc
 	status := "1"
 	reason := ""
 
+	//未成功执行的交易
+	if result.receipt.Status != eos.TransactionStatusExecuted {
+		status = "0"
+		reason = fmt.Sprintf("transaction %s", result.receipt.Status)
+	}
+
 	symbol := data.Quantity.Symbol.Symbol
 	decimals := int32(data.Quantity.Symbol.Precision)
 	amount := common.NewString(data.Quantity.Amount).String()
@@ -463,8 +653,29 @@ func (bs *EOSBlockScanner) InitExtractResult(sourceKey string, action TransferAc
 	}
 
 	transx.SetExtParam("memo", data.Memo)
+	transx.SetExtParam("actionOrdinal", action.Ordinal)
+	if action.GlobalSequence > 0 {
+		transx.SetExtParam("globalSequence", action.GlobalSequence)
+	}
+	if len(action.MemoAddress) > 0 {
+		transx.SetExtParam("memoAddress", action.MemoAddress)
+	}
 
-	wxID := openwallet.GenTransactionWxID(transx)
+	//交易回执的资源使用量和执行状态，以及出块节点
+	transx.SetExtParam("cpu_usage_us", result.receipt.CPUUsageMicroSeconds)
+	transx.SetExtParam("net_usage_words", uint32(result.receipt.NetUsageWords))
+	transx.SetExtParam("status", result.receipt.Status.String())
+	if len(result.BlockProducer) > 0 {
+		transx.SetExtParam("producer", result.BlockProducer)
+	}
+
+	//标记不受信任的代币
+	if err := bs.checkTrustedToken(string(action.Account), data.Quantity.Symbol); err != nil {
+		transx.SetExtParam("untrusted", true)
+		transx.SetExtParam("untrustedReason", err.Error())
+	}
+
+	wxID := genActionWxID(transx, action.Ordinal)
 	transx.WxID = wxID
 
 	txExtractData.Transaction = transx
@@ -481,6 +692,14 @@ func (bs *EOSBlockScanner) InitExtractResult(sourceKey string, action TransferAc
 	result.extractData[sourceKey] = txExtractDataArray
 }
 
+//genActionWxID 交易单中每个转账操作的WxID，第一个操作与按交易生成的WxID一致
+func genActionWxID(tx *openwallet.Transaction, ordinal uint64) string {
+	if ordinal == 0 {
+		return openwallet.GenTransactionWxID(tx)
+	}
+	return openwallet.GenTransactionWxID2(fmt.Sprintf("%s_%d", tx.TxID, ordinal), tx.Coin.Symbol, tx.Coin.ContractID)
+}
+
 //extractTxInput 提取交易单输入部分,无需手续费，所以只包含1个TxInput
 func (bs *EOSBlockScanner) extractTxInput(action TransferAction, txExtractData *openwallet.TxExtractData) {
 
@@ -490,7 +709,7 @@ func (bs *EOSBlockScanner) extractTxInput(action TransferAction, txExtractData *
 
 	//主网from交易转账信息，第一个TxInput
 	txInput := &openwallet.TxInput{}
-	txInput.Recharge.Sid = openwallet.GenTxInputSID(tx.TxID, bs.wm.Symbol(), coin.ContractID, uint64(0))
+	txInput.Recharge.Sid = openwallet.GenTxInputSID(tx.TxID, bs.wm.Symbol(), coin.ContractID, action.Ordinal)
 	txInput.Recharge.TxID = tx.TxID
 	txInput.Recharge.Address = data.From
 	txInput.Recharge.Coin = coin
@@ -514,9 +733,13 @@ func (bs *EOSBlockScanner) extractTxOutput(action TransferAction, txExtractData
 
 	//主网to交易转账信息,只有一个TxOutPut
 	txOutput := &openwallet.TxOutPut{}
-	txOutput.Recharge.Sid = openwallet.GenTxOutPutSID(tx.TxID, bs.wm.Symbol(), coin.ContractID, uint64(0))
+	txOutput.Recharge.Sid = openwallet.GenTxOutPutSID(tx.TxID, bs.wm.Symbol(), coin.ContractID, action.Ordinal)
 	txOutput.Recharge.TxID = tx.TxID
 	txOutput.Recharge.Address = data.To
+	//备注充值记到备注地址
+	if len(action.MemoAddress) > 0 {
+		txOutput.Recharge.Address = action.MemoAddress
+	}
 	txOutput.Recharge.Coin = coin
 	txOutput.Recharge.Amount = tx.Amount
 	txOutput.Recharge.Symbol = coin.Symbol
@@ -535,22 +758,11 @@ func (bs *EOSBlockScanner) newExtractDataNotify(height uint64, extractData map[s
 		return nil
 	}
 
-	for o := range bs.Observers {
-		for key, array := range extractData {
-			for _, item := range array {
-				err := o.BlockExtractDataNotify(key, item)
-				if err != nil {
-					log.Error("BlockExtractDataNotify unexpected error:", err)
-					//记录未扫区块
-					unscanRecord := openwallet.NewUnscanRecord(height, "", "ExtractData Notify failed.", bs.wm.Symbol())
-					err = bs.SaveUnscanRecord(unscanRecord)
-					if err != nil {
-						log.Std.Error("block height: %d, save unscan record failed. unexpected error: %v", height, err.Error())
-					}
-
-				}
-			}
-
+	//按操作顺序通知，已送达的不再通知
+	ordered := orderedExtractData(extractData)
+	for _, o := range bs.observers() {
+		for _, item := range ordered {
+			bs.deliver(o, height, &NotifyOutboxEntry{SourceKey: item.sourceKey, Sid: extractDataSid(item.data), ExtractData: item.data})
 		}
 	}
 
@@ -573,7 +785,7 @@ func (bs *EOSBlockScanner) ScanBlock(height uint64) error {
 
 func (bs *EOSBlockScanner) scanBlock(height uint64) (*eos.BlockResp, error) {
 
-	block, err := bs.wm.Api.GetBlockByNum(uint32(height))
+	block, err := bs.getBlockByNum(uint32(height))
 	if err != nil {
 		bs.wm.Log.Std.Info("block scanner can not get new block data; unexpected error: %v", err)
 
@@ -586,7 +798,7 @@ func (bs *EOSBlockScanner) scanBlock(height uint64) (*eos.BlockResp, error) {
 
 	bs.wm.Log.Std.Info("block scanner scanning height: %d ...", height)
 
-	err = bs.BatchExtractTransactions(uint64(block.BlockNum), block.ID.String(), block.Timestamp.Unix(), block.Transactions)
+	err = bs.batchExtractBlock(block, nil)
 	if err != nil {
 		bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
 	}
@@ -600,7 +812,7 @@ func (bs *EOSBlockScanner) SetRescanBlockHeight(height uint64) error {
 		return errors.New("block height to rescan must greater than 0. ")
 	}
 
-	block, err := bs.wm.Api.GetBlockByNum(uint32(height - 1))
+	block, err := bs.getBlockByNum(uint32(height - 1))
 	if err != nil {
 		return err
 	}
@@ -628,7 +840,24 @@ func (bs *EOSBlockScanner) GetGlobalHeadBlock() (block *eos.BlockResp, err error
 		return
 	}
 
-	block, err = bs.wm.Api.GetBlockByNum(infoResp.HeadBlockNum - 1)
+	block, err = bs.getBlockByNum(infoResp.HeadBlockNum - 1)
+	if err != nil {
+		bs.wm.Log.Std.Info("block scanner can not get block by height; unexpected error:%v", err)
+		return
+	}
+
+	return
+}
+
+//GetGlobalIrreversibleBlock 获取最新的不可逆区块
+func (bs *EOSBlockScanner) GetGlobalIrreversibleBlock() (block *eos.BlockResp, err error) {
+	infoResp, err := bs.GetChainInfo()
+	if err != nil {
+		bs.wm.Log.Std.Info("get chain info error;unexpected error:%v", err)
+		return
+	}
+
+	block, err = bs.getBlockByNum(infoResp.LastIrreversibleBlockNum)
 	if err != nil {
 		bs.wm.Log.Std.Info("block scanner can not get block by height; unexpected error:%v", err)
 		return
@@ -652,10 +881,19 @@ func (bs *EOSBlockScanner) GetScannedBlockHeight() uint64 {
 	return uint64(height)
 }
 
-//GetBalanceByAddress 查询地址余额
+//GetBalanceByAddress 查询地址余额，余额为主币可用余额，抵押、赎回和RAM明细通过AccountBalanceScanner查询。
+//查询失败的地址不在结果中
 func (bs *EOSBlockScanner) GetBalanceByAddress(address ...string) ([]*openwallet.Balance, error) {
 
-	addrBalanceArr := make([]*openwallet.Balance, 0)
+	accountBalances, err := bs.GetAccountBalances(address...)
+	if err != nil {
+		return nil, err
+	}
+
+	addrBalanceArr := make([]*openwallet.Balance, 0, len(accountBalances))
+	for _, b := range accountBalances {
+		addrBalanceArr = append(addrBalanceArr, b.Balance)
+	}
 
 	return addrBalanceArr, nil
 }
@@ -672,11 +910,13 @@ func (bs *EOSBlockScanner) GetCurrentBlockHeader() (*openwallet.BlockHeader, err
 //rescanFailedRecord 重扫失败记录
 func (bs *EOSBlockScanner) RescanFailedRecord() {
 
+	defer bs.closeShipRescan()
+
 	var (
 		blockMap = make(map[uint64][]string)
 	)
 
-	list, err := bs.BlockchainDAI.GetUnscanRecords(bs.wm.Symbol())
+	list, err := bs.GetUnscanRecords()
 	if err != nil {
 		bs.wm.Log.Std.Info("block scanner can not get rescan data; unexpected error: %v", err)
 	}
@@ -704,13 +944,13 @@ func (bs *EOSBlockScanner) RescanFailedRecord() {
 
 		bs.wm.Log.Std.Info("block scanner rescanning height: %d ...", height)
 
-		block, err := bs.wm.Api.GetBlockByNum(uint32(height))
+		block, traces, err := bs.getRescanBlock(uint32(height))
 		if err != nil {
 			bs.wm.Log.Std.Info("block scanner can not get new block data; unexpected error: %v", err)
 			continue
 		}
 
-		err = bs.BatchExtractTransactions(uint64(block.BlockNum), block.ID.String(), block.Timestamp.Unix(), block.Transactions)
+		err = bs.batchExtractBlock(block, traces)
 		if err != nil {
 			bs.wm.Log.Std.Info("block scanner can not extractRechargeRecords; unexpected error: %v", err)
 			continue
@@ -721,6 +961,15 @@ func (bs *EOSBlockScanner) RescanFailedRecord() {
 	}
 }
 
+//getRescanBlock 获取重扫的区块，通过state history扫描时同时获取交易追踪，与推送时的提取结果一致
+func (bs *EOSBlockScanner) getRescanBlock(height uint32) (*eos.BlockResp, map[string][]*ActionTrace, error) {
+	if len(bs.wm.Config.ShipAPI) > 0 {
+		return bs.getShipBlock(height)
+	}
+	block, err := bs.getBlockByNum(height)
+	return block, nil, err
+}
+
 //SupportBlockchainDAI 支持外部设置区块链数据访问接口
 //@optional
 func (bs *EOSBlockScanner) SupportBlockchainDAI() bool {
@@ -0,0 +1,312 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	//回填进度的存储桶
+	backfillBucket = "backfill_progress"
+)
+
+// BackfillProgress 回填任务进度
+type BackfillProgress struct {
+	ID        string
+	Start     uint32   //起始高度
+	End       uint32   //结束高度
+	Current   uint32   //已完成的高度
+	Failed    []uint32 //获取或提取失败的区块高度，任务重新开始时先重试
+	Done      bool     //是否已完成
+	Err       string   //最近一次失败的原因
+	UpdatedAt int64
+}
+
+// Percent 完成百分比
+func (p BackfillProgress) Percent() float64 {
+	if p.Current < p.Start {
+		return 0
+	}
+	return float64(p.Current-p.Start+1) * 100 / float64(p.End-p.Start+1)
+}
+
+// BackfillJob 历史区块回填任务，与实时扫描并行扫描[start, end]区间的不可逆区块并通知观测者，
+// 每完成一个区块保存进度，重启后从进度继续。获取或提取失败的区块记录在进度中，不中断任务，
+// 任务重新开始时先重试这些区块
+type BackfillJob struct {
+	Source   BlockSource //回填使用的区块来源，例如BlockLogSource，为nil时使用扫描器的区块来源
+	bs       *EOSBlockScanner
+	store    KeyValueStore
+	mu       sync.RWMutex
+	progress BackfillProgress
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+	err      error
+	start    sync.Once
+}
+
+//stateStore 扫描器状态的持久化存储
+func (bs *EOSBlockScanner) stateStore() KeyValueStore {
+	if bs.StateStore != nil {
+		return bs.StateStore
+	}
+	if store, ok := bs.BlockchainDAI.(KeyValueStore); ok {
+		return store
+	}
+	return nil
+}
+
+// NewBackfillJob 创建回填任务，已有相同ID和区间的进度时从进度继续
+func (bs *EOSBlockScanner) NewBackfillJob(id string, start, end uint32) (*BackfillJob, error) {
+	return bs.NewBackfillJobFromSource(id, start, end, nil)
+}
+
+// NewBackfillJobFromSource 创建从指定区块来源读取区块的回填任务，不影响实时扫描的区块来源，
+// 区块来源为区块日志时结束高度不能超过日志的最后区块
+func (bs *EOSBlockScanner) NewBackfillJobFromSource(id string, start, end uint32, source BlockSource) (*BackfillJob, error) {
+
+	if start == 0 || start > end {
+		return nil, fmt.Errorf("invalid backfill range: [%d, %d]", start, end)
+	}
+
+	store := bs.stateStore()
+	if store == nil {
+		return nil, fmt.Errorf("backfill progress store is not setup")
+	}
+
+	lastIrreversible, err := bs.sourceLastIrreversibleBlockNum(source)
+	if err != nil {
+		return nil, err
+	}
+	if end > lastIrreversible {
+		return nil, fmt.Errorf("backfill end height: %d is above last irreversible block: %d", end, lastIrreversible)
+	}
+
+	progress, err := bs.GetBackfillProgress(id)
+	if err != nil {
+		return nil, err
+	}
+	if progress == nil {
+		progress = &BackfillProgress{ID: id, Start: start, End: end, Current: start - 1}
+	} else if progress.Start != start || progress.End != end {
+		return nil, fmt.Errorf("backfill job: %s already exists with range [%d, %d]", id, progress.Start, progress.End)
+	}
+
+	job := &BackfillJob{
+		Source:   source,
+		bs:       bs,
+		store:    store,
+		progress: *progress,
+		done:     make(chan struct{}),
+	}
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+
+	return job, nil
+}
+
+// GetBackfillProgress 获取保存的回填进度，没有记录时返回nil
+func (bs *EOSBlockScanner) GetBackfillProgress(id string) (*BackfillProgress, error) {
+
+	store := bs.stateStore()
+	if store == nil {
+		return nil, fmt.Errorf("backfill progress store is not setup")
+	}
+
+	var progress BackfillProgress
+	err := store.GetValue(backfillBucket, id, &progress)
+	if err == ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &progress, nil
+}
+
+// Start 开始回填，异步执行
+func (job *BackfillJob) Start() {
+	job.start.Do(func() {
+		go job.run()
+	})
+}
+
+// Stop 停止回填，已完成的进度保留
+func (job *BackfillJob) Stop() {
+	job.cancel()
+}
+
+// Wait 等待回填结束，返回失败的原因
+func (job *BackfillJob) Wait() error {
+	<-job.done
+	return job.err
+}
+
+// Progress 当前进度
+func (job *BackfillJob) Progress() BackfillProgress {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return job.progress
+}
+
+//run 从已完成的高度继续扫描
+func (job *BackfillJob) run() {
+	defer close(job.done)
+	defer job.cancel()
+
+	progress := job.Progress()
+	if progress.Done {
+		return
+	}
+
+	job.err = job.retryFailed(progress.Failed)
+	if job.err == nil && progress.Current < progress.End {
+		job.bs.wm.Log.Std.Info("backfill job: %s scanning blocks [%d, %d] ...", progress.ID, progress.Current+1, progress.End)
+		job.err = job.scan(progress.Current+1, progress.End)
+	}
+	if job.err != nil {
+		job.bs.wm.Log.Std.Error("backfill job: %s stopped at height: %d; unexpected error: %v", progress.ID, job.Progress().Current, job.err)
+		job.save(func(p *BackfillProgress) { p.Err = job.err.Error() })
+		return
+	}
+
+	progress = job.Progress()
+	if progress.Current < progress.End {
+		return
+	}
+	if len(progress.Failed) > 0 {
+		job.err = fmt.Errorf("backfill job: %s failed blocks: %v", progress.ID, progress.Failed)
+		job.bs.wm.Log.Std.Error("%v, will retry when the job starts again", job.err)
+		job.save(func(p *BackfillProgress) { p.Err = job.err.Error() })
+		return
+	}
+	job.save(func(p *BackfillProgress) {
+		p.Done = true
+		p.Err = ""
+	})
+	job.bs.wm.Log.Std.Info("backfill job: %s finished", progress.ID)
+}
+
+//retryFailed 重试之前失败的区块，成功的从失败列表中删除
+func (job *BackfillJob) retryFailed(heights []uint32) error {
+
+	for _, height := range heights {
+		select {
+		case <-job.ctx.Done():
+			return nil
+		default:
+		}
+
+		fetched := job.bs.fetchBlock(job.Source, height)
+		ok, err := job.notify(fetched)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		err = job.save(func(p *BackfillProgress) {
+			failed := make([]uint32, 0, len(p.Failed))
+			for _, h := range p.Failed {
+				if h != height {
+					failed = append(failed, h)
+				}
+			}
+			p.Failed = failed
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//scan 并发预取区间内的区块，按高度顺序通知并保存进度
+func (job *BackfillJob) scan(from, to uint32) error {
+
+	bs := job.bs
+
+	//返回时停止预取
+	ctx, cancel := context.WithCancel(job.ctx)
+	defer cancel()
+
+	for fetching := range bs.fetchBlocks(ctx, job.Source, from, to) {
+
+		fetched, err := nextFetchedBlock(ctx, fetching)
+		if err != nil {
+			//停止回填，已完成的进度保留
+			return nil
+		}
+
+		ok, err := job.notify(fetched)
+		if err != nil {
+			return err
+		}
+
+		//失败的区块记录后继续
+		err = job.save(func(p *BackfillProgress) {
+			p.Current = fetched.Height
+			if !ok {
+				p.Failed = append(p.Failed, fetched.Height)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//notify 通知区块中提取成功的交易，区块获取或有交易提取失败时返回false
+func (job *BackfillJob) notify(fetched *fetchedBlock) (bool, error) {
+
+	bs := job.bs
+
+	if fetched.Err != nil {
+		bs.wm.Log.Std.Error("backfill job: %s get block: %d failed; unexpected error: %v", job.Progress().ID, fetched.Height, fetched.Err)
+		return false, nil
+	}
+
+	success := true
+	for _, result := range fetched.Results {
+		if !result.Success {
+			bs.wm.Log.Std.Error("backfill job: %s extract block: %d transaction: %s failed", job.Progress().ID, fetched.Height, result.TxID)
+			success = false
+			continue
+		}
+		if err := bs.newExtractDataNotify(uint64(fetched.Height), result.extractData); err != nil {
+			return false, err
+		}
+		if err := bs.newExtractContractDataNotify(uint64(fetched.Height), result.extractContractData); err != nil {
+			return false, err
+		}
+	}
+	return success, nil
+}
+
+//save 更新并保存进度
+func (job *BackfillJob) save(update func(p *BackfillProgress)) error {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	update(&job.progress)
+	job.progress.UpdatedAt = time.Now().Unix()
+	return job.store.SetValue(backfillBucket, job.progress.ID, &job.progress)
+}
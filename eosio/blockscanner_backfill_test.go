@@ -0,0 +1,145 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/eoscanada/eos-go"
+)
+
+func TestEOSBlockScanner_BackfillJob(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	//每10个区块有一笔给alice的转账
+	transactions := make(map[uint32]*eos.PackedTransaction)
+	for num := uint32(10); num <= 60; num += 10 {
+		transactions[num] = testPackedTransaction(uint16(num), testTransferAction("eosio.token", "bob", "alice", "1.0000 EOS", fmt.Sprint(num)))
+	}
+	blocks := node.addChain(1, 100, 0, testBlockID(0, 0), transactions)
+	node.info.HeadBlockNum = 100
+	node.info.LastIrreversibleBlockNum = 80
+
+	wm := testNewMockWalletManager(node)
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	bs.ScanTargetFunc = testScanTargetFunc(map[string]string{"alice": "account_alice"})
+	bs.SaveLocalBlockHead(100, blocks[100].ID.String())
+
+	observer := newTestObserver()
+	bs.AddObserver(observer)
+
+	if _, err := bs.NewBackfillJob("audit", 5, 90); err == nil {
+		t.Errorf("backfill above last irreversible block should fail")
+	}
+
+	//区块35获取失败，记录后继续回填
+	node.mu.Lock()
+	delete(node.blocks, 35)
+	node.mu.Unlock()
+
+	job, err := bs.NewBackfillJob("audit", 5, 64)
+	if err != nil {
+		t.Fatalf("create backfill job failed: %v", err)
+	}
+	job.Start()
+	if err := job.Wait(); err == nil {
+		t.Fatalf("backfill should report the missing block")
+	}
+	progress, _ := bs.GetBackfillProgress("audit")
+	if progress.Current != 64 || progress.Done || len(progress.Failed) != 1 || progress.Failed[0] != 35 || len(progress.Err) == 0 {
+		t.Fatalf("saved progress = %+v, want block 35 failed", progress)
+	}
+	if len(observer.extractData("account_alice")) != 6 {
+		t.Fatalf("alice extract data size = %d, want 6", len(observer.extractData("account_alice")))
+	}
+
+	if _, err := bs.NewBackfillJob("audit", 1, 64); err == nil {
+		t.Errorf("backfill job with different range should fail")
+	}
+
+	//重启后重试失败的区块
+	node.addBlock(35, 0, blocks[34].ID, testPackedTransaction(35, testTransferAction("eosio.token", "bob", "alice", "1.0000 EOS", "35")))
+	job, err = bs.NewBackfillJob("audit", 5, 64)
+	if err != nil {
+		t.Fatalf("resume backfill job failed: %v", err)
+	}
+	job.Start()
+	if err := job.Wait(); err != nil {
+		t.Fatalf("backfill failed: %v", err)
+	}
+
+	progress = &BackfillProgress{}
+	*progress = job.Progress()
+	if !progress.Done || progress.Current != 64 || len(progress.Failed) != 0 || progress.Percent() != 100 {
+		t.Errorf("backfill progress = %+v", progress)
+	}
+
+	extracted := observer.extractData("account_alice")
+	if len(extracted) != 7 || extracted[6].Transaction.BlockHeight != 35 {
+		t.Fatalf("alice extract data size = %d, want block 35 retried", len(extracted))
+	}
+	for i, data := range extracted[:6] {
+		if data.Transaction.BlockHeight != uint64(i+1)*10 {
+			t.Errorf("extract data %d height = %d", i, data.Transaction.BlockHeight)
+		}
+	}
+
+	//实时扫描的本地区块头不受影响
+	if height, _, _ := bs.GetLocalBlockHead(); height != 100 {
+		t.Errorf("local block head = %d, want 100", height)
+	}
+
+	//已完成的任务不再扫描
+	job, _ = bs.NewBackfillJob("audit", 5, 64)
+	job.Start()
+	job.Wait()
+	if len(observer.extractData("account_alice")) != 7 {
+		t.Errorf("finished backfill job scanned again")
+	}
+}
+
+func TestEOSBlockScanner_BackfillJobStop(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+	node.addChain(1, 100, 0, testBlockID(0, 0), nil)
+	node.info.LastIrreversibleBlockNum = 100
+
+	wm := testNewMockWalletManager(node)
+	wm.Config.BlockFetchWindow = 2
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	bs.ScanTargetFunc = testScanTargetFunc(nil)
+
+	job, err := bs.NewBackfillJob("stop", 1, 100)
+	if err != nil {
+		t.Fatalf("create backfill job failed: %v", err)
+	}
+	job.Stop()
+	job.Start()
+	if err := job.Wait(); err != nil {
+		t.Errorf("stopped backfill job err = %v", err)
+	}
+	if progress := job.Progress(); progress.Done {
+		t.Errorf("stopped backfill job should not be done: %+v", progress)
+	}
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	//主币合约
+	coreTokenContract = "eosio.token"
+	//并发查询余额的最大数量
+	maxBalanceQueryWorkers = 10
+)
+
+// AccountBalanceScanner 查询账户余额明细，GetBalanceByAddress只返回可用余额，
+// 需要抵押、赎回和RAM明细时把BlockScanner断言为该接口
+type AccountBalanceScanner interface {
+	GetAccountBalances(address ...string) ([]*AccountBalance, error)
+}
+
+var _ AccountBalanceScanner = (*EOSBlockScanner)(nil)
+
+// AccountBalance 账户主币余额，包括可用余额和抵押资源
+type AccountBalance struct {
+	*openwallet.Balance
+	Liquid            string //可用余额
+	StakedCPU         string //自己抵押的CPU
+	StakedNet         string //自己抵押的NET
+	RefundCPU         string //赎回中的CPU
+	RefundNet         string //赎回中的NET
+	RefundRequestTime int64  //赎回申请时间，没有赎回为0
+	Total             string //可用、抵押、赎回中的总和
+	RAMQuota          int64  //RAM配额，字节
+	RAMUsage          int64  //RAM已使用，字节
+}
+
+// GetAccountBalances 并发查询账户的主币余额和资源，结果与账户顺序一致。
+// 查询失败的账户记录日志后跳过，全部失败时返回错误
+func (bs *EOSBlockScanner) GetAccountBalances(address ...string) ([]*AccountBalance, error) {
+
+	var (
+		wg       sync.WaitGroup
+		balances = make([]*AccountBalance, len(address))
+		errs     = make([]error, len(address))
+		workers  = make(chan struct{}, maxBalanceQueryWorkers)
+	)
+
+	for i, addr := range address {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, addr string) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			balances[i], errs[i] = bs.getAccountBalance(addr)
+		}(i, addr)
+	}
+
+	wg.Wait()
+
+	result := make([]*AccountBalance, 0, len(address))
+	for i, err := range errs {
+		if err != nil {
+			bs.wm.Log.Std.Error("get account[%s] balance failed, err: %v", address[i], err)
+			continue
+		}
+		result = append(result, balances[i])
+	}
+
+	if len(result) == 0 && len(address) > 0 {
+		return nil, fmt.Errorf("get account[%s] balance failed, err: %v", address[0], errs[0])
+	}
+
+	return result, nil
+}
+
+//getAccountBalance 查询单个账户的主币余额和资源
+func (bs *EOSBlockScanner) getAccountBalance(address string) (*AccountBalance, error) {
+
+	decimals := bs.wm.Decimal()
+	coreSymbol := eos.Symbol{Precision: uint8(decimals), Symbol: bs.wm.Symbol()}
+
+	accountAssets, err := bs.wm.Api.GetCurrencyBalance(eos.AccountName(address), bs.wm.Symbol(), eos.AccountName(coreTokenContract))
+	if err != nil {
+		return nil, err
+	}
+
+	accountResp, err := bs.wm.Api.GetAccount(eos.AccountName(address))
+	if err != nil {
+		return nil, err
+	}
+
+	liquid := eos.Asset{Symbol: coreSymbol}
+	if len(accountAssets) > 0 {
+		liquid = accountAssets[0]
+	}
+
+	//自己抵押的资源，没有抵押时节点返回空
+	stakedCPU := accountResp.SelfDelegatedBandwidth.CPUWeight
+	stakedNet := accountResp.SelfDelegatedBandwidth.NetWeight
+
+	var (
+		refundCPU, refundNet eos.Asset
+		refundRequestTime    int64
+	)
+	if refund := accountResp.RefundRequest; refund != nil {
+		refundCPU = refund.CPUAmount
+		refundNet = refund.NetAmount
+		refundRequestTime = refund.RequestTime.Unix()
+	}
+
+	assetDecimal := func(asset eos.Asset) decimal.Decimal {
+		return decimal.New(int64(asset.Amount), -decimals)
+	}
+
+	liquidDec := assetDecimal(liquid)
+	total := liquidDec.Add(assetDecimal(stakedCPU)).Add(assetDecimal(stakedNet)).
+		Add(assetDecimal(refundCPU)).Add(assetDecimal(refundNet))
+
+	return &AccountBalance{
+		Balance: &openwallet.Balance{
+			Symbol:           bs.wm.Symbol(),
+			AccountID:        bs.accountIDOf(address),
+			Address:          address,
+			Balance:          liquidDec.String(),
+			ConfirmBalance:   liquidDec.String(),
+			UnconfirmBalance: "0",
+		},
+		Liquid:            liquidDec.String(),
+		StakedCPU:         assetDecimal(stakedCPU).String(),
+		StakedNet:         assetDecimal(stakedNet).String(),
+		RefundCPU:         assetDecimal(refundCPU).String(),
+		RefundNet:         assetDecimal(refundNet).String(),
+		RefundRequestTime: refundRequestTime,
+		Total:             total.String(),
+		RAMQuota:          int64(accountResp.RAMQuota),
+		RAMUsage:          int64(accountResp.RAMUsage),
+	}, nil
+}
+
+//accountIDOf 通过ScanTargetFunc查找账户所属的资产账户，没有订阅时为空
+func (bs *EOSBlockScanner) accountIDOf(address string) string {
+	if bs.ScanTargetFunc == nil {
+		return ""
+	}
+	accountID, ok := bs.ScanTargetFunc(openwallet.ScanTarget{Alias: address, Symbol: bs.wm.Symbol(), BalanceModelType: openwallet.BalanceModelTypeAccount})
+	if !ok {
+		return ""
+	}
+	return accountID
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/eoscanada/eos-go"
+)
+
+// testAccountResp 构建账户资源信息
+func testAccountResp(name string, stakedCPU, stakedNet string, refund *eos.RefundRequest) *eos.AccountResp {
+	cpu, _ := eos.NewAsset(stakedCPU)
+	net, _ := eos.NewAsset(stakedNet)
+	zero, _ := eos.NewAsset("0.0000 EOS")
+	return &eos.AccountResp{
+		AccountName:       eos.AccountName(name),
+		CoreLiquidBalance: zero,
+		TotalResources:    eos.TotalResources{Owner: eos.AccountName(name), CPUWeight: cpu, NetWeight: net},
+		RAMQuota:          8192,
+		RAMUsage:          3000,
+		SelfDelegatedBandwidth: eos.DelegatedBandwidth{
+			From:      eos.AccountName(name),
+			To:        eos.AccountName(name),
+			CPUWeight: cpu,
+			NetWeight: net,
+		},
+		RefundRequest: refund,
+	}
+}
+
+func TestEOSBlockScanner_GetAccountBalances(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	refundCPU, _ := eos.NewAsset("0.5000 EOS")
+	refundNet, _ := eos.NewAsset("0.2500 EOS")
+	requestTime := eos.JSONTime{Time: time.Unix(1600000000, 0).UTC()}
+
+	node.balances["alice"] = []string{"10.0000 EOS"}
+	node.accounts["alice"] = testAccountResp("alice", "2.0000 EOS", "1.0000 EOS", &eos.RefundRequest{
+		Owner:       "alice",
+		RequestTime: requestTime,
+		CPUAmount:   refundCPU,
+		NetAmount:   refundNet,
+	})
+	//没有余额和抵押的账户
+	node.accounts["bob"] = testAccountResp("bob", "0.0000 EOS", "0.0000 EOS", nil)
+
+	wm := testNewMockWalletManager(node)
+	bs := wm.Blockscanner
+	bs.ScanTargetFunc = testScanTargetFunc(map[string]string{"alice": "account_alice"})
+
+	//通过BlockScanner接口断言查询明细
+	scanner, ok := wm.GetBlockScanner().(AccountBalanceScanner)
+	if !ok {
+		t.Fatalf("block scanner does not implement AccountBalanceScanner")
+	}
+	balances, err := scanner.GetAccountBalances("alice", "bob")
+	if err != nil {
+		t.Fatalf("get account balances failed: %v", err)
+	}
+	if len(balances) != 2 {
+		t.Fatalf("balances size = %d, want 2", len(balances))
+	}
+
+	alice := balances[0]
+	if alice.Address != "alice" || alice.AccountID != "account_alice" || alice.ConfirmBalance != "10" || alice.Liquid != "10" {
+		t.Errorf("unexpected alice balance: %+v", alice.Balance)
+	}
+	if alice.StakedCPU != "2" || alice.StakedNet != "1" || alice.RefundCPU != "0.5" || alice.RefundNet != "0.25" {
+		t.Errorf("unexpected alice resources: %+v", alice)
+	}
+	if alice.Total != "13.75" || alice.RefundRequestTime != 1600000000 {
+		t.Errorf("alice total = %s, refund time = %d", alice.Total, alice.RefundRequestTime)
+	}
+	if alice.RAMQuota != 8192 || alice.RAMUsage != 3000 {
+		t.Errorf("alice ram = %d/%d", alice.RAMUsage, alice.RAMQuota)
+	}
+
+	bob := balances[1]
+	if bob.Address != "bob" || bob.AccountID != "" || bob.Balance.Balance != "0" || bob.Total != "0" {
+		t.Errorf("unexpected bob balance: %+v", bob)
+	}
+
+	//查询失败的账户跳过，不影响其他账户
+	addrBalances, err := bs.GetBalanceByAddress("nobody", "alice", "bob")
+	if err != nil {
+		t.Fatalf("get balance with unknown account failed: %v", err)
+	}
+	if len(addrBalances) != 2 || addrBalances[0].Address != "alice" || addrBalances[1].Address != "bob" {
+		t.Errorf("balances with unknown account = %+v", addrBalances)
+	}
+
+	//全部失败时返回错误
+	if _, err := bs.GetBalanceByAddress("nobody"); err == nil {
+		t.Errorf("get balance of only unknown account should fail")
+	}
+}
+
+func TestEOSBlockScanner_GetBalanceByAddress(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+	node.delay = 20 * time.Millisecond
+
+	addresses := make([]string, 0)
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("user%d", i)
+		node.balances[name] = []string{fmt.Sprintf("%d.0000 EOS", i)}
+		node.accounts[name] = testAccountResp(name, "0.0000 EOS", "0.0000 EOS", nil)
+		addresses = append(addresses, name)
+	}
+
+	wm := testNewMockWalletManager(node)
+	bs := wm.Blockscanner
+
+	balances, err := bs.GetBalanceByAddress(addresses...)
+	if err != nil {
+		t.Fatalf("get balance failed: %v", err)
+	}
+	for i, b := range balances {
+		if b.Address != addresses[i] || b.Balance != fmt.Sprint(i) {
+			t.Errorf("balance %d = %s %s", i, b.Address, b.Balance)
+		}
+	}
+
+	if node.maxInflight <= 1 || node.maxInflight > maxBalanceQueryWorkers*2 {
+		t.Errorf("max inflight requests = %d", node.maxInflight)
+	}
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/eoscanada/eos-go"
+)
+
+const (
+	//区块日志文件名
+	blockLogFile = "blocks.log"
+	//区块索引文件名
+	blockIndexFile = "blocks.index"
+	//支持的最高区块日志版本，版本4开始区块中的交易可被裁剪，格式不同
+	maxBlockLogVersion = 3
+)
+
+//irreversibleBlockSource 只包含不可逆区块的区块来源，不需要通过节点确认不可逆高度
+type irreversibleBlockSource interface {
+	LastIrreversibleBlockNum() uint32
+}
+
+//lastIrreversibleBlockNum 不可逆区块高度，区块来源为区块日志时以日志的最后区块为准
+func (bs *EOSBlockScanner) lastIrreversibleBlockNum() (uint32, error) {
+	return bs.sourceLastIrreversibleBlockNum(nil)
+}
+
+//sourceLastIrreversibleBlockNum 指定区块来源的不可逆区块高度，source为nil时使用扫描器的区块来源
+func (bs *EOSBlockScanner) sourceLastIrreversibleBlockNum(source BlockSource) (uint32, error) {
+	if source == nil {
+		source = bs.BlockSource
+	}
+	if irreversible, ok := source.(irreversibleBlockSource); ok {
+		return irreversible.LastIrreversibleBlockNum(), nil
+	}
+	infoResp, err := bs.GetChainInfo()
+	if err != nil {
+		return 0, err
+	}
+	return infoResp.LastIrreversibleBlockNum, nil
+}
+
+// BlockLogSource 读取nodeos数据目录中的blocks.log和blocks.index，
+// 通过blocks.index定位区块，按signed_block二进制格式解析，支持版本1~3的区块日志
+type BlockLogSource struct {
+	log           *os.File
+	index         *os.File
+	logSize       int64
+	version       uint32
+	firstBlockNum uint32
+	lastBlockNum  uint32
+}
+
+// NewBlockLogSource 打开区块日志目录，dir中需要包含blocks.log和blocks.index
+func NewBlockLogSource(dir string) (*BlockLogSource, error) {
+
+	log, err := os.Open(filepath.Join(dir, blockLogFile))
+	if err != nil {
+		return nil, err
+	}
+	index, err := os.Open(filepath.Join(dir, blockIndexFile))
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+
+	source := &BlockLogSource{log: log, index: index}
+	if err := source.readHeader(); err != nil {
+		source.Close()
+		return nil, err
+	}
+
+	return source, nil
+}
+
+//readHeader 读取日志版本和首个区块高度，并检查索引与日志是否一致
+func (source *BlockLogSource) readHeader() error {
+
+	logInfo, err := source.log.Stat()
+	if err != nil {
+		return err
+	}
+	indexInfo, err := source.index.Stat()
+	if err != nil {
+		return err
+	}
+	source.logSize = logInfo.Size()
+
+	header := make([]byte, 8)
+	if _, err := source.log.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("read block log header failed, err: %v", err)
+	}
+	source.version = binary.LittleEndian.Uint32(header[:4])
+	if source.version == 0 || source.version > maxBlockLogVersion {
+		return fmt.Errorf("unsupported block log version: %d", source.version)
+	}
+
+	//版本1的日志总是从区块1开始
+	source.firstBlockNum = 1
+	if source.version > 1 {
+		source.firstBlockNum = binary.LittleEndian.Uint32(header[4:])
+	}
+
+	if indexInfo.Size() == 0 || indexInfo.Size()%8 != 0 {
+		return fmt.Errorf("invalid block index size: %d", indexInfo.Size())
+	}
+	source.lastBlockNum = source.firstBlockNum + uint32(indexInfo.Size()/8) - 1
+
+	//日志的最后8字节为最后区块的位置，需要与索引一致
+	lastPos, err := source.blockPosition(source.lastBlockNum)
+	if err != nil {
+		return err
+	}
+	trailer, err := source.readUint64(source.logSize - 8)
+	if err != nil {
+		return err
+	}
+	if trailer != lastPos {
+		return fmt.Errorf("block index does not match block log, last block position: %d, log trailer: %d", lastPos, trailer)
+	}
+
+	return nil
+}
+
+//readUint64 读取日志中指定位置的uint64
+func (source *BlockLogSource) readUint64(offset int64) (uint64, error) {
+	buf := make([]byte, 8)
+	if _, err := source.log.ReadAt(buf, offset); err != nil {
+		return 0, fmt.Errorf("read block log at: %d failed, err: %v", offset, err)
+	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
+//blockPosition 从索引读取区块在日志中的位置
+func (source *BlockLogSource) blockPosition(num uint32) (uint64, error) {
+	buf := make([]byte, 8)
+	if _, err := source.index.ReadAt(buf, int64(num-source.firstBlockNum)*8); err != nil {
+		return 0, fmt.Errorf("read block index: %d failed, err: %v", num, err)
+	}
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
+// Version 区块日志版本
+func (source *BlockLogSource) Version() uint32 {
+	return source.version
+}
+
+// FirstBlockNum 日志中的首个区块高度
+func (source *BlockLogSource) FirstBlockNum() uint32 {
+	return source.firstBlockNum
+}
+
+// LastBlockNum 日志中的最后区块高度
+func (source *BlockLogSource) LastBlockNum() uint32 {
+	return source.lastBlockNum
+}
+
+// LastIrreversibleBlockNum 区块日志只记录不可逆区块
+func (source *BlockLogSource) LastIrreversibleBlockNum() uint32 {
+	return source.lastBlockNum
+}
+
+// GetBlockByNum 读取并解析指定高度的区块，可并发调用
+func (source *BlockLogSource) GetBlockByNum(num uint32) (*eos.BlockResp, error) {
+
+	if num < source.firstBlockNum || num > source.lastBlockNum {
+		return nil, fmt.Errorf("block: %d is out of block log range [%d, %d]", num, source.firstBlockNum, source.lastBlockNum)
+	}
+
+	//区块数据后紧跟8字节的区块位置，区块结束于下一个区块的位置
+	pos, err := source.blockPosition(num)
+	if err != nil {
+		return nil, err
+	}
+	end := uint64(source.logSize)
+	if num < source.lastBlockNum {
+		end, err = source.blockPosition(num + 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if end <= pos+8 || end > uint64(source.logSize) {
+		return nil, fmt.Errorf("invalid block: %d position: %d, next position: %d", num, pos, end)
+	}
+
+	data := make([]byte, end-pos)
+	if _, err := source.log.ReadAt(data, int64(pos)); err != nil {
+		return nil, fmt.Errorf("read block: %d failed, err: %v", num, err)
+	}
+	if trailer := binary.LittleEndian.Uint64(data[len(data)-8:]); trailer != pos {
+		return nil, fmt.Errorf("block: %d position: %d does not match log entry: %d", num, pos, trailer)
+	}
+
+	block := &eos.BlockResp{}
+	if err := eos.NewDecoder(data[:len(data)-8]).Decode(&block.SignedBlock); err != nil {
+		return nil, fmt.Errorf("decode block: %d failed, err: %v", num, err)
+	}
+	if block.BlockNumber() != num {
+		return nil, fmt.Errorf("block log entry: %d is not block: %d", block.BlockNumber(), num)
+	}
+
+	//计算区块ID需要二进制编码，加锁避免并发编码
+	block.BlockNum = num
+	eosCodecLock.Lock()
+	block.ID, err = block.BlockID()
+	eosCodecLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	block.RefBlockPrefix = binary.LittleEndian.Uint32(block.ID[8:12])
+
+	//二进制中的交易只有打包数据，补充交易ID
+	for i, tx := range block.Transactions {
+		if tx.Transaction.Packed == nil {
+			continue
+		}
+		block.Transactions[i].Transaction.ID, err = packedTransactionID(tx.Transaction.Packed)
+		if err != nil {
+			return nil, fmt.Errorf("block: %d transaction: %d id failed, err: %v", num, i, err)
+		}
+	}
+
+	return block, nil
+}
+
+// Close 关闭区块日志和索引
+func (source *BlockLogSource) Close() error {
+	source.index.Close()
+	return source.log.Close()
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
+)
+
+//testSignedBlockBinary 按signed_block格式序列化区块，eos-go不支持交易回执的二进制序列化
+func testSignedBlockBinary(t *testing.T, block *eos.SignedBlock) []byte {
+	var buf bytes.Buffer
+	write := func(v interface{}) {
+		data, err := eos.MarshalBinary(v)
+		if err != nil {
+			t.Fatalf("marshal %T failed: %v", v, err)
+		}
+		buf.Write(data)
+	}
+	write(block.SignedBlockHeader)
+	write(eos.Varuint32(len(block.Transactions)))
+	for _, tx := range block.Transactions {
+		write(tx.TransactionReceiptHeader)
+		buf.WriteByte(1)
+		write(tx.Transaction.Packed)
+	}
+	write(eos.Varuint32(0))
+	return buf.Bytes()
+}
+
+//testWriteBlockLog 在dir中写入版本2的blocks.log和blocks.index，返回区块ID
+func testWriteBlockLog(t *testing.T, dir string, from, to uint32, transactions map[uint32]*eos.PackedTransaction) map[uint32]eos.Checksum256 {
+
+	var (
+		log   bytes.Buffer
+		index bytes.Buffer
+		ids   = make(map[uint32]eos.Checksum256)
+		prev  = testBlockID(from-1, 0)
+		u64   = make([]byte, 8)
+	)
+
+	binary.Write(&log, binary.LittleEndian, uint32(2))
+	binary.Write(&log, binary.LittleEndian, from)
+	log.WriteString("genesis state")
+	binary.Write(&log, binary.LittleEndian, ^uint64(0))
+
+	for num := from; num <= to; num++ {
+		var block *eos.BlockResp
+		if tx, ok := transactions[num]; ok {
+			block = testBlock(num, 0, prev, tx)
+		} else {
+			block = testBlock(num, 0, prev)
+		}
+		id, _ := block.BlockID()
+		ids[num] = id
+		prev = id
+
+		pos := uint64(log.Len())
+		binary.LittleEndian.PutUint64(u64, pos)
+		log.Write(testSignedBlockBinary(t, &block.SignedBlock))
+		log.Write(u64)
+		index.Write(u64)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, blockLogFile), log.Bytes(), 0644)
+	ioutil.WriteFile(filepath.Join(dir, blockIndexFile), index.Bytes(), 0644)
+	return ids
+}
+
+func TestBlockLogSource(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "eosio-blocklog")
+	defer os.RemoveAll(dir)
+
+	packed := testPackedTransaction(1, testTransferAction("eosio.token", "bob", "alice", "1.0000 EOS", "log"))
+	ids := testWriteBlockLog(t, dir, 50, 60, map[uint32]*eos.PackedTransaction{55: packed})
+
+	source, err := NewBlockLogSource(dir)
+	if err != nil {
+		t.Fatalf("open block log failed: %v", err)
+	}
+	defer source.Close()
+	if source.Version() != 2 || source.FirstBlockNum() != 50 || source.LastBlockNum() != 60 {
+		t.Fatalf("block log version: %d range = [%d, %d]", source.Version(), source.FirstBlockNum(), source.LastBlockNum())
+	}
+
+	block, err := source.GetBlockByNum(55)
+	if err != nil {
+		t.Fatalf("get block failed: %v", err)
+	}
+	txid, _ := packed.ID()
+	if block.BlockNum != 55 || !bytes.Equal(block.ID, ids[55]) || !bytes.Equal(block.Previous, ids[54]) {
+		t.Errorf("unexpected block: %d %s", block.BlockNum, block.ID)
+	}
+	if len(block.Transactions) != 1 || block.Transactions[0].Transaction.ID.String() != txid.String() || block.Transactions[0].Status != eos.TransactionStatusExecuted {
+		t.Errorf("unexpected block transactions: %+v", block.Transactions)
+	}
+	if last, err := source.GetBlockByNum(60); err != nil || !bytes.Equal(last.ID, ids[60]) {
+		t.Errorf("get last block failed: %v", err)
+	}
+	if _, err := source.GetBlockByNum(61); err == nil {
+		t.Errorf("block out of range should fail")
+	}
+
+	//索引与日志不一致
+	index, _ := ioutil.ReadFile(filepath.Join(dir, blockIndexFile))
+	ioutil.WriteFile(filepath.Join(dir, blockIndexFile), index[:len(index)-8], 0644)
+	if _, err := NewBlockLogSource(dir); err == nil {
+		t.Errorf("mismatched block index should fail")
+	}
+
+	//不支持的版本
+	log, _ := ioutil.ReadFile(filepath.Join(dir, blockLogFile))
+	binary.LittleEndian.PutUint32(log, 4)
+	ioutil.WriteFile(filepath.Join(dir, blockLogFile), log, 0644)
+	if _, err := NewBlockLogSource(dir); err == nil {
+		t.Errorf("unsupported block log version should fail")
+	}
+}
+
+func TestEOSBlockScanner_BackfillFromBlockLog(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "eosio-blocklog")
+	defer os.RemoveAll(dir)
+
+	transactions := make(map[uint32]*eos.PackedTransaction)
+	for num := uint32(3); num <= 40; num += 5 {
+		transactions[num] = testPackedTransaction(uint16(num), testTransferAction("eosio.token", "bob", "alice", "1.0000 EOS", fmt.Sprint(num)))
+	}
+	testWriteBlockLog(t, dir, 1, 40, transactions)
+
+	source, err := NewBlockLogSource(dir)
+	if err != nil {
+		t.Fatalf("open block log failed: %v", err)
+	}
+	defer source.Close()
+
+	//没有节点，ABI预先缓存
+	cache := NewCacheManager()
+	wm := NewWalletManager(&cache)
+	wm.ContractDecoder.SetABIInfo("eosio.token", openwallet.ABIInfo{ABI: testTokenABI()})
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	bs.ScanTargetFunc = testScanTargetFunc(map[string]string{"alice": "account_alice"})
+	observer := newTestObserver()
+	bs.AddObserver(observer)
+
+	if _, err := bs.NewBackfillJobFromSource("blocklog", 1, 41, source); err == nil {
+		t.Errorf("backfill above block log should fail")
+	}
+
+	job, err := bs.NewBackfillJobFromSource("blocklog", 1, 40, source)
+	if err != nil {
+		t.Fatalf("create backfill job failed: %v", err)
+	}
+	if bs.BlockSource != nil {
+		t.Errorf("backfill source should not replace the scanner block source")
+	}
+	job.Start()
+	if err := job.Wait(); err != nil {
+		t.Fatalf("backfill failed: %v", err)
+	}
+
+	extracted := observer.extractData("account_alice")
+	if len(extracted) != len(transactions) {
+		t.Fatalf("alice extract data size = %d, want %d", len(extracted), len(transactions))
+	}
+	if extracted[0].Transaction.BlockHeight != 3 || len(extracted[0].Transaction.TxID) == 0 {
+		t.Errorf("unexpected extract data: %+v", extracted[0].Transaction)
+	}
+	if progress := job.Progress(); !progress.Done || progress.Current != 40 {
+		t.Errorf("backfill progress = %+v", progress)
+	}
+}
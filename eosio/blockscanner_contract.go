@@ -0,0 +1,191 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
+)
+
+const (
+	//订阅合约的所有操作
+	contractActionWildcard = "*"
+)
+
+// ContractActionKey 合约操作的订阅标识，格式为 contract::action
+func ContractActionKey(contract, action string) string {
+	return contract + "::" + action
+}
+
+// ParseContractActions 解析逗号分隔的合约操作订阅，例如 atomicassets::transfer,eosio::delegatebw,myapp::*
+func ParseContractActions(value string) map[string]bool {
+	actions := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		parts := strings.Split(item, "::")
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			continue
+		}
+		actions[ContractActionKey(parts[0], parts[1])] = true
+	}
+	return actions
+}
+
+//isMonitorContractAction 是否订阅了合约操作
+func (bs *EOSBlockScanner) isMonitorContractAction(action *eos.Action) bool {
+	if bs.MonitorContractActions[ContractActionKey(string(action.Account), string(action.Name))] {
+		return true
+	}
+	return bs.MonitorContractActions[ContractActionKey(string(action.Account), contractActionWildcard)]
+}
+
+//contractSourceKey 查找合约操作通知的源标识，没有设置ScanTargetFuncV2或合约未登记时返回false
+func (bs *EOSBlockScanner) contractSourceKey(contract string, scanTargetFuncV2 openwallet.BlockScanTargetFuncV2) (string, bool) {
+	if scanTargetFuncV2 == nil {
+		scanTargetFuncV2 = bs.ScanTargetFuncV2
+	}
+	if scanTargetFuncV2 == nil {
+		return "", false
+	}
+	target := scanTargetFuncV2(openwallet.ScanTargetParam{
+		ScanTarget:     contract,
+		Symbol:         bs.wm.Symbol(),
+		ScanTargetType: openwallet.ScanTargetTypeContractAddress,
+	})
+	if !target.Exist {
+		return "", false
+	}
+	return target.SourceKey, true
+}
+
+//extractContractAction 解析订阅的合约操作，同一交易同一源标识同一合约的操作合并为一个回执的多个事件
+func (bs *EOSBlockScanner) extractContractAction(action *eos.Action, result *ExtractResult) error {
+
+	if !bs.isMonitorContractAction(action) {
+		return nil
+	}
+
+	//合约没有登记为扫描对象，不生成回执
+	contract := string(action.Account)
+	sourceKey, ok := bs.contractSourceKey(contract, result.scanTargetFuncV2)
+	if !ok {
+		return nil
+	}
+
+	data, err := bs.decodeActionData(action)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return nil
+	}
+
+	contractID := openwallet.GenContractID(bs.wm.Symbol(), contract)
+
+	if result.extractContractData == nil {
+		result.extractContractData = make(map[string][]*openwallet.SmartContractReceipt)
+	}
+
+	var receipt *openwallet.SmartContractReceipt
+	for _, r := range result.extractContractData[sourceKey] {
+		if r.Coin.Contract.Address == contract {
+			receipt = r
+			break
+		}
+	}
+	if receipt == nil {
+		from := ""
+		if len(action.Authorization) > 0 {
+			from = string(action.Authorization[0].Actor)
+		}
+
+		coin := openwallet.Coin{
+			Symbol:     bs.wm.Symbol(),
+			IsContract: true,
+			ContractID: contractID,
+			Contract: openwallet.SmartContract{
+				Symbol:     bs.wm.Symbol(),
+				ContractID: contractID,
+				Address:    contract,
+			},
+		}
+
+		receipt = &openwallet.SmartContractReceipt{
+			Coin:        coin,
+			TxID:        result.TxID,
+			From:        from,
+			To:          contract,
+			Value:       "0",
+			Fees:        "0",
+			BlockHash:   result.BlockHash,
+			BlockHeight: result.BlockHeight,
+			ConfirmTime: result.BlockTime,
+			Status:      "1",
+		}
+		receipt.GenWxID()
+		result.extractContractData[sourceKey] = append(result.extractContractData[sourceKey], receipt)
+	}
+
+	receipt.Events = append(receipt.Events, &openwallet.SmartContractEvent{
+		Contract: &receipt.Coin.Contract,
+		Event:    string(action.Name),
+		Value:    string(data),
+	})
+
+	//原始回执为所有事件对应的操作
+	raw := make([]json.RawMessage, 0, len(receipt.Events))
+	if len(receipt.RawReceipt) > 0 {
+		json.Unmarshal([]byte(receipt.RawReceipt), &raw)
+	}
+	rawAction, _ := json.Marshal(map[string]interface{}{
+		"account":       action.Account,
+		"name":          action.Name,
+		"authorization": action.Authorization,
+		"data":          json.RawMessage(data),
+	})
+	raw = append(raw, rawAction)
+	rawReceipt, _ := json.Marshal(raw)
+	receipt.RawReceipt = string(rawReceipt)
+
+	return nil
+}
+
+//newExtractContractDataNotify 发送合约回执通知，同一源标识的回执按合约首次出现的顺序通知
+func (bs *EOSBlockScanner) newExtractContractDataNotify(height uint64, extractContractData map[string][]*openwallet.SmartContractReceipt) error {
+
+	keys := make([]string, 0, len(extractContractData))
+	for key := range extractContractData {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, o := range bs.observers() {
+		for _, key := range keys {
+			for _, receipt := range extractContractData[key] {
+				bs.deliver(o, height, &NotifyOutboxEntry{SourceKey: key, Sid: receipt.WxID, ContractReceipt: receipt})
+			}
+		}
+	}
+
+	return nil
+}
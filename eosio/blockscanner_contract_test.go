@@ -0,0 +1,191 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
+)
+
+//testNFTTransferAction 构建atomicassets的转账操作
+func testNFTTransferAction(from, to string, assetIDs []uint64, memo string) *eos.Action {
+	data, _ := eos.MarshalBinary(struct {
+		From     eos.AccountName
+		To       eos.AccountName
+		AssetIDs []uint64
+		Memo     string
+	}{eos.AccountName(from), eos.AccountName(to), assetIDs, memo})
+	action := &eos.Action{
+		Account:       "atomicassets",
+		Name:          "transfer",
+		Authorization: []eos.PermissionLevel{{Actor: eos.AccountName(from), Permission: "active"}},
+		ActionData:    eos.NewActionDataFromHexData(data),
+	}
+	action.ActionData.SetToServer(false)
+	return action
+}
+
+//testNFTABI atomicassets的转账ABI
+func testNFTABI() *eos.ABI {
+	return &eos.ABI{
+		Version: "eosio::abi/1.1",
+		Structs: []eos.StructDef{
+			{
+				Name: "transfer",
+				Fields: []eos.FieldDef{
+					{Name: "from", Type: "name"},
+					{Name: "to", Type: "name"},
+					{Name: "asset_ids", Type: "uint64[]"},
+					{Name: "memo", Type: "string"},
+				},
+			},
+		},
+		Actions: []eos.ActionDef{{Name: "transfer", Type: "transfer"}},
+	}
+}
+
+func TestEOSBlockScanner_ExtractContractAction(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+	node.abis["atomicassets"] = testNFTABI()
+
+	wm := testNewMockWalletManager(node)
+	bs := wm.Blockscanner
+	bs.MonitorContractActions = ParseContractActions("atomicassets::transfer, eosio::delegatebw, myapp::*")
+	bs.ScanTargetFuncV2 = func(target openwallet.ScanTargetParam) openwallet.ScanTargetResult {
+		if target.ScanTargetType == openwallet.ScanTargetTypeContractAddress && target.ScanTarget == "atomicassets" {
+			return openwallet.ScanTargetResult{SourceKey: "contract_atomicassets", Exist: true}
+		}
+		return openwallet.ScanTargetResult{}
+	}
+
+	packed := testPackedTransaction(1,
+		testNFTTransferAction("alice", "bob", []uint64{1099511627776, 1099511627777}, "gift"),
+		testNFTTransferAction("alice", "carol", []uint64{1099511627778}, ""),
+		testTransferAction("eosio.token", "alice", "bob", "1.0000 EOS", "fee"),
+		&eos.Action{Account: "myapp", Name: "log", Authorization: []eos.PermissionLevel{{Actor: "alice", Permission: "active"}}, ActionData: eos.NewActionDataFromHexData([]byte{1})},
+	)
+	block := testBlock(100, 0, testBlockID(99, 0), packed)
+
+	result := bs.ExtractTransaction(100, block.ID.String(), block.Timestamp.Unix(), block.Transactions[0], testScanTargetFunc(map[string]string{"bob": "account_bob"}))
+	if !result.Success {
+		t.Fatalf("extract transaction failed")
+	}
+
+	receipts := result.extractContractData["contract_atomicassets"]
+	if len(receipts) != 1 {
+		t.Fatalf("contract receipts = %d, want 1", len(receipts))
+	}
+	receipt := receipts[0]
+	//订阅了但没有登记的合约不生成回执
+	if len(result.extractContractData) != 1 {
+		t.Errorf("contract receipts = %d, want only atomicassets", len(result.extractContractData))
+	}
+	if len(receipt.Events) != 2 || receipt.Events[0].Event != "transfer" {
+		t.Fatalf("receipt events size = %d, want 2", len(receipt.Events))
+	}
+	var event1, event2 struct {
+		To       string   `json:"to"`
+		AssetIDs []uint64 `json:"asset_ids"`
+	}
+	json.Unmarshal([]byte(receipt.Events[0].Value), &event1)
+	json.Unmarshal([]byte(receipt.Events[1].Value), &event2)
+	if len(event1.AssetIDs) != 2 || event2.To != "carol" {
+		t.Errorf("unexpected events: %s, %s", receipt.Events[0].Value, receipt.Events[1].Value)
+	}
+	if receipt.From != "alice" || receipt.To != "atomicassets" || receipt.TxID != result.TxID || len(receipt.WxID) == 0 {
+		t.Errorf("unexpected receipt: %+v", receipt)
+	}
+	var raw []json.RawMessage
+	if json.Unmarshal([]byte(receipt.RawReceipt), &raw); len(raw) != 2 {
+		t.Errorf("unexpected raw receipt: %s", receipt.RawReceipt)
+	}
+
+	//代币转账仍然按转账提取
+	if len(result.extractData["account_bob"]) != 1 {
+		t.Errorf("bob extract data size = %d, want 1", len(result.extractData["account_bob"]))
+	}
+
+	observer := newTestObserver()
+	bs.AddObserver(observer)
+	bs.saveExtractResult(100, result)
+	if len(observer.receipts["contract_atomicassets"]) != 1 {
+		t.Errorf("observer receipts size = %d, want 1", len(observer.receipts["contract_atomicassets"]))
+	}
+}
+
+func TestEOSBlockScanner_ExtractContractActionPerContract(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+	node.abis["atomicassets"] = testNFTABI()
+
+	//同一源标识登记了两个合约
+	wm := testNewMockWalletManager(node)
+	bs := wm.Blockscanner
+	bs.MonitorContractActions = ParseContractActions("atomicassets::transfer, eosio.token::transfer")
+	bs.ScanTargetFuncV2 = func(target openwallet.ScanTargetParam) openwallet.ScanTargetResult {
+		if target.ScanTargetType == openwallet.ScanTargetTypeContractAddress && (target.ScanTarget == "atomicassets" || target.ScanTarget == "eosio.token") {
+			return openwallet.ScanTargetResult{SourceKey: "contract_wallet", Exist: true}
+		}
+		return openwallet.ScanTargetResult{}
+	}
+
+	packed := testPackedTransaction(1,
+		testNFTTransferAction("alice", "bob", []uint64{1099511627776}, ""),
+		testTransferAction("eosio.token", "alice", "bob", "1.0000 EOS", ""),
+		testNFTTransferAction("alice", "carol", []uint64{1099511627777}, ""),
+	)
+	block := testBlock(100, 0, testBlockID(99, 0), packed)
+	result := bs.ExtractTransaction(100, block.ID.String(), block.Timestamp.Unix(), block.Transactions[0], testScanTargetFunc(nil))
+	if !result.Success {
+		t.Fatalf("extract transaction failed")
+	}
+
+	//每个合约一个回执，按合约首次出现的顺序
+	receipts := result.extractContractData["contract_wallet"]
+	if len(receipts) != 2 || receipts[0].To != "atomicassets" || receipts[1].To != "eosio.token" {
+		t.Fatalf("contract receipts = %d, want atomicassets and eosio.token", len(receipts))
+	}
+	if len(receipts[0].Events) != 2 || len(receipts[1].Events) != 1 || receipts[0].WxID == receipts[1].WxID {
+		t.Errorf("unexpected receipts: %+v, %+v", receipts[0], receipts[1])
+	}
+
+	observer := newTestObserver()
+	bs.AddObserver(observer)
+	bs.saveExtractResult(100, result)
+	if len(observer.receipts["contract_wallet"]) != 2 {
+		t.Errorf("observer receipts size = %d, want 2", len(observer.receipts["contract_wallet"]))
+	}
+}
+
+func TestParseContractActions(t *testing.T) {
+	actions := ParseContractActions("atomicassets::transfer, myapp::* ,invalid,::empty")
+	if len(actions) != 2 || !actions["atomicassets::transfer"] || !actions["myapp::*"] {
+		t.Errorf("unexpected actions: %v", actions)
+	}
+
+	bs := NewWalletManager(nil).Blockscanner
+	bs.MonitorContractActions = actions
+	if !bs.isMonitorContractAction(&eos.Action{Account: "myapp", Name: "anything"}) {
+		t.Errorf("wildcard action is not monitored")
+	}
+	if bs.isMonitorContractAction(&eos.Action{Account: "atomicassets", Name: "burnasset"}) {
+		t.Errorf("unexpected monitored action")
+	}
+}
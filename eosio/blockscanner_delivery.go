@@ -0,0 +1,267 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const (
+	//已送达的通知
+	notifyDeliveredBucket = "notify_delivered"
+	//保留不可逆区块之前的送达记录的区块数量，覆盖重扫不可逆区块的常见范围
+	deliveredPruneMargin = 10000
+	//清理送达记录的间隔
+	deliveredPruneInterval = time.Hour
+)
+
+//deliveredRecord 已送达通知的记录
+type deliveredRecord struct {
+	BlockHeight uint64
+	DeliveredAt int64
+}
+
+//keyLocks 按键加锁，同一键的操作串行执行，不同键互不阻塞
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+//keyLock 键的锁和等待者数量，没有等待者时从map中删除
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+//lock 锁定键，返回解锁函数
+func (kl *keyLocks) lock(key string) func() {
+	kl.mu.Lock()
+	if kl.locks == nil {
+		kl.locks = make(map[string]*keyLock)
+	}
+	l, ok := kl.locks[key]
+	if !ok {
+		l = &keyLock{}
+		kl.locks[key] = l
+	}
+	l.refs++
+	kl.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		kl.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(kl.locks, key)
+		}
+		kl.mu.Unlock()
+	}
+}
+
+//sourceExtractData 按sourceKey分组前的提取数据
+type sourceExtractData struct {
+	sourceKey string
+	data      *openwallet.TxExtractData
+}
+
+//notifyKey 通知在重试队列和已送达集合中的键
+func (bs *EOSBlockScanner) notifyKey(o openwallet.BlockScanNotificationObject, sourceKey, sid string) string {
+	return fmt.Sprintf("%s|%s|%s", bs.observerID(o), sourceKey, sid)
+}
+
+//orderedExtractData 按操作执行顺序排列交易的提取数据，同一操作按sourceKey排列
+func orderedExtractData(extractData map[string][]*openwallet.TxExtractData) []sourceExtractData {
+	ordered := make([]sourceExtractData, 0, len(extractData))
+	for key, array := range extractData {
+		for _, item := range array {
+			ordered = append(ordered, sourceExtractData{sourceKey: key, data: item})
+		}
+	}
+	//通过追踪提取的操作按全局序号，内联操作的操作序号大于之后执行的顶层操作；打包交易只有顶层操作，按操作序号
+	executionOrder := func(data *openwallet.TxExtractData) uint64 {
+		if data.Transaction == nil {
+			return 0
+		}
+		params := data.Transaction.GetExtParam()
+		if seq := params.Get("globalSequence").Uint(); seq > 0 {
+			return seq
+		}
+		return params.Get("actionOrdinal").Uint()
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		oi, oj := executionOrder(ordered[i].data), executionOrder(ordered[j].data)
+		if oi != oj {
+			return oi < oj
+		}
+		return ordered[i].sourceKey < ordered[j].sourceKey
+	})
+	return ordered
+}
+
+//isDelivered 通知是否已经送达
+func (bs *EOSBlockScanner) isDelivered(store KeyValueStore, key string) bool {
+	var record deliveredRecord
+	return store.GetValue(notifyDeliveredBucket, key, &record) == nil
+}
+
+//markDelivered 记录通知已送达
+func (bs *EOSBlockScanner) markDelivered(store KeyValueStore, key string, height uint64) {
+	err := store.SetValue(notifyDeliveredBucket, key, &deliveredRecord{BlockHeight: height, DeliveredAt: time.Now().Unix()})
+	if err != nil {
+		bs.wm.Log.Std.Error("save delivered notification: %s failed. unexpected error: %v", key, err)
+	}
+}
+
+//deliver 投递一条通知。已送达的通知不再投递，投递失败时加入重试队列。
+//同一通知的检查、投递和记录按键串行，回填、实时扫描和重试同时投递时只通知一次。
+//没有持久化存储时不去重，通知没有送达也没有记录重试时返回false
+func (bs *EOSBlockScanner) deliver(o openwallet.BlockScanNotificationObject, height uint64, entry *NotifyOutboxEntry) bool {
+
+	store := bs.stateStore()
+	key := bs.notifyKey(o, entry.SourceKey, entry.Sid)
+	if len(entry.Sid) > 0 {
+		defer bs.deliverLocks.lock(key)()
+	}
+	if store != nil && len(entry.Sid) > 0 && bs.isDelivered(store, key) {
+		bs.wm.Log.Std.Debug("notification: %s has been delivered, skip", key)
+		return true
+	}
+
+	if err := entry.notify(o); err != nil {
+		switch {
+		case entry.ContractReceipt != nil:
+			bs.wm.Log.Std.Error("BlockExtractSmartContractDataNotify unexpected error: %v", err)
+		case entry.Kind == notifyKindFinalized:
+			bs.wm.Log.Std.Error("BlockExtractDataFinalizedNotify unexpected error: %v", err)
+		case entry.Kind == notifyKindReversal:
+			bs.wm.Log.Std.Error("BlockExtractDataReversalNotify unexpected error: %v", err)
+		default:
+			bs.wm.Log.Std.Error("BlockExtractDataNotify unexpected error: %v", err)
+		}
+		//加入重试队列，只重试该条通知
+		return bs.notifyFailed(o, height, entry, err)
+	}
+
+	if store != nil && len(entry.Sid) > 0 {
+		bs.markDelivered(store, key, height)
+	}
+	return true
+}
+
+//forgetDelivered 撤销通知后删除送达记录，交易在新的分叉上再次出现时重新通知
+func (bs *EOSBlockScanner) forgetDelivered(o openwallet.BlockScanNotificationObject, sourceKey string, data *openwallet.TxExtractData) {
+	store := bs.stateStore()
+	if store == nil {
+		return
+	}
+	key := bs.notifyKey(o, sourceKey, extractDataSid(data))
+	if err := store.DeleteValue(notifyDeliveredBucket, key); err != nil {
+		bs.wm.Log.Std.Error("delete delivered notification: %s failed. unexpected error: %v", key, err)
+	}
+}
+
+// IsNotificationDelivered 观测者是否已收到sourceKey下Sid的通知
+func (bs *EOSBlockScanner) IsNotificationDelivered(o openwallet.BlockScanNotificationObject, sourceKey, sid string) (bool, error) {
+	store := bs.stateStore()
+	if store == nil {
+		return false, fmt.Errorf("delivered notification store is not setup")
+	}
+	return bs.isDelivered(store, bs.notifyKey(o, sourceKey, sid)), nil
+}
+
+// PruneDeliveredNotifications 删除低于指定高度的送达记录，之后重扫这些区块会再次通知
+func (bs *EOSBlockScanner) PruneDeliveredNotifications(belowHeight uint64) error {
+
+	store := bs.stateStore()
+	if store == nil {
+		return fmt.Errorf("delivered notification store is not setup")
+	}
+
+	keys, err := store.Keys(notifyDeliveredBucket)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		var record deliveredRecord
+		if err := store.GetValue(notifyDeliveredBucket, key, &record); err != nil {
+			if err == ErrKeyNotFound {
+				continue
+			}
+			return err
+		}
+		if record.BlockHeight < belowHeight {
+			if err := store.DeleteValue(notifyDeliveredBucket, key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+//pruneDelivered 每隔deliveredPruneInterval删除不可逆区块之前deliveredPruneMargin个区块以下的送达记录，
+//未重扫的区块和等待重试的通知仍需要去重，清理高度不超过它们
+func (bs *EOSBlockScanner) pruneDelivered() {
+
+	store := bs.stateStore()
+	if store == nil || time.Since(bs.lastDeliveredPrune) < deliveredPruneInterval {
+		return
+	}
+	bs.lastDeliveredPrune = time.Now()
+
+	lib, err := bs.lastIrreversibleBlockNum()
+	if err != nil {
+		bs.wm.Log.Std.Error("prune delivered notifications can not get last irreversible block; unexpected error: %v", err)
+		return
+	}
+	if uint64(lib) <= deliveredPruneMargin {
+		return
+	}
+	belowHeight := uint64(lib) - deliveredPruneMargin
+
+	if bs.BlockchainDAI != nil {
+		records, err := bs.GetUnscanRecords()
+		if err != nil {
+			bs.wm.Log.Std.Error("prune delivered notifications can not get rescan data; unexpected error: %v", err)
+			return
+		}
+		for _, r := range records {
+			if r.BlockHeight > 0 && r.BlockHeight < belowHeight {
+				belowHeight = r.BlockHeight
+			}
+		}
+	}
+
+	entries, err := bs.getNotifyEntries(store, notifyOutboxBucket)
+	if err != nil {
+		bs.wm.Log.Std.Error("prune delivered notifications can not get failed notifications; unexpected error: %v", err)
+		return
+	}
+	if len(entries) > 0 && entries[0].BlockHeight < belowHeight {
+		belowHeight = entries[0].BlockHeight
+	}
+
+	if err := bs.PruneDeliveredNotifications(belowHeight); err != nil {
+		bs.wm.Log.Std.Error("prune delivered notifications below height: %d failed. unexpected error: %v", belowHeight, err)
+	}
+}
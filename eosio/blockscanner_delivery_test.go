@@ -0,0 +1,276 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
+)
+
+//orderObserver 记录通知的顺序，通知内容为sourceKey:memo
+type orderObserver struct {
+	*testObserver
+	id    string
+	mu    sync.Mutex
+	order []string
+}
+
+func newOrderObserver(id string) *orderObserver {
+	return &orderObserver{testObserver: newTestObserver(), id: id}
+}
+
+func (o *orderObserver) ObserverID() string {
+	return o.id
+}
+
+func (o *orderObserver) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	o.mu.Lock()
+	o.order = append(o.order, sourceKey+":"+data.Transaction.GetExtParam().Get("memo").String())
+	o.mu.Unlock()
+	return o.testObserver.BlockExtractDataNotify(sourceKey, data)
+}
+
+func (o *orderObserver) delivered() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string{}, o.order...)
+}
+
+func TestEOSBlockScanner_OrderedDelivery(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	want := make([]string, 0)
+	transactions := make([]*eos.PackedTransaction, 0)
+	for i := 0; i < 20; i++ {
+		memo := fmt.Sprint(i)
+		transactions = append(transactions, testPackedTransaction(uint16(i), testTransferAction("eosio.token", "carol", "alice", "1.0000 EOS", memo)))
+		want = append(want, "account_alice:"+memo)
+	}
+	//同一交易中的多个操作按操作顺序通知
+	transactions = append(transactions, testPackedTransaction(100,
+		testTransferAction("eosio.token", "carol", "bob", "1.0000 EOS", "a0"),
+		testTransferAction("eosio.token", "carol", "alice", "1.0000 EOS", "a1"),
+		testTransferAction("eosio.token", "carol", "bob", "1.0000 EOS", "a2"),
+	))
+	want = append(want, "account_bob:a0", "account_alice:a1", "account_bob:a2")
+	block := testBlock(100, 0, testBlockID(99, 0), transactions...)
+
+	wm := testNewMockWalletManager(node)
+	bs := wm.Blockscanner
+	bs.ScanTargetFunc = testScanTargetFunc(map[string]string{"alice": "account_alice", "bob": "account_bob"})
+	observer := newOrderObserver("wallet")
+	bs.AddObserver(observer)
+
+	if err := bs.BatchExtractTransactions(100, block.ID.String(), block.Timestamp.Unix(), block.Transactions); err != nil {
+		t.Fatalf("batch extract transactions failed: %v", err)
+	}
+
+	delivered := observer.delivered()
+	if len(delivered) != len(want) {
+		t.Fatalf("delivered size = %d, want %d", len(delivered), len(want))
+	}
+	for i := range want {
+		if delivered[i] != want[i] {
+			t.Fatalf("delivered[%d] = %s, want %s", i, delivered[i], want[i])
+		}
+	}
+}
+
+func TestEOSBlockScanner_DeliverOnce(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	blocks := node.addChain(100, 101, 0, testBlockID(99, 0), map[uint32]*eos.PackedTransaction{
+		101: testPackedTransaction(1, testTransferAction("eosio.token", "carol", "alice", "1.0000 EOS", "deposit")),
+	})
+	node.info.HeadBlockNum = 101
+
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	scanTargetFunc := testScanTargetFunc(map[string]string{"alice": "account_alice"})
+
+	wm := testNewMockWalletManager(node)
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	bs.ScanTargetFunc = scanTargetFunc
+	observer := newOrderObserver("wallet")
+	bs.AddObserver(observer)
+
+	//重扫区块不重复通知
+	bs.scanBlock(101)
+	bs.scanBlock(101)
+	if len(observer.delivered()) != 1 {
+		t.Fatalf("delivered size = %d, want 1", len(observer.delivered()))
+	}
+	sid := observer.extractData("account_alice")[0].TxOutputs[0].Sid
+	if delivered, _ := bs.IsNotificationDelivered(observer, "account_alice", sid); !delivered {
+		t.Errorf("notification is not marked delivered")
+	}
+
+	//重启后仍不重复通知，其他观测者正常通知
+	wm2 := testNewMockWalletManager(node)
+	restarted := wm2.Blockscanner
+	restarted.SetBlockchainDAI(dai)
+	restarted.ScanTargetFunc = scanTargetFunc
+	observer2, other := newOrderObserver("wallet"), newOrderObserver("audit")
+	restarted.AddObserver(observer2)
+	restarted.AddObserver(other)
+	restarted.scanBlock(101)
+	if len(observer2.delivered()) != 0 || len(other.delivered()) != 1 {
+		t.Fatalf("delivered after restart = %d, other observer = %d", len(observer2.delivered()), len(other.delivered()))
+	}
+
+	//分叉撤销后，交易再次出现时重新通知
+	restarted.reversalDataNotify(&finalizingBlock{Height: 101, Hash: blocks[101].ID.String(), ExtractData: map[string]map[string][]*openwallet.TxExtractData{
+		"tx": {"account_alice": observer.extractData("account_alice")},
+	}})
+	restarted.scanBlock(101)
+	if len(observer2.delivered()) != 2 || len(other.delivered()) != 3 {
+		t.Errorf("delivered after reversal = %d, other observer = %d", len(observer2.delivered()), len(other.delivered()))
+	}
+
+	//清理送达记录后重扫再次通知
+	if err := restarted.PruneDeliveredNotifications(uint64(blocks[101].BlockNum)); err != nil {
+		t.Fatalf("prune delivered notifications failed: %v", err)
+	}
+	if delivered, _ := restarted.IsNotificationDelivered(observer2, "account_alice", sid); !delivered {
+		t.Errorf("notification above prune height should be kept")
+	}
+	restarted.PruneDeliveredNotifications(102)
+	restarted.scanBlock(101)
+	if len(observer2.delivered()) != 3 {
+		t.Errorf("delivered after prune = %d, want 3", len(observer2.delivered()))
+	}
+}
+
+func TestEOSBlockScanner_DeliverPlainObserverOnce(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	node.addChain(100, 101, 0, testBlockID(99, 0), map[uint32]*eos.PackedTransaction{
+		101: testPackedTransaction(1, testTransferAction("eosio.token", "carol", "alice", "1.0000 EOS", "deposit")),
+	})
+	node.info.HeadBlockNum = 101
+
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	scanTargetFunc := testScanTargetFunc(map[string]string{"alice": "account_alice"})
+
+	wm := testNewMockWalletManager(node)
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	bs.ScanTargetFunc = scanTargetFunc
+
+	//没有实现IdentifiedObserver的观测者按币种和类型名去重，重扫不重复通知
+	observer := newTestObserver()
+	bs.AddObserver(observer)
+	bs.scanBlock(101)
+	bs.scanBlock(101)
+	if len(observer.extractData("account_alice")) != 1 {
+		t.Fatalf("delivered = %d, want 1", len(observer.extractData("account_alice")))
+	}
+	sid := observer.extractData("account_alice")[0].TxOutputs[0].Sid
+	if delivered, err := bs.IsNotificationDelivered(observer, "account_alice", sid); err != nil || !delivered {
+		t.Errorf("notification is not marked delivered: %v", err)
+	}
+
+	//重启后标识不变，仍不重复通知
+	restarted := testNewMockWalletManager(node).Blockscanner
+	restarted.SetBlockchainDAI(dai)
+	restarted.ScanTargetFunc = scanTargetFunc
+	observer2 := newTestObserver()
+	restarted.AddObserver(observer2)
+	restarted.scanBlock(101)
+	if len(observer2.extractData("account_alice")) != 0 {
+		t.Errorf("delivered after restart = %d, want 0", len(observer2.extractData("account_alice")))
+	}
+}
+
+func TestEOSBlockScanner_DeliverConcurrent(t *testing.T) {
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+
+	wm := NewWalletManager(nil)
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	observer := newOrderObserver("wallet")
+
+	//回填和实时扫描同时投递同一通知，只通知一次
+	data := &openwallet.TxExtractData{
+		TxOutputs:   []*openwallet.TxOutPut{{Recharge: openwallet.Recharge{Sid: "tx1_0"}}},
+		Transaction: &openwallet.Transaction{TxID: "tx1", BlockHeight: 10},
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bs.deliver(observer, 10, &NotifyOutboxEntry{SourceKey: "account_alice", Sid: "tx1_0", ExtractData: data})
+		}()
+	}
+	wg.Wait()
+
+	if len(observer.delivered()) != 1 {
+		t.Errorf("delivered size = %d, want 1", len(observer.delivered()))
+	}
+	if len(bs.deliverLocks.locks) != 0 {
+		t.Errorf("delivery locks = %d, want released", len(bs.deliverLocks.locks))
+	}
+}
+
+func TestEOSBlockScanner_PruneDeliveredFromScanTask(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+
+	wm := testNewMockWalletManager(node)
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	for _, height := range []uint64{100, 200, 300} {
+		bs.markDelivered(dai, fmt.Sprintf("wallet|account_alice|%d", height), height)
+	}
+
+	//不可逆区块之前保留deliveredPruneMargin个区块，等待重试的通知所在区块也保留
+	node.info.LastIrreversibleBlockNum = 300 + deliveredPruneMargin
+	dai.SetValue(notifyOutboxBucket, "wallet|account_alice|200", &NotifyOutboxEntry{Key: "wallet|account_alice|200", BlockHeight: 200})
+	bs.runRetryTasks()
+	keys, _ := dai.Keys(notifyDeliveredBucket)
+	if len(keys) != 2 {
+		t.Fatalf("delivered records = %v, want 200 and 300", keys)
+	}
+
+	//间隔内不重复清理
+	dai.DeleteValue(notifyOutboxBucket, "wallet|account_alice|200")
+	bs.runRetryTasks()
+	if keys, _ := dai.Keys(notifyDeliveredBucket); len(keys) != 2 {
+		t.Fatalf("delivered records = %v, want 200 and 300", keys)
+	}
+
+	bs.lastDeliveredPrune = time.Time{}
+	bs.runRetryTasks()
+	keys, _ = dai.Keys(notifyDeliveredBucket)
+	if len(keys) != 1 || keys[0] != "wallet|account_alice|300" {
+		t.Errorf("delivered records = %v, want 300", keys)
+	}
+}
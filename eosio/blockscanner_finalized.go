@@ -0,0 +1,266 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
+)
+
+const (
+	//等待不可逆的区块提取数据
+	finalizingBucket = "finalizing_blocks"
+	//已发送确认通知的高度
+	finalizedHeightBucket = "finalized_height"
+)
+
+// FinalizedObserver 可选的观测者接口，混合模式下交易所在区块不可逆后接收确认通知。
+// 没有实现该接口的观测者不接收确认通知，同一Sid只通过BlockExtractDataNotify通知一次
+type FinalizedObserver interface {
+	BlockExtractDataFinalizedNotify(sourceKey string, data *openwallet.TxExtractData) error
+}
+
+//finalizingBlock 等待不可逆的区块提取数据，分叉时用于发送撤销通知
+type finalizingBlock struct {
+	Height uint64
+	Hash   string
+	//交易在区块中的顺序
+	TxIDs []string
+	//txid -> sourceKey -> 提取数据
+	ExtractData map[string]map[string][]*openwallet.TxExtractData
+}
+
+//scanMaxBlockHeight 按扫描模式获取可扫描的最大高度
+func (bs *EOSBlockScanner) scanMaxBlockHeight(infoResp *eos.InfoResp) uint32 {
+	if bs.wm.Config.ScanMode == ScanModeIrreversible {
+		return infoResp.LastIrreversibleBlockNum
+	}
+	return infoResp.HeadBlockNum
+}
+
+//addFinalizingData 记录等待不可逆的提取数据，同一交易重扫时覆盖之前的记录
+func (bs *EOSBlockScanner) addFinalizingData(height uint64, hash, txid string, extractData map[string][]*openwallet.TxExtractData) {
+	//不可逆模式的区块不会分叉，无需记录
+	if bs.wm.Config.ScanMode == ScanModeIrreversible || len(extractData) == 0 {
+		return
+	}
+
+	bs.finalizingLock.Lock()
+	defer bs.finalizingLock.Unlock()
+
+	bs.loadFinalizing()
+
+	//已经确认过的区块不再重复通知
+	if height <= bs.finalizedHeight {
+		return
+	}
+
+	block, ok := bs.finalizing[height]
+	if !ok || block.Hash != hash {
+		block = &finalizingBlock{
+			Height:      height,
+			Hash:        hash,
+			ExtractData: make(map[string]map[string][]*openwallet.TxExtractData),
+		}
+		bs.finalizing[height] = block
+	}
+	if _, exist := block.ExtractData[txid]; !exist {
+		block.TxIDs = append(block.TxIDs, txid)
+	}
+	block.ExtractData[txid] = extractData
+	bs.saveFinalizingBlock(block)
+}
+
+//removeFinalizingData 删除指定高度的等待数据
+func (bs *EOSBlockScanner) removeFinalizingData(height uint64) *finalizingBlock {
+	bs.finalizingLock.Lock()
+	defer bs.finalizingLock.Unlock()
+
+	bs.loadFinalizing()
+
+	block := bs.finalizing[height]
+	delete(bs.finalizing, height)
+	if block != nil {
+		bs.deleteFinalizingBlock(height)
+	}
+	return block
+}
+
+//loadFinalizing 首次使用时从持久化存储加载等待数据和已确认高度，重启后仍能发送确认和撤销通知。
+//调用者需持有finalizingLock
+func (bs *EOSBlockScanner) loadFinalizing() {
+	if bs.finalizingLoaded {
+		return
+	}
+	store := bs.stateStore()
+	if store == nil {
+		return
+	}
+
+	keys, err := store.Keys(finalizingBucket)
+	if err != nil {
+		bs.wm.Log.Std.Error("block scanner can not load finalizing blocks; unexpected error: %v", err)
+		return
+	}
+	for _, key := range keys {
+		var block finalizingBlock
+		if err := store.GetValue(finalizingBucket, key, &block); err != nil {
+			bs.wm.Log.Std.Error("block scanner can not load finalizing block: %s; unexpected error: %v", key, err)
+			return
+		}
+		//内存中的数据较新
+		if _, exist := bs.finalizing[block.Height]; !exist {
+			bs.finalizing[block.Height] = &block
+		}
+	}
+
+	var height uint64
+	if err := store.GetValue(finalizedHeightBucket, bs.wm.Symbol(), &height); err == nil && height > bs.finalizedHeight {
+		bs.finalizedHeight = height
+	}
+
+	bs.finalizingLoaded = true
+}
+
+//saveFinalizingBlock 保存等待数据，没有持久化存储时只保存在内存
+func (bs *EOSBlockScanner) saveFinalizingBlock(block *finalizingBlock) {
+	store := bs.stateStore()
+	if store == nil {
+		return
+	}
+	if err := store.SetValue(finalizingBucket, strconv.FormatUint(block.Height, 10), block); err != nil {
+		bs.wm.Log.Std.Error("block height: %d, save finalizing block failed. unexpected error: %v", block.Height, err)
+	}
+}
+
+//deleteFinalizingBlock 删除已确认或已分叉的等待数据
+func (bs *EOSBlockScanner) deleteFinalizingBlock(height uint64) {
+	store := bs.stateStore()
+	if store == nil {
+		return
+	}
+	if err := store.DeleteValue(finalizingBucket, strconv.FormatUint(height, 10)); err != nil {
+		bs.wm.Log.Std.Error("block height: %d, delete finalizing block failed. unexpected error: %v", height, err)
+	}
+}
+
+//notifyFinalizedData 区块进入不可逆后删除等待数据，混合模式先发送确认通知，
+//通知没有送达也无法加入重试队列时保留该区块及之后的等待数据，下次再通知
+func (bs *EOSBlockScanner) notifyFinalizedData(lastIrreversibleHeight uint64) {
+
+	bs.finalizingLock.Lock()
+	defer bs.finalizingLock.Unlock()
+
+	bs.loadFinalizing()
+
+	finalizedHeight := bs.finalizedHeight
+	defer func() {
+		if bs.finalizedHeight > finalizedHeight {
+			if store := bs.stateStore(); store != nil {
+				if err := store.SetValue(finalizedHeightBucket, bs.wm.Symbol(), bs.finalizedHeight); err != nil {
+					bs.wm.Log.Std.Error("save finalized height: %d failed. unexpected error: %v", bs.finalizedHeight, err)
+				}
+			}
+		}
+	}()
+
+	heights := make([]uint64, 0)
+	for height := range bs.finalizing {
+		if height <= lastIrreversibleHeight {
+			heights = append(heights, height)
+		}
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+
+	for _, height := range heights {
+		block := bs.finalizing[height]
+
+		//本地区块已被替换，说明该区块已分叉
+		if localBlock, err := bs.GetLocalBlock(uint32(height)); err == nil && localBlock.Hash != block.Hash {
+			bs.wm.Log.Std.Info("block height: %d hash: %s has been forked, skip finalized notify", height, block.Hash)
+			delete(bs.finalizing, height)
+			bs.deleteFinalizingBlock(height)
+			continue
+		}
+
+		if bs.wm.Config.ScanMode == ScanModeHybrid {
+			bs.wm.Log.Std.Info("block height: %d hash: %s has been finalized", height, block.Hash)
+			if !bs.finalizedDataNotify(block) {
+				bs.wm.Log.Std.Error("block height: %d finalized notification is not delivered, retry next time", height)
+				return
+			}
+		}
+
+		delete(bs.finalizing, height)
+		bs.deleteFinalizingBlock(height)
+		if height > bs.finalizedHeight {
+			bs.finalizedHeight = height
+		}
+	}
+}
+
+//ordered 按交易在区块中的顺序和操作执行顺序排列提取数据
+func (block *finalizingBlock) ordered() []sourceExtractData {
+	txids := append([]string{}, block.TxIDs...)
+	//没有记录顺序的交易按交易ID排在最后
+	listed := make(map[string]bool, len(txids))
+	for _, txid := range txids {
+		listed[txid] = true
+	}
+	unlisted := make([]string, 0)
+	for txid := range block.ExtractData {
+		if !listed[txid] {
+			unlisted = append(unlisted, txid)
+		}
+	}
+	sort.Strings(unlisted)
+	txids = append(txids, unlisted...)
+
+	ordered := make([]sourceExtractData, 0)
+	for _, txid := range txids {
+		ordered = append(ordered, orderedExtractData(block.ExtractData[txid])...)
+	}
+	return ordered
+}
+
+//finalizedDataNotify 向实现FinalizedObserver的观测者发送不可逆确认通知，失败的通知加入重试队列。
+//有通知没有送达也无法加入重试队列时返回false
+func (bs *EOSBlockScanner) finalizedDataNotify(block *finalizingBlock) bool {
+	handled := true
+	ordered := block.ordered()
+	for _, o := range bs.observers() {
+		if _, ok := o.(FinalizedObserver); !ok {
+			continue
+		}
+		for _, item := range ordered {
+			entry := &NotifyOutboxEntry{
+				Kind:        notifyKindFinalized,
+				SourceKey:   item.sourceKey,
+				Sid:         blockNotifySid(notifyKindFinalized, block.Hash, item.data),
+				ExtractData: item.data,
+			}
+			//之后的通知下次按顺序再发送
+			if !bs.deliver(o, block.Height, entry) {
+				handled = false
+				break
+			}
+		}
+	}
+	return handled
+}
@@ -0,0 +1,285 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/astaxie/beego/config"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
+)
+
+//testFinalizedObserver 记录不可逆确认通知的观测者
+type testFinalizedObserver struct {
+	*testObserver
+	finalized map[string][]*openwallet.TxExtractData
+}
+
+func (o *testFinalizedObserver) BlockExtractDataFinalizedNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.finalized[sourceKey] = append(o.finalized[sourceKey], data)
+	return nil
+}
+
+//testFinalityScanner 区块101和103各有一笔给alice的转账，本地已扫描到区块100
+func testFinalityScanner(t *testing.T, node *mockNode, scanMode string) (*EOSBlockScanner, func()) {
+	transactions := map[uint32]*eos.PackedTransaction{
+		101: testPackedTransaction(1, testTransferAction("eosio.token", "bob", "alice", "1.0000 EOS", "101")),
+		103: testPackedTransaction(3, testTransferAction("eosio.token", "bob", "alice", "3.0000 EOS", "103")),
+	}
+	blocks := node.addChain(100, 104, 0, testBlockID(99, 0), transactions)
+	node.info.HeadBlockNum = 104
+	node.info.LastIrreversibleBlockNum = 102
+
+	wm := testNewMockWalletManager(node)
+	wm.Config.ScanMode = scanMode
+	dai, cleanup := testBlockchainDAI(t)
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	bs.ScanTargetFunc = testScanTargetFunc(map[string]string{"alice": "account_alice"})
+	bs.RescanLastBlockCount = 0
+	bs.Scanning = true
+	bs.SaveLocalBlockHead(100, blocks[100].ID.String())
+
+	return bs, cleanup
+}
+
+func TestEOSBlockScanner_ScanBlockTask_Irreversible(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	bs, cleanup := testFinalityScanner(t, node, ScanModeIrreversible)
+	defer cleanup()
+
+	observer := newTestObserver()
+	bs.AddObserver(observer)
+	bs.ScanBlockTask()
+
+	height, hash, _ := bs.GetLocalBlockHead()
+	if height != 102 || hash != testBlockID(102, 0).String() {
+		t.Errorf("local block head = %d %s, want 102", height, hash)
+	}
+
+	extracted := observer.extractData("account_alice")
+	if len(extracted) != 1 || extracted[0].Transaction.BlockHeight != 101 {
+		t.Fatalf("alice extract data size = %d, want only block 101", len(extracted))
+	}
+
+	if node.callCount("/v1/chain/get_block") != 2 {
+		t.Errorf("get_block calls = %d, want 2", node.callCount("/v1/chain/get_block"))
+	}
+}
+
+func TestEOSBlockScanner_ScanBlockTask_Hybrid(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	bs, cleanup := testFinalityScanner(t, node, ScanModeHybrid)
+	defer cleanup()
+
+	observer := newTestFinalizedObserver()
+	bs.AddObserver(observer)
+	bs.ScanBlockTask()
+
+	if len(observer.extractData("account_alice")) != 2 {
+		t.Fatalf("alice extract data size = %d, want 2", len(observer.extractData("account_alice")))
+	}
+
+	finalized := observer.finalized["account_alice"]
+	if len(finalized) != 1 || finalized[0].Transaction.BlockHeight != 101 {
+		t.Fatalf("alice finalized size = %d, want only block 101", len(finalized))
+	}
+
+	//区块103进入不可逆
+	node.info.LastIrreversibleBlockNum = 104
+	bs.ScanBlockTask()
+
+	finalized = observer.finalized["account_alice"]
+	if len(finalized) != 2 || finalized[1].Transaction.BlockHeight != 103 {
+		t.Fatalf("alice finalized size = %d, want blocks 101 and 103", len(finalized))
+	}
+}
+
+func newTestFinalizedObserver() *testFinalizedObserver {
+	return &testFinalizedObserver{testObserver: newTestObserver(), finalized: make(map[string][]*openwallet.TxExtractData)}
+}
+
+func TestEOSBlockScanner_FinalizedDataNotify(t *testing.T) {
+	wm := NewWalletManager(nil)
+	wm.Config.ScanMode = ScanModeHybrid
+	bs := wm.Blockscanner
+
+	//未实现FinalizedObserver的观测者不接收确认通知
+	plain, observer := newTestObserver(), newTestFinalizedObserver()
+	bs.AddObserver(plain)
+	bs.AddObserver(observer)
+
+	tx := &openwallet.Transaction{TxID: "tx1", BlockHeight: 10}
+	bs.addFinalizingData(10, "hash10", "tx1", map[string][]*openwallet.TxExtractData{
+		"account_alice": {{Transaction: tx}},
+	})
+	bs.addFinalizingData(11, "hash11", "tx2", map[string][]*openwallet.TxExtractData{
+		"account_alice": {{Transaction: &openwallet.Transaction{TxID: "tx2", BlockHeight: 11}}},
+	})
+	//区块11分叉
+	bs.removeFinalizingData(11)
+	bs.notifyFinalizedData(11)
+
+	finalized := observer.finalized["account_alice"]
+	if len(finalized) != 1 || finalized[0].Transaction.TxID != "tx1" {
+		t.Fatalf("alice finalized size = %d, want only tx1", len(finalized))
+	}
+	if len(plain.extractData("account_alice")) != 0 || len(observer.extractData("account_alice")) != 0 {
+		t.Errorf("finalized data should not be notified by BlockExtractDataNotify")
+	}
+
+	//已确认的区块重扫不再通知
+	bs.addFinalizingData(10, "hash10", "tx1", map[string][]*openwallet.TxExtractData{
+		"account_alice": {{Transaction: tx}},
+	})
+	bs.notifyFinalizedData(11)
+	if len(observer.finalized["account_alice"]) != 1 {
+		t.Errorf("finalized block notified again")
+	}
+}
+
+//failingFinalizedObserver 确认通知先失败fail次
+type failingFinalizedObserver struct {
+	*testFinalizedObserver
+	fail int
+}
+
+func (o *failingFinalizedObserver) BlockExtractDataFinalizedNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	if o.fail > 0 {
+		o.fail--
+		return fmt.Errorf("observer is unavailable")
+	}
+	return o.testFinalizedObserver.BlockExtractDataFinalizedNotify(sourceKey, data)
+}
+
+func TestEOSBlockScanner_FinalizedDataRetry(t *testing.T) {
+	wm := NewWalletManager(nil)
+	wm.Config.ScanMode = ScanModeHybrid
+	wm.Config.NotifyRetryBackoff = 0
+	bs := wm.Blockscanner
+	observer := &failingFinalizedObserver{testFinalizedObserver: newTestFinalizedObserver(), fail: 1}
+	bs.AddObserver(observer)
+
+	extractData := func(txid string) map[string][]*openwallet.TxExtractData {
+		return map[string][]*openwallet.TxExtractData{"account_alice": {{
+			TxOutputs:   []*openwallet.TxOutPut{{Recharge: openwallet.Recharge{Sid: txid + "_0"}}},
+			Transaction: &openwallet.Transaction{TxID: txid, BlockHeight: 10},
+		}}}
+	}
+	bs.addFinalizingData(10, "hash10", "txb", extractData("txb"))
+	bs.addFinalizingData(10, "hash10", "txa", extractData("txa"))
+
+	//没有持久化存储时无法加入重试队列，保留等待数据下次通知
+	bs.notifyFinalizedData(10)
+	if len(bs.finalizing) != 1 || bs.finalizedHeight != 0 {
+		t.Fatalf("finalizing block should be kept when notification is lost")
+	}
+	bs.notifyFinalizedData(10)
+	finalized := observer.finalized["account_alice"]
+	//按交易在区块中的顺序通知
+	if len(finalized) != 2 || finalized[0].Transaction.TxID != "txb" || finalized[1].Transaction.TxID != "txa" || len(bs.finalizing) != 0 {
+		t.Fatalf("unexpected finalized notifications: %d", len(finalized))
+	}
+
+	//有持久化存储时失败的确认通知进入重试队列，删除等待数据
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	wm = NewWalletManager(nil)
+	wm.Config.ScanMode = ScanModeHybrid
+	wm.Config.NotifyRetryBackoff = 0
+	bs = wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	observer = &failingFinalizedObserver{testFinalizedObserver: newTestFinalizedObserver(), fail: 1}
+	bs.AddObserver(observer)
+	bs.addFinalizingData(10, "hash10", "txa", extractData("txa"))
+	bs.notifyFinalizedData(10)
+	pending, _ := bs.GetFailedNotifications()
+	if len(pending) != 1 || pending[0].Kind != notifyKindFinalized || pending[0].Sid != "finalized:hash10:txa_0" {
+		t.Fatalf("unexpected failed notifications: %+v", pending)
+	}
+	if keys, _ := dai.Keys(finalizingBucket); len(keys) != 0 {
+		t.Errorf("finalizing blocks = %v, want none", keys)
+	}
+	bs.RetryFailedNotifications()
+	if len(observer.finalized["account_alice"]) != 1 || len(observer.extractData("account_alice")) != 0 {
+		t.Errorf("failed finalized notification is not redelivered by BlockExtractDataFinalizedNotify")
+	}
+}
+
+func TestEOSBlockScanner_FinalizingDataRestart(t *testing.T) {
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+
+	wm := NewWalletManager(nil)
+	wm.Config.ScanMode = ScanModeHybrid
+	wm.Blockscanner.SetBlockchainDAI(dai)
+	wm.Blockscanner.addFinalizingData(10, "hash10", "tx1", map[string][]*openwallet.TxExtractData{
+		"account_alice": {{Transaction: &openwallet.Transaction{TxID: "tx1", BlockHeight: 10}}},
+	})
+
+	//重启后从持久化存储恢复等待数据
+	restarted := NewWalletManager(nil)
+	restarted.Config.ScanMode = ScanModeHybrid
+	restarted.Blockscanner.SetBlockchainDAI(dai)
+	observer := newTestFinalizedObserver()
+	restarted.Blockscanner.AddObserver(observer)
+	restarted.Blockscanner.notifyFinalizedData(10)
+
+	extracted := observer.finalized["account_alice"]
+	if len(extracted) != 1 || extracted[0].Transaction.TxID != "tx1" {
+		t.Fatalf("alice finalized size = %d, want tx1", len(extracted))
+	}
+
+	//已确认的高度也被持久化，再次重启后重扫不再通知
+	again := NewWalletManager(nil)
+	again.Config.ScanMode = ScanModeHybrid
+	again.Blockscanner.SetBlockchainDAI(dai)
+	again.Blockscanner.AddObserver(observer)
+	again.Blockscanner.addFinalizingData(10, "hash10", "tx1", map[string][]*openwallet.TxExtractData{
+		"account_alice": {{Transaction: &openwallet.Transaction{TxID: "tx1", BlockHeight: 10}}},
+	})
+	again.Blockscanner.notifyFinalizedData(10)
+	if len(observer.finalized["account_alice"]) != 1 {
+		t.Errorf("finalized block notified again after restart")
+	}
+	if keys, _ := dai.Keys(finalizingBucket); len(keys) != 0 {
+		t.Errorf("finalizing blocks = %v, want none", keys)
+	}
+}
+
+func TestWalletManager_LoadAssetsConfigScanMode(t *testing.T) {
+	for _, mode := range []string{ScanModeHead, ScanModeIrreversible, ScanModeHybrid} {
+		wm := NewWalletManager(nil)
+		c, _ := config.NewConfigData("ini", []byte("scanMode = "+mode+"\ndataDir = "+t.TempDir()))
+		if err := wm.LoadAssetsConfig(c); err != nil || wm.Config.ScanMode != mode {
+			t.Errorf("load scanMode %s failed: %v", mode, err)
+		}
+	}
+
+	wm := NewWalletManager(nil)
+	c, _ := config.NewConfigData("ini", []byte("scanMode = final"))
+	if err := wm.LoadAssetsConfig(c); err == nil {
+		t.Errorf("unknown scanMode should fail")
+	}
+}
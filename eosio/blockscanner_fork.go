@@ -0,0 +1,155 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"fmt"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+// ReversalObserver 可选的观测者接口，已通知的交易所在区块分叉后接收撤销通知。
+// 没有实现该接口的观测者，通过BlockExtractDataNotify接收状态为失败并带有reversed扩展参数的通知
+type ReversalObserver interface {
+	BlockExtractDataReversalNotify(sourceKey string, data *openwallet.TxExtractData) error
+}
+
+// Reorganize 本地区块与节点分叉时，从本地高度向前查找共同祖先，回滚之后的所有本地区块
+func (bs *EOSBlockScanner) Reorganize(localHeight uint32, localHash string) (uint32, string, error) {
+
+	ancestorHeight, ancestorHash, err := bs.FindCommonAncestor(localHeight, localHash)
+	if err != nil {
+		return 0, "", err
+	}
+
+	bs.wm.Log.Std.Info("block scanner found common ancestor on height: %d, hash: %s, orphaned blocks: %d", ancestorHeight, ancestorHash, localHeight-ancestorHeight)
+
+	bs.rollbackBlocks(ancestorHeight, localHeight, localHash)
+
+	//重新记录一个新扫描起点
+	bs.SaveLocalBlockHead(ancestorHeight, ancestorHash)
+
+	return ancestorHeight, ancestorHash, nil
+}
+
+// FindCommonAncestor 从本地高度向前比较本地区块与节点区块的hash，返回共同祖先的高度和hash，
+// 跳过没有本地记录的区块，不可逆区块没有本地记录时返回错误
+func (bs *EOSBlockScanner) FindCommonAncestor(localHeight uint32, localHash string) (uint32, string, error) {
+
+	infoResp, err := bs.GetChainInfo()
+	if err != nil {
+		return 0, "", err
+	}
+
+	hash := localHash
+	for height := localHeight; height > 0; height-- {
+
+		if height != localHeight {
+			localBlock, err := bs.GetLocalBlock(height)
+			if err != nil || len(localBlock.Hash) == 0 {
+				//不可逆区块没有本地记录，无法确认共同祖先，停止扫描由人工处理
+				if height <= infoResp.LastIrreversibleBlockNum {
+					return 0, "", fmt.Errorf("block height: %d is irreversible (last irreversible: %d) but not found in local, can not find common ancestor",
+						height, infoResp.LastIrreversibleBlockNum)
+				}
+				//本地没有记录，继续向前查找有记录的区块
+				bs.wm.Log.Std.Info("block height: %d not found in local, skip", height)
+				continue
+			}
+			hash = localBlock.Hash
+		}
+
+		block, err := bs.getBlockByNum(height)
+		if err != nil {
+			return 0, "", err
+		}
+
+		if block.ID.String() == hash {
+			return height, hash, nil
+		}
+
+		bs.wm.Log.Std.Info("block height: %d local hash = %s mainnet hash = %s ", height, hash, block.ID.String())
+
+		//不可逆区块不会分叉，本地记录与节点不一致说明本地数据或节点异常，停止扫描由人工处理
+		if height <= infoResp.LastIrreversibleBlockNum {
+			return 0, "", fmt.Errorf("block height: %d is irreversible (last irreversible: %d) but local hash %s does not match node hash %s, please check the node and local data",
+				height, infoResp.LastIrreversibleBlockNum, hash, block.ID.String())
+		}
+	}
+
+	return 0, "", fmt.Errorf("can not find common ancestor below height: %d", localHeight)
+}
+
+//rollbackBlocks 通知(ancestorHeight, localHeight]区间的分叉区块，并撤销已通知的交易
+func (bs *EOSBlockScanner) rollbackBlocks(ancestorHeight, localHeight uint32, localHash string) {
+
+	for height := localHeight; height > ancestorHeight; height-- {
+
+		bs.wm.Log.Std.Info("delete recharge records on block height: %d.", height)
+
+		// get local fork bolck
+		forkBlock, err := bs.GetLocalBlock(height)
+		if err != nil && height == localHeight {
+			forkBlock = &Block{BlockHeader: openwallet.BlockHeader{Hash: localHash, Height: uint64(height), Symbol: bs.wm.Symbol()}, Height: height}
+		}
+
+		// delete unscan block
+		bs.DeleteUnscanRecord(height)
+
+		//撤销该区块已通知的交易
+		if reverted := bs.removeFinalizingData(uint64(height)); reverted != nil {
+			bs.reversalDataNotify(reverted)
+		}
+
+		if forkBlock != nil {
+			//通知分叉区块给观测者，异步处理
+			bs.forkBlockNotify(forkBlock)
+		}
+	}
+}
+
+//reversalDataNotify 发送分叉撤销通知，失败的通知加入重试队列
+func (bs *EOSBlockScanner) reversalDataNotify(block *finalizingBlock) {
+	ordered := block.ordered()
+	for _, o := range bs.observers() {
+		for _, item := range ordered {
+			entry := &NotifyOutboxEntry{
+				Kind:        notifyKindReversal,
+				SourceKey:   item.sourceKey,
+				Sid:         blockNotifySid(notifyKindReversal, block.Hash, item.data),
+				ExtractData: item.data,
+			}
+			if !bs.deliver(o, block.Height, entry) {
+				bs.wm.Log.Std.Error("block height: %d, reversal notification of txid: %s is not delivered and can not be retried", block.Height, item.data.Transaction.TxID)
+			}
+			//交易在新的分叉上再次出现时重新通知
+			bs.forgetDelivered(o, item.sourceKey, item.data)
+		}
+	}
+}
+
+//reversedExtractData 复制提取数据，交易单标记为失败并设置reversed扩展参数
+func reversedExtractData(data *openwallet.TxExtractData) *openwallet.TxExtractData {
+	tx := *data.Transaction
+	tx.Status = "0"
+	tx.Reason = "block has been forked"
+	tx.SetExtParam("reversed", true)
+	return &openwallet.TxExtractData{
+		TxInputs:    data.TxInputs,
+		TxOutputs:   data.TxOutputs,
+		Transaction: &tx,
+	}
+}
@@ -0,0 +1,278 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
+)
+
+//testReversalObserver 记录分叉撤销通知的观测者
+type testReversalObserver struct {
+	*testObserver
+	reversed map[string][]*openwallet.TxExtractData
+}
+
+func (o *testReversalObserver) BlockExtractDataReversalNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.reversed[sourceKey] = append(o.reversed[sourceKey], data)
+	return nil
+}
+
+func TestEOSBlockScanner_Reorganize(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	//主链A：区块102和103各有一笔给alice的转账
+	chainA := node.addChain(100, 104, 0, testBlockID(99, 0), map[uint32]*eos.PackedTransaction{
+		102: testPackedTransaction(2, testTransferAction("eosio.token", "bob", "alice", "2.0000 EOS", "102")),
+		103: testPackedTransaction(3, testTransferAction("eosio.token", "bob", "alice", "3.0000 EOS", "103")),
+	})
+	node.info.HeadBlockNum = 104
+	node.info.LastIrreversibleBlockNum = 100
+
+	wm := testNewMockWalletManager(node)
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	bs.ScanTargetFunc = testScanTargetFunc(map[string]string{"alice": "account_alice"})
+	bs.RescanLastBlockCount = 0
+	bs.Scanning = true
+	bs.SaveLocalBlockHead(100, chainA[100].ID.String())
+
+	observer := &testReversalObserver{testObserver: newTestObserver(), reversed: make(map[string][]*openwallet.TxExtractData)}
+	plain := newTestObserver()
+	bs.AddObserver(observer)
+	bs.AddObserver(plain)
+	bs.ScanBlockTask()
+
+	if len(observer.extractData("account_alice")) != 2 {
+		t.Fatalf("alice extract data size = %d, want 2", len(observer.extractData("account_alice")))
+	}
+
+	//节点切换到从区块101分叉的链B，区块102~104被孤立
+	chainB := node.addChain(102, 106, 1, chainA[101].ID, map[uint32]*eos.PackedTransaction{
+		105: testPackedTransaction(5, testTransferAction("eosio.token", "bob", "alice", "5.0000 EOS", "105")),
+	})
+	node.info.HeadBlockNum = 106
+	bs.ScanBlockTask()
+
+	height, hash, _ := bs.GetLocalBlockHead()
+	if height != 106 || hash != chainB[106].ID.String() {
+		t.Errorf("local block head = %d %s, want chain B 106", height, hash)
+	}
+
+	reversed := observer.reversed["account_alice"]
+	if len(reversed) != 2 || reversed[0].Transaction.BlockHeight != 103 || reversed[1].Transaction.BlockHeight != 102 {
+		t.Fatalf("alice reversed size = %d, want blocks 103 and 102", len(reversed))
+	}
+
+	extracted := observer.extractData("account_alice")
+	if len(extracted) != 3 || extracted[2].Transaction.BlockHash != chainB[105].ID.String() {
+		t.Fatalf("alice extract data size = %d, want chain B 105 extracted", len(extracted))
+	}
+
+	//未实现ReversalObserver的观测者收到失败状态的通知
+	plainData := plain.extractData("account_alice")
+	if len(plainData) != 5 {
+		t.Fatalf("plain observer data size = %d, want 5", len(plainData))
+	}
+	if plainData[2].Transaction.Status != "0" || !plainData[2].Transaction.GetExtParam().Get("reversed").Bool() {
+		t.Errorf("unexpected reversal transaction: %+v", plainData[2].Transaction)
+	}
+
+	//每个孤立区块都通知分叉
+	forked := func() map[uint64]bool {
+		forks := make(map[uint64]bool)
+		for _, header := range observer.blockHeaders() {
+			if header.Fork {
+				forks[header.Height] = true
+			}
+		}
+		return forks
+	}
+	if !testWaitFor(func() bool { return len(forked()) == 3 }) {
+		t.Errorf("fork block notified = %v, want 102~104", forked())
+	}
+}
+
+func TestEOSBlockScanner_ReorganizeIrreversibleMismatch(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	chainA := node.addChain(100, 104, 0, testBlockID(99, 0), map[uint32]*eos.PackedTransaction{
+		102: testPackedTransaction(2, testTransferAction("eosio.token", "bob", "alice", "2.0000 EOS", "102")),
+	})
+	node.info.HeadBlockNum = 104
+	node.info.LastIrreversibleBlockNum = 100
+
+	wm := testNewMockWalletManager(node)
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	bs.ScanTargetFunc = testScanTargetFunc(map[string]string{"alice": "account_alice"})
+	bs.RescanLastBlockCount = 0
+	bs.Scanning = true
+	bs.SaveLocalBlockHead(100, chainA[100].ID.String())
+
+	observer := &testReversalObserver{testObserver: newTestObserver(), reversed: make(map[string][]*openwallet.TxExtractData)}
+	bs.AddObserver(observer)
+	bs.ScanBlockTask()
+
+	//节点返回从区块100分叉的链，分叉点已低于不可逆高度
+	node.addChain(101, 105, 1, chainA[100].ID, nil)
+	node.info.HeadBlockNum = 105
+	node.info.LastIrreversibleBlockNum = 102
+
+	if _, _, err := bs.Reorganize(104, chainA[104].ID.String()); err == nil {
+		t.Fatalf("mismatch below last irreversible block should fail")
+	}
+
+	height, hash, _ := bs.GetLocalBlockHead()
+	if height != 104 || hash != chainA[104].ID.String() {
+		t.Errorf("local block head = %d %s, should not be rolled back", height, hash)
+	}
+	if len(observer.reversed["account_alice"]) != 0 {
+		t.Errorf("irreversible transfer should not be reversed")
+	}
+}
+
+func TestEOSBlockScanner_ReversalAfterRestart(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	chainA := node.addChain(100, 104, 0, testBlockID(99, 0), map[uint32]*eos.PackedTransaction{
+		103: testPackedTransaction(3, testTransferAction("eosio.token", "bob", "alice", "3.0000 EOS", "103")),
+	})
+	node.info.HeadBlockNum = 104
+	node.info.LastIrreversibleBlockNum = 100
+
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+
+	wm := testNewMockWalletManager(node)
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	bs.ScanTargetFunc = testScanTargetFunc(map[string]string{"alice": "account_alice"})
+	bs.RescanLastBlockCount = 0
+	bs.Scanning = true
+	bs.SaveLocalBlockHead(100, chainA[100].ID.String())
+	bs.AddObserver(newTestObserver())
+	bs.ScanBlockTask()
+
+	//重启后节点切换到从区块102分叉的链，区块103的转账仍能撤销
+	restarted := testNewMockWalletManager(node).Blockscanner
+	restarted.SetBlockchainDAI(dai)
+	restarted.ScanTargetFunc = bs.ScanTargetFunc
+	restarted.RescanLastBlockCount = 0
+	restarted.Scanning = true
+	observer := &testReversalObserver{testObserver: newTestObserver(), reversed: make(map[string][]*openwallet.TxExtractData)}
+	restarted.AddObserver(observer)
+
+	node.addChain(103, 105, 1, chainA[102].ID, nil)
+	node.info.HeadBlockNum = 105
+	restarted.ScanBlockTask()
+
+	reversed := observer.reversed["account_alice"]
+	if len(reversed) != 1 || reversed[0].Transaction.BlockHeight != 103 {
+		t.Fatalf("alice reversed size = %d, want block 103", len(reversed))
+	}
+}
+
+func TestEOSBlockScanner_FindCommonAncestorMissingLocal(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	chainA := node.addChain(100, 104, 0, testBlockID(99, 0), nil)
+	node.addChain(102, 105, 1, chainA[101].ID, nil)
+	node.info.HeadBlockNum = 105
+	node.info.LastIrreversibleBlockNum = 100
+
+	wm := testNewMockWalletManager(node)
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	saveLocal := func(height uint32) {
+		bs.SaveLocalBlock(&Block{BlockHeader: openwallet.BlockHeader{Hash: chainA[height].ID.String(), Height: uint64(height), Symbol: wm.Symbol()}, Height: height})
+	}
+	saveLocal(101)
+	saveLocal(104)
+
+	//区块102和103没有本地记录，继续向前比较到区块101
+	height, hash, err := bs.FindCommonAncestor(104, chainA[104].ID.String())
+	if err != nil || height != 101 || hash != chainA[101].ID.String() {
+		t.Fatalf("common ancestor = %d %s, err = %v, want 101", height, hash, err)
+	}
+
+	//不可逆区块没有本地记录时无法确认共同祖先
+	node.info.LastIrreversibleBlockNum = 102
+	if _, _, err := bs.FindCommonAncestor(104, chainA[104].ID.String()); err == nil {
+		t.Errorf("missing irreversible local block should fail")
+	}
+}
+
+//failingReversalObserver 撤销通知先失败fail次
+type failingReversalObserver struct {
+	*testReversalObserver
+	fail int
+}
+
+func (o *failingReversalObserver) BlockExtractDataReversalNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	if o.fail > 0 {
+		o.fail--
+		return fmt.Errorf("observer is unavailable")
+	}
+	return o.testReversalObserver.BlockExtractDataReversalNotify(sourceKey, data)
+}
+
+func TestEOSBlockScanner_ReversalRetry(t *testing.T) {
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+
+	wm := NewWalletManager(nil)
+	wm.Config.NotifyRetryBackoff = 0
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	observer := &failingReversalObserver{testReversalObserver: &testReversalObserver{testObserver: newTestObserver(), reversed: make(map[string][]*openwallet.TxExtractData)}, fail: 1}
+	bs.AddObserver(observer)
+
+	bs.reversalDataNotify(&finalizingBlock{Height: 10, Hash: "hash10", ExtractData: map[string]map[string][]*openwallet.TxExtractData{
+		"tx1": {"account_alice": {{
+			TxOutputs:   []*openwallet.TxOutPut{{Recharge: openwallet.Recharge{Sid: "tx1_0"}}},
+			Transaction: &openwallet.Transaction{TxID: "tx1", BlockHeight: 10},
+		}}},
+	}})
+
+	//失败的撤销通知进入重试队列，重试时仍通过BlockExtractDataReversalNotify
+	pending, _ := bs.GetFailedNotifications()
+	if len(pending) != 1 || pending[0].Kind != notifyKindReversal || pending[0].Sid != "reversal:hash10:tx1_0" {
+		t.Fatalf("unexpected failed notifications: %+v", pending)
+	}
+	bs.RetryFailedNotifications()
+	if len(observer.reversed["account_alice"]) != 1 || len(observer.extractData("account_alice")) != 0 {
+		t.Errorf("failed reversal notification is not redelivered")
+	}
+	if pending, _ := bs.GetFailedNotifications(); len(pending) != 0 {
+		t.Errorf("failed notifications size = %d, want 0", len(pending))
+	}
+}
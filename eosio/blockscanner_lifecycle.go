@@ -0,0 +1,136 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"context"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const (
+	//节点请求失败后的默认最大重试次数
+	defaultNodeMaxRetries = 5
+	//节点请求失败后的默认重试间隔
+	defaultNodeRetryBackoff = time.Second
+	//节点请求失败后的最大重试间隔
+	maxNodeRetryBackoff = time.Minute
+)
+
+//context 扫描任务的上下文，停止、暂停或关闭扫描器时取消，运行扫描任务前没有启动时自动创建
+func (bs *EOSBlockScanner) context() context.Context {
+	bs.ctxLock.Lock()
+	defer bs.ctxLock.Unlock()
+	if bs.ctx == nil {
+		bs.ctx, bs.cancel = context.WithCancel(context.Background())
+	}
+	return bs.ctx
+}
+
+//resetContext 上下文已取消时重新创建，正在运行的扫描任务不受影响
+func (bs *EOSBlockScanner) resetContext() {
+	bs.ctxLock.Lock()
+	defer bs.ctxLock.Unlock()
+	if bs.ctx == nil || bs.ctx.Err() != nil {
+		bs.ctx, bs.cancel = context.WithCancel(context.Background())
+	}
+}
+
+//cancelContext 取消正在运行的扫描任务
+func (bs *EOSBlockScanner) cancelContext() {
+	bs.ctxLock.Lock()
+	defer bs.ctxLock.Unlock()
+	if bs.cancel != nil {
+		bs.cancel()
+	}
+}
+
+// Run 开始扫描
+func (bs *EOSBlockScanner) Run() error {
+	bs.resetContext()
+	return bs.BlockScannerBase.Run()
+}
+
+// Stop 停止扫描，正在运行的扫描任务在当前区块处理完后退出
+func (bs *EOSBlockScanner) Stop() error {
+	bs.cancelContext()
+	return bs.BlockScannerBase.Stop()
+}
+
+// Pause 暂停扫描
+func (bs *EOSBlockScanner) Pause() error {
+	bs.cancelContext()
+	return bs.BlockScannerBase.Pause()
+}
+
+// Restart 继续扫描
+func (bs *EOSBlockScanner) Restart() error {
+	bs.resetContext()
+	return bs.BlockScannerBase.Restart()
+}
+
+// CloseBlockScanner 关闭扫描器
+func (bs *EOSBlockScanner) CloseBlockScanner() error {
+	bs.cancelContext()
+	return bs.BlockScannerBase.CloseBlockScanner()
+}
+
+//nodeRetryBackoff 第retries次失败后的重试间隔，没有设置间隔时使用默认间隔，避免不等待立即重试
+func (bs *EOSBlockScanner) nodeRetryBackoff(retries uint32) time.Duration {
+	backoff := bs.wm.Config.NodeRetryBackoff
+	if backoff <= 0 {
+		backoff = defaultNodeRetryBackoff
+	}
+	for i := uint32(1); i < retries && backoff < maxNodeRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxNodeRetryBackoff {
+		backoff = maxNodeRetryBackoff
+	}
+	return backoff
+}
+
+//waitRetry 节点请求失败后等待重试，超过最大重试次数或扫描停止时返回false
+func (bs *EOSBlockScanner) waitRetry(ctx context.Context, retries *uint32) bool {
+
+	*retries++
+	if max := bs.wm.Config.NodeMaxRetries; max > 0 && *retries > max {
+		bs.wm.Log.Std.Error("block scanner gave up after %d retries", max)
+		return false
+	}
+
+	backoff := bs.nodeRetryBackoff(*retries)
+	bs.wm.Log.Std.Info("block scanner will retry in %v ...", backoff)
+
+	select {
+	case <-time.After(backoff):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+//observers 观测者快照，避免通知时与添加或移除观测者竞争
+func (bs *EOSBlockScanner) observers() []openwallet.BlockScanNotificationObject {
+	bs.Mu.RLock()
+	defer bs.Mu.RUnlock()
+	observers := make([]openwallet.BlockScanNotificationObject, 0, len(bs.Observers))
+	for o := range bs.Observers {
+		observers = append(observers, o)
+	}
+	return observers
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"testing"
+	"time"
+
+	"github.com/astaxie/beego/config"
+	"github.com/eoscanada/eos-go"
+)
+
+func TestEOSBlockScanner_LifecycleNodeRetry(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	blocks := node.addChain(100, 110, 0, testBlockID(99, 0), map[uint32]*eos.PackedTransaction{
+		105: testPackedTransaction(1, testTransferAction("eosio.token", "bob", "alice", "1.0000 EOS", "")),
+	})
+	node.info.HeadBlockNum = 110
+
+	wm := testNewMockWalletManager(node)
+	wm.Config.NodeRetryBackoff = time.Millisecond
+	wm.Config.NodeMaxRetries = 3
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	bs.ScanTargetFunc = testScanTargetFunc(map[string]string{"alice": "account_alice"})
+	bs.SaveLocalBlockHead(100, blocks[100].ID.String())
+	observer := newTestObserver()
+	bs.AddObserver(observer)
+
+	//节点短暂不可用时退避重试，不放弃本轮扫描
+	node.fail("/v1/chain/get_info", 2)
+	bs.ScanBlockTask()
+	if height, _, _ := bs.GetLocalBlockHead(); height != 110 {
+		t.Fatalf("local block head = %d, want 110", height)
+	}
+	if len(observer.extractData("account_alice")) != 1 {
+		t.Errorf("alice extract data size = %d, want 1", len(observer.extractData("account_alice")))
+	}
+
+	//超过最大重试次数后结束本轮扫描
+	node.addChain(111, 112, 0, blocks[110].ID, nil)
+	node.mu.Lock()
+	node.info.HeadBlockNum = 112
+	node.mu.Unlock()
+	node.fail("/v1/chain/get_info", 10)
+	calls := node.callCount("/v1/chain/get_info")
+	bs.ScanBlockTask()
+	if got := node.callCount("/v1/chain/get_info") - calls; got != 4 {
+		t.Errorf("get_info calls = %d, want 4", got)
+	}
+	if height, _, _ := bs.GetLocalBlockHead(); height != 110 {
+		t.Errorf("local block head = %d, want 110", height)
+	}
+}
+
+func TestEOSBlockScanner_LifecycleStop(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+	node.delay = 10 * time.Millisecond
+
+	blocks := node.addChain(100, 400, 0, testBlockID(99, 0), nil)
+	node.info.HeadBlockNum = 400
+
+	wm := testNewMockWalletManager(node)
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	bs.ScanTargetFunc = testScanTargetFunc(map[string]string{})
+	bs.RescanLastBlockCount = 0
+	bs.SaveLocalBlockHead(100, blocks[100].ID.String())
+
+	done := make(chan struct{})
+	go func() {
+		bs.ScanBlockTask()
+		close(done)
+	}()
+
+	//停止扫描后正在运行的任务尽快退出
+	time.Sleep(50 * time.Millisecond)
+	bs.Stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan task is not cancelled")
+	}
+
+	stopped, _, _ := bs.GetLocalBlockHead()
+	if stopped >= 400 {
+		t.Fatalf("local block head = %d, scan should be stopped", stopped)
+	}
+
+	//重新开始扫描时从停止的位置继续
+	bs.resetContext()
+	bs.ScanBlockTask()
+	if height, _, _ := bs.GetLocalBlockHead(); height != 400 {
+		t.Errorf("local block head = %d, want 400", height)
+	}
+}
+
+func TestWalletManager_LoadAssetsConfigNodeRetryBackoff(t *testing.T) {
+	wm := NewWalletManager(nil)
+	c, _ := config.NewConfigData("ini", []byte("nodeRetryBackoff = 0"))
+	if err := wm.LoadAssetsConfig(c); err == nil {
+		t.Errorf("zero nodeRetryBackoff should fail")
+	}
+
+	//直接设置为0时使用默认间隔
+	wm = NewWalletManager(nil)
+	wm.Config.NodeRetryBackoff = 0
+	if backoff := wm.Blockscanner.nodeRetryBackoff(2); backoff != 2*defaultNodeRetryBackoff {
+		t.Errorf("node retry backoff = %v, want %v", backoff, 2*defaultNodeRetryBackoff)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+// MemoResolverFunc 按充值账户和备注查找源标识
+// @return 备注地址，源标识，是否存在
+type MemoResolverFunc func(account, memo string) (address string, sourceKey string, exist bool)
+
+// NewDepositMemo 生成资产账户的唯一充值备注
+func NewDepositMemo(accountID string, index uint64) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s_%d", accountID, index)))
+	return hex.EncodeToString(hash[:8])
+}
+
+//isMemoDepositAccount 是否为按备注区分用户的充值账户
+func (bs *EOSBlockScanner) isMemoDepositAccount(account string) bool {
+	return len(bs.wm.Config.MemoDepositAccount) > 0 && bs.wm.Config.MemoDepositAccount == account
+}
+
+//resolveReceiver 查找接收者的源标识，接收者为充值账户时先按备注查找，找不到再按账户查找
+func (bs *EOSBlockScanner) resolveReceiver(transfer *TransferAction, scanTargetFunc openwallet.BlockScanTargetFunc) (string, bool) {
+
+	to := transfer.To
+
+	if bs.isMemoDepositAccount(to) {
+		memo := strings.TrimSpace(transfer.Memo)
+		if len(memo) > 0 {
+			resolver := bs.MemoResolver
+			if resolver == nil {
+				//默认以备注作为地址查找
+				resolver = func(account, memo string) (string, string, bool) {
+					sourceKey, ok := scanTargetFunc(openwallet.ScanTarget{Address: memo, Symbol: bs.wm.Symbol(), BalanceModelType: openwallet.BalanceModelTypeAddress})
+					return memo, sourceKey, ok
+				}
+			}
+
+			if address, sourceKey, ok := resolver(to, memo); ok {
+				transfer.MemoAddress = address
+				return sourceKey, true
+			}
+		}
+	}
+
+	return scanTargetFunc(openwallet.ScanTarget{Alias: to, Symbol: bs.wm.Symbol(), BalanceModelType: openwallet.BalanceModelTypeAccount})
+}
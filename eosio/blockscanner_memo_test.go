@@ -0,0 +1,125 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+func TestEOSBlockScanner_ExtractMemoDeposit(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	wm := testNewMockWalletManager(node)
+	wm.Config.MemoDepositAccount = "exchangehot1"
+	bs := wm.Blockscanner
+
+	memo := NewDepositMemo("account_alice", 1)
+
+	//备注地址和热钱包账户都登记为扫描对象
+	scanTargetFunc := func(target openwallet.ScanTarget) (string, bool) {
+		switch {
+		case target.Address == memo:
+			return "account_alice", true
+		case target.Alias == "exchangehot1":
+			return "account_hot", true
+		}
+		return "", false
+	}
+
+	packed := testPackedTransaction(1,
+		testTransferAction("eosio.token", "bob", "exchangehot1", "1.0000 EOS", " "+memo+" "),
+		testTransferAction("eosio.token", "bob", "exchangehot1", "2.0000 EOS", "unknown"),
+	)
+	block := testBlock(100, 0, testBlockID(99, 0), packed)
+
+	result := bs.ExtractTransaction(100, block.ID.String(), block.Timestamp.Unix(), block.Transactions[0], scanTargetFunc)
+
+	alice := result.extractData["account_alice"]
+	if len(alice) != 1 {
+		t.Fatalf("alice extract data size = %d, want 1", len(alice))
+	}
+	if alice[0].TxOutputs[0].Address != memo {
+		t.Errorf("alice output address = %s, want %s", alice[0].TxOutputs[0].Address, memo)
+	}
+	if alice[0].Transaction.GetExtParam().Get("memoAddress").String() != memo {
+		t.Errorf("memoAddress ext param is not set")
+	}
+
+	//未知备注按热钱包账户入账
+	hot := result.extractData["account_hot"]
+	if len(hot) != 1 || hot[0].TxOutputs[0].Address != "exchangehot1" {
+		t.Fatalf("unknown memo should fallback to deposit account")
+	}
+	if hot[0].Transaction.GetExtParam().Get("memoAddress").Exists() {
+		t.Errorf("memoAddress ext param should not be set")
+	}
+}
+
+func TestEOSBlockScanner_MemoResolver(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	wm := testNewMockWalletManager(node)
+	wm.Config.MemoDepositAccount = "exchangehot1"
+	bs := wm.Blockscanner
+	bs.MemoResolver = func(account, memo string) (string, string, bool) {
+		if account == "exchangehot1" && memo == "uid:1001" {
+			return "1001", "account_1001", true
+		}
+		return "", "", false
+	}
+
+	packed := testPackedTransaction(1, testTransferAction("eosio.token", "bob", "exchangehot1", "1.0000 EOS", "uid:1001"))
+	block := testBlock(100, 0, testBlockID(99, 0), packed)
+
+	result := bs.ExtractTransaction(100, block.ID.String(), block.Timestamp.Unix(), block.Transactions[0], testScanTargetFunc(nil))
+	data := result.extractData["account_1001"]
+	if len(data) != 1 || data[0].TxOutputs[0].Address != "1001" {
+		t.Fatalf("custom memo resolver is not used")
+	}
+}
+
+func TestAddressDecoder_CustomCreateAddress(t *testing.T) {
+	wm := NewWalletManager(nil)
+	decoder := wm.Decoder.(*addressDecoder)
+	account := &openwallet.AssetsAccount{AccountID: "account_alice"}
+
+	if decoder.SupportCustomCreateAddressFunction() {
+		t.Fatalf("custom create address should be disabled without deposit account")
+	}
+	if _, err := decoder.CustomCreateAddress(account, 0); err == nil {
+		t.Fatalf("create address without deposit account should fail")
+	}
+
+	wm.Config.MemoDepositAccount = "exchangehot1"
+	memos := make(map[string]bool)
+	for i := uint64(0); i < 100; i++ {
+		address, err := decoder.CustomCreateAddress(account, i)
+		if err != nil {
+			t.Fatalf("create address failed: %v", err)
+		}
+		if !address.IsMemo || address.Alias != "exchangehot1" || address.Memo != address.Address {
+			t.Fatalf("unexpected memo address: %+v", address)
+		}
+		memos[address.Address] = true
+	}
+	if len(memos) != 100 {
+		t.Errorf("memo size = %d, want 100 unique memos", len(memos))
+	}
+}
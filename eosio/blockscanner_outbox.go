@@ -0,0 +1,306 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+const (
+	//等待重试的通知
+	notifyOutboxBucket = "notify_outbox"
+	//超过最大投递次数的通知
+	notifyDeadLetterBucket = "notify_dead_letter"
+	//默认最大投递次数
+	defaultNotifyMaxAttempts = 10
+	//默认重试间隔
+	defaultNotifyRetryBackoff = 10 * time.Second
+	//最大重试间隔
+	maxNotifyRetryBackoff = time.Hour
+	//不可逆确认通知
+	notifyKindFinalized = "finalized"
+	//分叉撤销通知
+	notifyKindReversal = "reversal"
+)
+
+// IdentifiedObserver 观测者可以提供自己的标识，用于通知去重和重启后找回失败通知的接收者，
+// 没有实现时以币种和观测者类型名为标识，同一类型的多个观测者需要实现它来区分
+type IdentifiedObserver interface {
+	ObserverID() string
+}
+
+//observerID 观测者标识，默认为币种和观测者类型名，重启后不变
+func (bs *EOSBlockScanner) observerID(o openwallet.BlockScanNotificationObject) string {
+	if identified, ok := o.(IdentifiedObserver); ok {
+		return identified.ObserverID()
+	}
+	return fmt.Sprintf("%s:%T", bs.wm.Symbol(), o)
+}
+
+// NotifyOutboxEntry 投递失败的通知，按(观测者, sourceKey, Sid)记录，只重试该条通知。
+// 失败不阻塞之后区块的通知，重试送达时可能晚于更高区块的通知，观测者不能依赖失败后的通知顺序
+type NotifyOutboxEntry struct {
+	Key             string
+	Observer        string
+	Kind            string `json:",omitempty"` //通知类型，空为交易通知，finalized为确认通知，reversal为撤销通知
+	SourceKey       string
+	Sid             string
+	BlockHeight     uint64
+	ExtractData     *openwallet.TxExtractData        `json:",omitempty"`
+	ContractReceipt *openwallet.SmartContractReceipt `json:",omitempty"`
+	Attempts        uint32
+	NextRetryAt     time.Time
+	LastError       string
+	CreatedAt       int64
+}
+
+//notify 按通知类型投递通知
+func (entry *NotifyOutboxEntry) notify(o openwallet.BlockScanNotificationObject) error {
+	if entry.ContractReceipt != nil {
+		return o.BlockExtractSmartContractDataNotify(entry.SourceKey, entry.ContractReceipt)
+	}
+	switch entry.Kind {
+	case notifyKindFinalized:
+		if fo, ok := o.(FinalizedObserver); ok {
+			return fo.BlockExtractDataFinalizedNotify(entry.SourceKey, entry.ExtractData)
+		}
+		return nil
+	case notifyKindReversal:
+		if ro, ok := o.(ReversalObserver); ok {
+			return ro.BlockExtractDataReversalNotify(entry.SourceKey, entry.ExtractData)
+		}
+		return o.BlockExtractDataNotify(entry.SourceKey, reversedExtractData(entry.ExtractData))
+	}
+	return o.BlockExtractDataNotify(entry.SourceKey, entry.ExtractData)
+}
+
+//extractDataSid 通知的唯一标识，取第一个输出或输入的Sid
+func extractDataSid(data *openwallet.TxExtractData) string {
+	for _, output := range data.TxOutputs {
+		if len(output.Sid) > 0 {
+			return output.Sid
+		}
+	}
+	for _, input := range data.TxInputs {
+		if len(input.Sid) > 0 {
+			return input.Sid
+		}
+	}
+	if data.Transaction != nil {
+		return data.Transaction.WxID
+	}
+	return ""
+}
+
+//blockNotifySid 确认和撤销通知的Sid，加上通知类型和区块hash前缀，与交易通知分开去重
+func blockNotifySid(kind, blockHash string, data *openwallet.TxExtractData) string {
+	sid := extractDataSid(data)
+	if len(sid) == 0 {
+		return ""
+	}
+	return kind + ":" + blockHash + ":" + sid
+}
+
+//notifyRetryBackoff 第attempts次失败后的重试间隔
+func (bs *EOSBlockScanner) notifyRetryBackoff(attempts uint32) time.Duration {
+	backoff := bs.wm.Config.NotifyRetryBackoff
+	for i := uint32(1); i < attempts && backoff < maxNotifyRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxNotifyRetryBackoff {
+		backoff = maxNotifyRetryBackoff
+	}
+	return backoff
+}
+
+//notifyFailed 把投递失败的通知加入重试队列。没有持久化存储时，交易通知记录未扫区块重扫整个区块，
+//确认和撤销通知返回false，由调用者保留
+func (bs *EOSBlockScanner) notifyFailed(o openwallet.BlockScanNotificationObject, height uint64, entry *NotifyOutboxEntry, notifyErr error) bool {
+
+	store := bs.stateStore()
+	if store != nil {
+		entry.Observer = bs.observerID(o)
+		entry.Key = bs.notifyKey(o, entry.SourceKey, entry.Sid)
+		entry.BlockHeight = height
+		entry.CreatedAt = time.Now().Unix()
+		err := bs.retryLater(store, entry, notifyErr)
+		if err == nil {
+			return true
+		}
+		bs.wm.Log.Std.Error("block height: %d, save failed notification: %s failed. unexpected error: %v", height, entry.Key, err)
+	}
+
+	if len(entry.Kind) > 0 {
+		return false
+	}
+
+	//记录未扫区块
+	reason := "ExtractData Notify failed."
+	if entry.ContractReceipt != nil {
+		reason = "ExtractContractData Notify failed."
+	}
+	unscanRecord := openwallet.NewUnscanRecord(height, "", reason, bs.wm.Symbol())
+	err := bs.SaveUnscanRecord(unscanRecord)
+	if err != nil {
+		bs.wm.Log.Std.Error("block height: %d, save unscan record failed. unexpected error: %v", height, err.Error())
+		return false
+	}
+	return true
+}
+
+//retryLater 增加投递次数，未超过最大次数时按退避时间等待重试，否则移入死信列表
+func (bs *EOSBlockScanner) retryLater(store KeyValueStore, entry *NotifyOutboxEntry, notifyErr error) error {
+
+	entry.Attempts++
+	entry.LastError = notifyErr.Error()
+
+	if entry.Attempts >= bs.wm.Config.NotifyMaxAttempts {
+		bs.wm.Log.Std.Error("notification: %s failed %d times, moved to dead letter list", entry.Key, entry.Attempts)
+		if err := store.SetValue(notifyDeadLetterBucket, entry.Key, entry); err != nil {
+			return err
+		}
+		return store.DeleteValue(notifyOutboxBucket, entry.Key)
+	}
+
+	entry.NextRetryAt = time.Now().Add(bs.notifyRetryBackoff(entry.Attempts))
+	return store.SetValue(notifyOutboxBucket, entry.Key, entry)
+}
+
+// RetryFailedNotifications 重新投递已到重试时间的失败通知，按区块高度从低到高，观测者未注册时保留等待
+func (bs *EOSBlockScanner) RetryFailedNotifications() {
+
+	store := bs.stateStore()
+	if store == nil {
+		return
+	}
+
+	entries, err := bs.getNotifyEntries(store, notifyOutboxBucket)
+	if err != nil {
+		bs.wm.Log.Std.Error("block scanner can not get failed notifications; unexpected error: %v", err)
+		return
+	}
+
+	observers := make(map[string]openwallet.BlockScanNotificationObject)
+	for _, o := range bs.observers() {
+		observers[bs.observerID(o)] = o
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		o, ok := observers[entry.Observer]
+		if !ok || entry.NextRetryAt.After(now) {
+			continue
+		}
+		bs.retryNotification(store, o, entry)
+	}
+}
+
+//retryNotification 重新投递一条失败通知，与deliver按相同的键串行
+func (bs *EOSBlockScanner) retryNotification(store KeyValueStore, o openwallet.BlockScanNotificationObject, entry *NotifyOutboxEntry) {
+
+	if len(entry.Sid) > 0 {
+		defer bs.deliverLocks.lock(entry.Key)()
+
+		//重扫时已经送达
+		if bs.isDelivered(store, entry.Key) {
+			store.DeleteValue(notifyOutboxBucket, entry.Key)
+			return
+		}
+	}
+
+	if err := entry.notify(o); err != nil {
+		bs.wm.Log.Std.Error("retry notification: %s unexpected error: %v", entry.Key, err)
+		if err := bs.retryLater(store, entry, err); err != nil {
+			bs.wm.Log.Std.Error("save failed notification: %s failed. unexpected error: %v", entry.Key, err)
+		}
+		return
+	}
+
+	if len(entry.Sid) > 0 {
+		bs.markDelivered(store, entry.Key, entry.BlockHeight)
+	}
+	if err := store.DeleteValue(notifyOutboxBucket, entry.Key); err != nil {
+		bs.wm.Log.Std.Error("delete notification: %s failed. unexpected error: %v", entry.Key, err)
+	}
+}
+
+// GetFailedNotifications 等待重试的通知，按区块高度排序
+func (bs *EOSBlockScanner) GetFailedNotifications() ([]*NotifyOutboxEntry, error) {
+	store := bs.stateStore()
+	if store == nil {
+		return nil, fmt.Errorf("notification outbox store is not setup")
+	}
+	return bs.getNotifyEntries(store, notifyOutboxBucket)
+}
+
+// GetDeadLetters 超过最大投递次数的通知，按区块高度排序
+func (bs *EOSBlockScanner) GetDeadLetters() ([]*NotifyOutboxEntry, error) {
+	store := bs.stateStore()
+	if store == nil {
+		return nil, fmt.Errorf("notification outbox store is not setup")
+	}
+	return bs.getNotifyEntries(store, notifyDeadLetterBucket)
+}
+
+// RequeueDeadLetter 把死信重新加入重试队列，投递次数清零
+func (bs *EOSBlockScanner) RequeueDeadLetter(key string) error {
+	store := bs.stateStore()
+	if store == nil {
+		return fmt.Errorf("notification outbox store is not setup")
+	}
+
+	var entry NotifyOutboxEntry
+	if err := store.GetValue(notifyDeadLetterBucket, key, &entry); err != nil {
+		if err == ErrKeyNotFound {
+			return fmt.Errorf("dead letter: %s not found", key)
+		}
+		return err
+	}
+
+	entry.Attempts = 0
+	entry.NextRetryAt = time.Now()
+	if err := store.SetValue(notifyOutboxBucket, key, &entry); err != nil {
+		return err
+	}
+	return store.DeleteValue(notifyDeadLetterBucket, key)
+}
+
+//getNotifyEntries 读取bucket中的所有通知
+func (bs *EOSBlockScanner) getNotifyEntries(store KeyValueStore, bucket string) ([]*NotifyOutboxEntry, error) {
+
+	keys, err := store.Keys(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*NotifyOutboxEntry, 0, len(keys))
+	for _, key := range keys {
+		var entry NotifyOutboxEntry
+		if err := store.GetValue(bucket, key, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].BlockHeight < entries[j].BlockHeight
+	})
+	return entries, nil
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+)
+
+//failingObserver 指定sourceKey的通知先失败若干次
+type failingObserver struct {
+	*testObserver
+	mu   sync.Mutex
+	fail map[string]int
+}
+
+func (o *failingObserver) ObserverID() string {
+	return "wallet"
+}
+
+func (o *failingObserver) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	o.mu.Lock()
+	if o.fail[sourceKey] > 0 {
+		o.fail[sourceKey]--
+		o.mu.Unlock()
+		return fmt.Errorf("observer of %s is unavailable", sourceKey)
+	}
+	o.mu.Unlock()
+	return o.testObserver.BlockExtractDataNotify(sourceKey, data)
+}
+
+func (o *failingObserver) setFail(sourceKey string, times int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.fail[sourceKey] = times
+}
+
+func TestEOSBlockScanner_NotifyOutbox(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	wm := testNewMockWalletManager(node)
+	wm.Config.NotifyRetryBackoff = 0
+	wm.Config.NotifyMaxAttempts = 3
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	observer := &failingObserver{testObserver: newTestObserver(), fail: map[string]int{"account_alice": 2}}
+	bs.AddObserver(observer)
+
+	scanTargetFunc := testScanTargetFunc(map[string]string{"alice": "account_alice", "bob": "account_bob"})
+	block := testBlock(100, 0, testBlockID(99, 0),
+		testPackedTransaction(1, testTransferAction("eosio.token", "carol", "alice", "1.0000 EOS", "")),
+		testPackedTransaction(2, testTransferAction("eosio.token", "carol", "bob", "2.0000 EOS", "")),
+	)
+	for _, tx := range block.Transactions {
+		bs.saveExtractResult(100, bs.ExtractTransaction(100, block.ID.String(), block.Timestamp.Unix(), tx, scanTargetFunc))
+	}
+
+	//只有失败的通知进入重试队列，不记录未扫区块
+	if len(observer.extractData("account_bob")) != 1 || len(observer.extractData("account_alice")) != 0 {
+		t.Fatalf("unexpected delivered notifications")
+	}
+	pending, _ := bs.GetFailedNotifications()
+	if len(pending) != 1 || pending[0].SourceKey != "account_alice" || pending[0].Observer != "wallet" || pending[0].Attempts != 1 {
+		t.Fatalf("unexpected failed notifications: %+v", pending)
+	}
+	if pending[0].Sid != pending[0].ExtractData.TxOutputs[0].Sid || pending[0].BlockHeight != 100 {
+		t.Errorf("unexpected failed notification: %+v", pending[0])
+	}
+	if records, _ := bs.GetUnscanRecords(); len(records) != 0 {
+		t.Errorf("unscan records size = %d, want 0", len(records))
+	}
+
+	//第二次失败后重试成功
+	bs.RetryFailedNotifications()
+	if pending, _ := bs.GetFailedNotifications(); len(pending) != 1 || pending[0].Attempts != 2 {
+		t.Fatalf("unexpected failed notifications after retry: %+v", pending)
+	}
+	bs.RetryFailedNotifications()
+	if pending, _ := bs.GetFailedNotifications(); len(pending) != 0 {
+		t.Fatalf("failed notifications size = %d, want 0", len(pending))
+	}
+	alice := observer.extractData("account_alice")
+	if len(alice) != 1 || alice[0].Transaction.TxID != block.Transactions[0].Transaction.ID.String() {
+		t.Errorf("alice notification is not redelivered")
+	}
+	if len(observer.extractData("account_bob")) != 1 {
+		t.Errorf("bob received duplicate notifications")
+	}
+
+	//未到重试时间时不重试
+	wm.Config.NotifyRetryBackoff = time.Hour
+	observer.setFail("account_bob", 10)
+	next := testBlock(101, 0, block.ID, testPackedTransaction(3, testTransferAction("eosio.token", "carol", "bob", "3.0000 EOS", "")))
+	bs.saveExtractResult(101, bs.ExtractTransaction(101, next.ID.String(), next.Timestamp.Unix(), next.Transactions[0], scanTargetFunc))
+	bs.RetryFailedNotifications()
+	pending, _ = bs.GetFailedNotifications()
+	if len(pending) != 1 || pending[0].Attempts != 1 || pending[0].NextRetryAt.Before(time.Now().Add(50*time.Minute)) {
+		t.Fatalf("unexpected backoff: %+v", pending)
+	}
+
+	//超过最大投递次数移入死信列表
+	wm.Config.NotifyRetryBackoff = 0
+	pending[0].NextRetryAt = time.Now()
+	dai.SetValue(notifyOutboxBucket, pending[0].Key, pending[0])
+	bs.RetryFailedNotifications()
+	bs.RetryFailedNotifications()
+	pending, _ = bs.GetFailedNotifications()
+	dead, _ := bs.GetDeadLetters()
+	if len(pending) != 0 || len(dead) != 1 || dead[0].Attempts != 3 || len(dead[0].LastError) == 0 {
+		t.Fatalf("unexpected dead letters: %+v", dead)
+	}
+
+	observer.setFail("account_bob", 0)
+	if err := bs.RequeueDeadLetter(dead[0].Key); err != nil {
+		t.Fatalf("requeue dead letter failed: %v", err)
+	}
+	bs.RetryFailedNotifications()
+	dead, _ = bs.GetDeadLetters()
+	if len(dead) != 0 || len(observer.extractData("account_bob")) != 2 {
+		t.Errorf("dead letter is not redelivered")
+	}
+	if err := bs.RequeueDeadLetter("unknown"); err == nil {
+		t.Errorf("requeue unknown dead letter should fail")
+	}
+}
+
+//flakyObserver 没有实现IdentifiedObserver，前fail次通知失败
+type flakyObserver struct {
+	*testObserver
+	fail int
+}
+
+func (o *flakyObserver) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	if o.fail > 0 {
+		o.fail--
+		return fmt.Errorf("observer is unavailable")
+	}
+	return o.testObserver.BlockExtractDataNotify(sourceKey, data)
+}
+
+func TestEOSBlockScanner_NotifyOutboxPlainObserver(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	scanTargetFunc := testScanTargetFunc(map[string]string{"alice": "account_alice"})
+	block := testBlock(100, 0, testBlockID(99, 0),
+		testPackedTransaction(1, testTransferAction("eosio.token", "carol", "alice", "1.0000 EOS", "")))
+
+	wm := testNewMockWalletManager(node)
+	wm.Config.NotifyRetryBackoff = 0
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	observer := &flakyObserver{testObserver: newTestObserver(), fail: 1}
+	bs.AddObserver(observer)
+	bs.saveExtractResult(100, bs.ExtractTransaction(100, block.ID.String(), block.Timestamp.Unix(), block.Transactions[0], scanTargetFunc))
+
+	//失败的通知按默认标识进入重试队列，不重扫整个区块
+	pending, _ := bs.GetFailedNotifications()
+	if len(pending) != 1 || pending[0].Observer != bs.observerID(observer) {
+		t.Fatalf("unexpected failed notifications: %+v", pending)
+	}
+	if records, _ := bs.GetUnscanRecords(); len(records) != 0 {
+		t.Errorf("unscan records size = %d, want 0", len(records))
+	}
+
+	//重启后同类型的观测者收到重试的通知
+	restarted := testNewMockWalletManager(node).Blockscanner
+	restarted.SetBlockchainDAI(dai)
+	observer2 := &flakyObserver{testObserver: newTestObserver()}
+	restarted.AddObserver(observer2)
+	restarted.RetryFailedNotifications()
+	if pending, _ := restarted.GetFailedNotifications(); len(pending) != 0 || len(observer2.extractData("account_alice")) != 1 {
+		t.Errorf("failed notification is not redelivered after restart")
+	}
+}
+
+func TestEOSBlockScanner_NotifyRetryBackoff(t *testing.T) {
+	bs := NewWalletManager(nil).Blockscanner
+	bs.wm.Config.NotifyRetryBackoff = 10 * time.Second
+	for attempts, want := range map[uint32]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 4: 80 * time.Second, 20: time.Hour} {
+		if backoff := bs.notifyRetryBackoff(attempts); backoff != want {
+			t.Errorf("backoff of attempts %d = %v, want %v", attempts, backoff, want)
+		}
+	}
+}
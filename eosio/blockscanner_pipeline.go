@@ -0,0 +1,231 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
+)
+
+//fetchedBlock 预取并提取完成的区块
+type fetchedBlock struct {
+	Height  uint32
+	Block   *eos.BlockResp
+	Results []ExtractResult
+	Err     error
+}
+
+//fetchBlockWindow 并发预取区块的窗口大小
+func (bs *EOSBlockScanner) fetchBlockWindow() int {
+	if bs.wm.Config.BlockFetchWindow == 0 {
+		return 1
+	}
+	return int(bs.wm.Config.BlockFetchWindow)
+}
+
+//fetchJob 预取任务，结果写入有缓冲的通道，工作协程不会阻塞
+type fetchJob struct {
+	height uint32
+	result chan<- *fetchedBlock
+}
+
+//fetchBlocks 并发获取[from, to]区间的区块并提取交易，按高度顺序返回结果通道，取消ctx停止预取。
+//source为nil时使用扫描器的区块来源。取消后已入队的结果通道可能没有结果，读取时需要同时等待ctx
+func (bs *EOSBlockScanner) fetchBlocks(ctx context.Context, source BlockSource, from, to uint32) <-chan chan *fetchedBlock {
+
+	var (
+		window = bs.fetchBlockWindow()
+		//队列容量限制同时预取的区块数量
+		queue = make(chan chan *fetchedBlock, window)
+		jobs  = make(chan fetchJob)
+	)
+
+	//固定数量的工作协程，任务通道关闭后退出
+	for i := 0; i < window; i++ {
+		go func() {
+			for job := range jobs {
+				job.result <- bs.fetchBlock(source, job.height)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(queue)
+		defer close(jobs)
+		for height := from; height <= to; height++ {
+			fetched := make(chan *fetchedBlock, 1)
+			select {
+			case queue <- fetched:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- fetchJob{height: height, result: fetched}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return queue
+}
+
+//nextFetchedBlock 等待预取结果，ctx取消时返回错误，已有结果时也不再返回
+func nextFetchedBlock(ctx context.Context, fetching <-chan *fetchedBlock) (*fetchedBlock, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	select {
+	case fetched := <-fetching:
+		return fetched, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+//fetchBlock 从区块来源获取区块并提取其中的交易，source为nil时使用扫描器的区块来源
+func (bs *EOSBlockScanner) fetchBlock(source BlockSource, height uint32) *fetchedBlock {
+
+	block, err := bs.getBlockFrom(source, height)
+	if err != nil {
+		return &fetchedBlock{Height: height, Err: err}
+	}
+
+	return &fetchedBlock{
+		Height:  height,
+		Block:   block,
+		Results: bs.extractBlockTransactions(block),
+	}
+}
+
+//extractBlockTransactions 按交易顺序提取区块中的交易
+func (bs *EOSBlockScanner) extractBlockTransactions(block *eos.BlockResp) []ExtractResult {
+	results := make([]ExtractResult, 0, len(block.Transactions))
+	for _, tx := range block.Transactions {
+		results = append(results, bs.extractTransaction(uint64(block.BlockNum), block.ID.String(), block.Timestamp.Unix(), string(block.Producer), tx, nil, false, bs.ScanTargetFunc))
+	}
+	return results
+}
+
+//scanBlocks 并发预取[from, to]区间的区块，按高度顺序提交，返回最新的本地高度和hash。
+//发现分叉时回滚到共同祖先后返回，获取区块失败或ctx取消时返回错误
+func (bs *EOSBlockScanner) scanBlocks(ctx context.Context, from, to uint32, currentHash string) (uint32, string, error) {
+
+	//返回时停止预取
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	currentHeight := from - 1
+
+	for fetching := range bs.fetchBlocks(ctx, nil, from, to) {
+
+		fetched, err := nextFetchedBlock(ctx, fetching)
+		if err != nil {
+			// stop scan
+			return currentHeight, currentHash, err
+		}
+
+		bs.wm.Log.Std.Info("block scanner scanning height: %d ...", fetched.Height)
+
+		if fetched.Err != nil {
+			bs.wm.Log.Std.Info("block scanner can not get new block data by rpc; unexpected error: %v", fetched.Err)
+			return currentHeight, currentHash, fetched.Err
+		}
+
+		block := fetched.Block
+
+		if currentHash != block.Previous.String() {
+			bs.wm.Log.Std.Info("block has been fork on height: %d.", fetched.Height)
+			bs.wm.Log.Std.Info("block height: %d local hash = %s ", currentHeight, currentHash)
+			bs.wm.Log.Std.Info("block height: %d mainnet hash = %s ", currentHeight, block.Previous.String())
+
+			//向前查找共同祖先，回滚分叉区块，之后预取的区块全部丢弃
+			ancestorHeight, ancestorHash, err := bs.Reorganize(currentHeight, currentHash)
+			if err != nil {
+				bs.wm.Log.Std.Error("block scanner can not reorganize fork blocks; unexpected error: %v", err)
+				return currentHeight, currentHash, err
+			}
+
+			bs.wm.Log.Std.Info("rescan block from height: %d, common ancestor hash: %s .", ancestorHeight+1, ancestorHash)
+
+			return ancestorHeight, ancestorHash, nil
+		}
+
+		currentHeight = fetched.Height
+		currentHash = block.ID.String()
+
+		bs.commitBlock(fetched)
+	}
+
+	return currentHeight, currentHash, nil
+}
+
+//commitBlock 通知区块的提取结果，保存本地新高度并通知新区块
+func (bs *EOSBlockScanner) commitBlock(fetched *fetchedBlock) {
+
+	if err := bs.commitExtractResults(uint64(fetched.Height), fetched.Results); err != nil {
+		bs.wm.Log.Std.Error("block scanner ran BatchExtractTransactions occured unexpected error: %v", err)
+	}
+
+	//保存本地新高度
+	bs.SaveLocalBlockHead(fetched.Height, fetched.Block.ID.String())
+	bs.SaveLocalBlock(ParseBlock(fetched.Block))
+	//通知新区块给观测者，异步处理
+	bs.newBlockNotify(fetched.Block)
+}
+
+//commitExtractResults 按交易顺序通知区块的提取结果
+func (bs *EOSBlockScanner) commitExtractResults(height uint64, results []ExtractResult) error {
+	failed := 0
+	for _, result := range results {
+		if err := bs.saveExtractResult(height, result); err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("block scanner saveWork failed")
+	}
+	return nil
+}
+
+//saveExtractResult 通知提取结果，提取失败时记录未扫区块
+func (bs *EOSBlockScanner) saveExtractResult(height uint64, result ExtractResult) error {
+
+	if !result.Success {
+		//记录未扫区块
+		unscanRecord := openwallet.NewUnscanRecord(height, "", "", bs.wm.Symbol())
+		bs.SaveUnscanRecord(unscanRecord)
+		return fmt.Errorf("extract transaction failed")
+	}
+
+	err := bs.newExtractDataNotify(height, result.extractData)
+	if err != nil {
+		bs.wm.Log.Std.Info("newExtractDataNotify unexpected error: %v", err)
+	}
+
+	err = bs.newExtractContractDataNotify(height, result.extractContractData)
+	if err != nil {
+		bs.wm.Log.Std.Info("newExtractContractDataNotify unexpected error: %v", err)
+	}
+
+	//记录等待不可逆确认的数据
+	bs.addFinalizingData(height, result.BlockHash, result.TxID, result.extractData)
+
+	return err
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eoscanada/eos-go"
+)
+
+func TestEOSBlockScanner_ScanBlocks(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+	node.delay = 5 * time.Millisecond
+
+	//每隔3个区块有一笔给alice的转账
+	transactions := make(map[uint32]*eos.PackedTransaction)
+	for num := uint32(101); num <= 160; num += 3 {
+		transactions[num] = testPackedTransaction(uint16(num), testTransferAction("eosio.token", "bob", "alice", "1.0000 EOS", fmt.Sprint(num)))
+	}
+	blocks := node.addChain(100, 160, 0, testBlockID(99, 0), transactions)
+	node.info.HeadBlockNum = 160
+	node.info.LastIrreversibleBlockNum = 160
+
+	wm := testNewMockWalletManager(node)
+	wm.Config.BlockFetchWindow = 8
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	bs.ScanTargetFunc = testScanTargetFunc(map[string]string{"alice": "account_alice"})
+	bs.Scanning = true
+
+	observer := newTestObserver()
+	bs.AddObserver(observer)
+
+	height, hash, err := bs.scanBlocks(context.Background(), 101, 160, blocks[100].ID.String())
+	if err != nil {
+		t.Fatalf("scan blocks failed: %v", err)
+	}
+	if height != 160 || hash != blocks[160].ID.String() {
+		t.Errorf("scan blocks head = %d %s, want 160", height, hash)
+	}
+
+	localHeight, _, _ := bs.GetLocalBlockHead()
+	if localHeight != 160 {
+		t.Errorf("local block head = %d, want 160", localHeight)
+	}
+
+	//通知按高度顺序送达
+	extracted := observer.extractData("account_alice")
+	if len(extracted) != len(transactions) {
+		t.Fatalf("alice extract data size = %d, want %d", len(extracted), len(transactions))
+	}
+	for i := 1; i < len(extracted); i++ {
+		if extracted[i].Transaction.BlockHeight <= extracted[i-1].Transaction.BlockHeight {
+			t.Fatalf("extract data is not ordered by height: %d after %d", extracted[i].Transaction.BlockHeight, extracted[i-1].Transaction.BlockHeight)
+		}
+	}
+
+	if max := atomic.LoadInt32(&node.maxInflight); max < 2 || max > 9 {
+		t.Errorf("max concurrent requests = %d, want within fetch window", max)
+	}
+}
+
+func TestEOSBlockScanner_ScanBlocksFork(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	chainA := node.addChain(100, 103, 0, testBlockID(99, 0), nil)
+	node.info.HeadBlockNum = 103
+	node.info.LastIrreversibleBlockNum = 100
+
+	wm := testNewMockWalletManager(node)
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	bs.ScanTargetFunc = testScanTargetFunc(map[string]string{})
+	bs.Scanning = true
+
+	if _, _, err := bs.scanBlocks(context.Background(), 101, 103, chainA[100].ID.String()); err != nil {
+		t.Fatalf("scan blocks failed: %v", err)
+	}
+
+	//链B从区块101分叉，预取窗口中分叉点之后的区块需要丢弃
+	node.addChain(102, 108, 1, chainA[101].ID, nil)
+	height, hash, err := bs.scanBlocks(context.Background(), 104, 108, chainA[103].ID.String())
+	if err != nil {
+		t.Fatalf("scan blocks failed: %v", err)
+	}
+	if height != 101 || hash != chainA[101].ID.String() {
+		t.Errorf("scan blocks head = %d %s, want common ancestor 101", height, hash)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"testing"
+
+	"github.com/eoscanada/eos-go"
+)
+
+func TestEOSBlockScanner_ExtractReceiptInfo(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	block := node.addBlock(101, 0, testBlockID(100, 0),
+		testPackedTransaction(1, testTransferAction("eosio.token", "bob", "alice", "1.0000 EOS", "executed")),
+		testPackedTransaction(2, testTransferAction("eosio.token", "bob", "alice", "2.0000 EOS", "hard_fail")),
+		testPackedTransaction(3, testTransferAction("eosio.token", "alice", "bob", "3.0000 EOS", "expired")),
+		testPackedTransaction(4, testTransferAction("eosio.token", "bob", "alice", "4.0000 EOS", "delayed")),
+	)
+	statuses := []eos.TransactionStatus{eos.TransactionStatusExecuted, eos.TransactionStatusHardFail, eos.TransactionStatusExpired, eos.TransactionStatusDelayed}
+	for i := range block.Transactions {
+		block.Transactions[i].Status = statuses[i]
+		block.Transactions[i].CPUUsageMicroSeconds = uint32(100 * (i + 1))
+		block.Transactions[i].NetUsageWords = eos.Varuint32(12 + i)
+	}
+
+	scanTargetFunc := testScanTargetFunc(map[string]string{"alice": "account_alice"})
+
+	//默认只通知成功执行的交易
+	wm := testNewMockWalletManager(node)
+	bs := wm.Blockscanner
+	bs.ScanTargetFunc = scanTargetFunc
+	observer := newTestObserver()
+	bs.AddObserver(observer)
+	bs.scanBlock(101)
+
+	extracted := observer.extractData("account_alice")
+	if len(extracted) != 1 {
+		t.Fatalf("alice extract data size = %d, want 1", len(extracted))
+	}
+	tx := extracted[0].Transaction
+	if tx.Status != "1" || tx.Fees != "0" {
+		t.Errorf("unexpected transaction status: %s fees: %s", tx.Status, tx.Fees)
+	}
+	ext := tx.GetExtParam()
+	if ext.Get("cpu_usage_us").Uint() != 100 || ext.Get("net_usage_words").Uint() != 12 {
+		t.Errorf("unexpected resource usage: %s", ext.Raw)
+	}
+	if ext.Get("status").String() != "executed" || ext.Get("producer").String() != "producer1" {
+		t.Errorf("unexpected receipt status or producer: %s", ext.Raw)
+	}
+
+	//上报失败交易，延迟交易仍然忽略
+	wm2 := testNewMockWalletManager(node)
+	wm2.Config.ReportFailedTransactions = true
+	reporter := wm2.Blockscanner
+	reporter.ScanTargetFunc = scanTargetFunc
+	observer2 := newTestObserver()
+	reporter.AddObserver(observer2)
+	reporter.scanBlock(101)
+
+	extracted = observer2.extractData("account_alice")
+	if len(extracted) != 3 {
+		t.Fatalf("alice extract data size = %d, want 3", len(extracted))
+	}
+	want := []struct {
+		status, reason, receipt string
+		cpu                     uint64
+	}{
+		{"1", "", "executed", 100},
+		{"0", "transaction hard_fail", "hard_fail", 200},
+		{"0", "transaction expired", "expired", 300},
+	}
+	for i, w := range want {
+		tx := extracted[i].Transaction
+		if tx.Status != w.status || tx.Reason != w.reason {
+			t.Errorf("transaction %d status = %s reason = %s, want %s %s", i, tx.Status, tx.Reason, w.status, w.reason)
+		}
+		ext := tx.GetExtParam()
+		if ext.Get("status").String() != w.receipt || ext.Get("cpu_usage_us").Uint() != w.cpu {
+			t.Errorf("transaction %d unexpected ext params: %s", i, ext.Raw)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/eoscanada/eos-go"
+)
+
+// BlockSource 区块数据来源
+type BlockSource interface {
+	GetBlockByNum(num uint32) (*eos.BlockResp, error)
+}
+
+//eos-go的二进制编码器会修改包级别的日志变量，并发编码需要加锁。
+//解析区块不经过编码器，计算区块ID、打包交易和发送SHiP请求等所有编码操作都需要加锁
+var eosCodecLock sync.Mutex
+
+//marshalBinary 加锁进行二进制编码
+func marshalBinary(v interface{}) ([]byte, error) {
+	eosCodecLock.Lock()
+	defer eosCodecLock.Unlock()
+	return eos.MarshalBinary(v)
+}
+
+//rawBlock get_block响应，交易回执的trx保留原始数据。
+//eos-go解析trx时会重新编码打包交易计算ID，改为通过packedTransactionID计算
+type rawBlock struct {
+	eos.BlockResp
+	Transactions []rawTransactionReceipt `json:"transactions"`
+}
+
+//rawTransactionReceipt 交易回执，trx为交易ID或打包交易
+type rawTransactionReceipt struct {
+	eos.TransactionReceiptHeader
+	Transaction json.RawMessage `json:"trx"`
+}
+
+//unmarshalBlock 解析get_block响应，可并发调用
+func unmarshalBlock(data []byte) (*eos.BlockResp, error) {
+	var raw rawBlock
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	block := raw.BlockResp
+	block.Transactions = make([]eos.TransactionReceipt, 0, len(raw.Transactions))
+	for _, tx := range raw.Transactions {
+		receipt := eos.TransactionReceipt{TransactionReceiptHeader: tx.TransactionReceiptHeader}
+		if err := unmarshalTransactionWithID(tx.Transaction, &receipt.Transaction); err != nil {
+			return nil, err
+		}
+		block.Transactions = append(block.Transactions, receipt)
+	}
+	return &block, nil
+}
+
+//unmarshalTransactionWithID 解析交易回执的trx，打包交易通过packedTransactionID计算ID，
+//其他格式由eos-go解析，需要加锁
+func unmarshalTransactionWithID(data json.RawMessage, tx *eos.TransactionWithID) error {
+	if len(data) == 0 || data[0] != '{' {
+		eosCodecLock.Lock()
+		defer eosCodecLock.Unlock()
+		return json.Unmarshal(data, tx)
+	}
+
+	var packed eos.PackedTransaction
+	if err := json.Unmarshal(data, &packed); err != nil {
+		return err
+	}
+	id, err := packedTransactionID(&packed)
+	if err != nil {
+		return fmt.Errorf("get id: %s", err)
+	}
+	*tx = eos.TransactionWithID{ID: id, Packed: &packed}
+	return nil
+}
+
+//packedTransactionID 交易ID为解压后打包交易的sha256，与eos-go重新编码的结果一致，不经过编码器可以并发计算
+func packedTransactionID(packed *eos.PackedTransaction) (eos.Checksum256, error) {
+	data := []byte(packed.PackedTransaction)
+	if packed.Compression == eos.CompressionZlib {
+		reader, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		if data, err = ioutil.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	}
+	id := sha256.Sum256(data)
+	return id[:], nil
+}
+
+//getBlockByNum 从区块数据来源获取区块，没有设置时通过节点客户端获取
+func (bs *EOSBlockScanner) getBlockByNum(num uint32) (*eos.BlockResp, error) {
+	return bs.getBlockFrom(nil, num)
+}
+
+//getBlockFrom 从指定的区块来源获取区块，source为nil时使用扫描器的区块来源
+func (bs *EOSBlockScanner) getBlockFrom(source BlockSource, num uint32) (*eos.BlockResp, error) {
+	if source == nil {
+		source = bs.BlockSource
+	}
+	if source != nil {
+		return source.GetBlockByNum(num)
+	}
+	if bs.wm.client == nil {
+		return nil, fmt.Errorf("API url is not setup. ")
+	}
+	return bs.wm.client.GetBlockByNum(num)
+}
+
+// ReplayBlocks 按高度顺序重放[from, to]区间的区块，经过与扫描相同的提取和通知流程，
+// 区块来源通过BlockSource设置，例如FileBlockSource。停止扫描器时中断重放并返回错误
+func (bs *EOSBlockScanner) ReplayBlocks(from, to uint32) error {
+
+	//返回时停止预取
+	ctx, cancel := context.WithCancel(bs.context())
+	defer cancel()
+
+	var currentHash string
+
+	for fetching := range bs.fetchBlocks(ctx, nil, from, to) {
+
+		fetched, err := nextFetchedBlock(ctx, fetching)
+		if err != nil {
+			return err
+		}
+		if fetched.Err != nil {
+			return fmt.Errorf("get block: %d failed, err: %v", fetched.Height, fetched.Err)
+		}
+
+		bs.wm.Log.Std.Info("block scanner replaying height: %d ...", fetched.Height)
+
+		if len(currentHash) > 0 && fetched.Block.Previous.String() != currentHash {
+			return fmt.Errorf("block: %d previous hash: %s is not linked to %s", fetched.Height, fetched.Block.Previous.String(), currentHash)
+		}
+		currentHash = fetched.Block.ID.String()
+
+		bs.commitBlock(fetched)
+	}
+
+	//预取在取消时提前结束
+	return ctx.Err()
+}
+
+//archivedTransactionReceipt 归档的交易回执，trx为打包交易对象
+type archivedTransactionReceipt struct {
+	eos.TransactionReceiptHeader
+	Transaction interface{} `json:"trx"`
+}
+
+//archivedBlock 归档的区块，与节点get_block的响应格式一致。
+//eos-go序列化的交易回执为[id, packed]，无法被自身解析，需要转换
+type archivedBlock struct {
+	*eos.BlockResp
+	Transactions []archivedTransactionReceipt `json:"transactions"`
+}
+
+//newArchivedBlock 转换为可以被eos-go解析的区块
+func newArchivedBlock(block *eos.BlockResp) *archivedBlock {
+	archived := &archivedBlock{BlockResp: block, Transactions: make([]archivedTransactionReceipt, 0, len(block.Transactions))}
+	for _, tx := range block.Transactions {
+		receipt := archivedTransactionReceipt{TransactionReceiptHeader: tx.TransactionReceiptHeader, Transaction: tx.Transaction.ID}
+		if tx.Transaction.Packed != nil {
+			receipt.Transaction = tx.Transaction.Packed
+		}
+		archived.Transactions = append(archived.Transactions, receipt)
+	}
+	return archived
+}
+
+// FileBlockSource 从归档文件读取区块，path为目录时读取其中的<高度>.json文件，
+// 为文件时按行读取get_block的响应，同一高度有多行时以最后一行为准
+type FileBlockSource struct {
+	path    string
+	isDir   bool
+	offsets map[uint32]int64 //高度 -> 行的偏移
+	file    *os.File
+	mu      sync.Mutex
+}
+
+// NewFileBlockSource 打开区块归档目录或文件
+func NewFileBlockSource(path string) (*FileBlockSource, error) {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	source := &FileBlockSource{path: path, isDir: info.IsDir(), offsets: make(map[uint32]int64)}
+	if source.isDir {
+		return source, nil
+	}
+
+	source.file, err = os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	//建立高度索引
+	var (
+		offset int64
+		reader = bufio.NewReader(source.file)
+	)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			var header struct {
+				BlockNum uint32 `json:"block_num"`
+			}
+			if jsonErr := json.Unmarshal(line, &header); jsonErr != nil {
+				source.file.Close()
+				return nil, fmt.Errorf("invalid block archive line at offset: %d, err: %v", offset, jsonErr)
+			}
+			source.offsets[header.BlockNum] = offset
+		}
+		offset += int64(len(line))
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			source.file.Close()
+			return nil, err
+		}
+	}
+
+	return source, nil
+}
+
+// Heights 归档中所有区块的高度，按升序排列
+func (source *FileBlockSource) Heights() ([]uint32, error) {
+	heights := make([]uint32, 0)
+	if source.isDir {
+		files, err := ioutil.ReadDir(source.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+				continue
+			}
+			num, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), ".json"), 10, 32)
+			if err != nil {
+				continue
+			}
+			heights = append(heights, uint32(num))
+		}
+	} else {
+		for num := range source.offsets {
+			heights = append(heights, num)
+		}
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	return heights, nil
+}
+
+// GetBlockByNum 读取指定高度的区块
+func (source *FileBlockSource) GetBlockByNum(num uint32) (*eos.BlockResp, error) {
+
+	var (
+		data []byte
+		err  error
+	)
+
+	if source.isDir {
+		data, err = ioutil.ReadFile(filepath.Join(source.path, fmt.Sprintf("%d.json", num)))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		offset, ok := source.offsets[num]
+		if !ok {
+			return nil, fmt.Errorf("block: %d not found in archive", num)
+		}
+		source.mu.Lock()
+		_, err = source.file.Seek(offset, io.SeekStart)
+		if err == nil {
+			data, err = bufio.NewReader(source.file).ReadBytes('\n')
+			if err == io.EOF {
+				err = nil
+			}
+		}
+		source.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	block, err := unmarshalBlock(data)
+	if err != nil {
+		return nil, fmt.Errorf("decode block: %d failed, err: %v", num, err)
+	}
+	return block, nil
+}
+
+// Close 关闭归档文件
+func (source *FileBlockSource) Close() error {
+	if source.file != nil {
+		return source.file.Close()
+	}
+	return nil
+}
+
+// BlockRecorder 记录从区块来源获取的区块，按行追加到归档文件，可用FileBlockSource重放
+type BlockRecorder struct {
+	source BlockSource
+	file   *os.File
+	mu     sync.Mutex
+}
+
+// NewBlockRecorder 创建区块记录器，source通常为节点RPC客户端，例如NewClient创建的客户端
+func NewBlockRecorder(source BlockSource, path string) (*BlockRecorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockRecorder{source: source, file: file}, nil
+}
+
+// GetBlockByNum 获取区块并记录到归档文件
+func (recorder *BlockRecorder) GetBlockByNum(num uint32) (*eos.BlockResp, error) {
+
+	block, err := recorder.source.GetBlockByNum(num)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(newArchivedBlock(block))
+	if err != nil {
+		return nil, fmt.Errorf("encode block: %d failed, err: %v", num, err)
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if _, err := recorder.file.Write(append(data, '\n')); err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+// Close 关闭归档文件
+func (recorder *BlockRecorder) Close() error {
+	return recorder.file.Close()
+}
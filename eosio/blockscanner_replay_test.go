@@ -0,0 +1,186 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
+)
+
+func TestEOSBlockScanner_RecordAndReplayBlocks(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "eosio-replay")
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "blocks.ndjson")
+
+	node := newMockNode()
+	transactions := make(map[uint32]*eos.PackedTransaction)
+	for num := uint32(101); num <= 120; num += 4 {
+		transactions[num] = testPackedTransaction(uint16(num), testTransferAction("eosio.token", "bob", "alice", "1.0000 EOS", fmt.Sprint(num)))
+	}
+	blocks := node.addChain(100, 120, 0, testBlockID(99, 0), transactions)
+	node.info.HeadBlockNum = 120
+
+	//扫描节点区块时记录
+	wm := testNewMockWalletManager(node)
+	recorder, err := NewBlockRecorder(wm.client, archive)
+	if err != nil {
+		t.Fatalf("create block recorder failed: %v", err)
+	}
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	bs.BlockSource = recorder
+	bs.ScanTargetFunc = testScanTargetFunc(map[string]string{"alice": "account_alice"})
+	bs.Scanning = true
+	live := newTestObserver()
+	bs.AddObserver(live)
+	if _, _, err := bs.scanBlocks(context.Background(), 101, 120, blocks[100].ID.String()); err != nil {
+		t.Fatalf("scan blocks failed: %v", err)
+	}
+	recorder.Close()
+	node.Close()
+
+	//离线重放
+	source, err := NewFileBlockSource(archive)
+	if err != nil {
+		t.Fatalf("open block archive failed: %v", err)
+	}
+	defer source.Close()
+	if heights, _ := source.Heights(); len(heights) != 20 || heights[0] != 101 {
+		t.Fatalf("archive heights = %v", heights)
+	}
+
+	//预先缓存ABI，重放时不访问节点
+	cache := NewCacheManager()
+	wm2 := NewWalletManager(&cache)
+	if err := wm2.ContractDecoder.SetABIInfo("eosio.token", openwallet.ABIInfo{ABI: testTokenABI()}); err != nil {
+		t.Fatalf("set abi failed: %v", err)
+	}
+	dai2, cleanup2 := testBlockchainDAI(t)
+	defer cleanup2()
+	replay := wm2.Blockscanner
+	replay.SetBlockchainDAI(dai2)
+	replay.BlockSource = source
+	replay.ScanTargetFunc = bs.ScanTargetFunc
+	replayed := newTestObserver()
+	replay.AddObserver(replayed)
+
+	if err := replay.ReplayBlocks(101, 120); err != nil {
+		t.Fatalf("replay blocks failed: %v", err)
+	}
+
+	liveData, replayedData := live.extractData("account_alice"), replayed.extractData("account_alice")
+	if len(replayedData) != len(transactions) || len(replayedData) != len(liveData) {
+		t.Fatalf("replayed extract data size = %d, live = %d", len(replayedData), len(liveData))
+	}
+	for i := range liveData {
+		if liveData[i].Transaction.WxID != replayedData[i].Transaction.WxID || liveData[i].TxOutputs[0].Sid != replayedData[i].TxOutputs[0].Sid {
+			t.Errorf("replayed transaction %d differs from live scan", i)
+		}
+	}
+	if height, hash, _ := replay.GetLocalBlockHead(); height != 120 || hash != blocks[120].ID.String() {
+		t.Errorf("replay local block head = %d %s", height, hash)
+	}
+
+	if err := replay.ReplayBlocks(119, 121); err == nil {
+		t.Errorf("replay block missing from archive should fail")
+	}
+
+	//停止扫描器时中断重放
+	replay.cancelContext()
+	if err := replay.ReplayBlocks(101, 120); err != context.Canceled {
+		t.Errorf("replay after stop err = %v, want canceled", err)
+	}
+}
+
+func TestFileBlockSource_Dir(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "eosio-replay")
+	defer os.RemoveAll(dir)
+
+	packed := testPackedTransaction(1, testTransferAction("eosio.token", "bob", "alice", "1.0000 EOS", ""))
+	for num := uint32(10); num <= 11; num++ {
+		data, _ := json.Marshal(newArchivedBlock(testBlock(num, 0, testBlockID(num-1, 0), packed)))
+		ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.json", num)), data, 0644)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "README.txt"), []byte("fixtures"), 0644)
+
+	source, err := NewFileBlockSource(dir)
+	if err != nil {
+		t.Fatalf("open block dir failed: %v", err)
+	}
+	if heights, _ := source.Heights(); len(heights) != 2 || heights[1] != 11 {
+		t.Errorf("dir heights = %v", heights)
+	}
+	block, err := source.GetBlockByNum(11)
+	if err != nil {
+		t.Fatalf("get block failed: %v", err)
+	}
+	if block.BlockNum != 11 || len(block.Transactions) != 1 || block.Transactions[0].Transaction.Packed == nil {
+		t.Errorf("unexpected block: %+v", block)
+	}
+}
+
+func TestEOSBlockScanner_GetBlockByNumConcurrent(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	tx := eos.NewTransaction([]*eos.Action{testTransferAction("eosio.token", "bob", "alice", "1.0000 EOS", "zlib")}, &eos.TxOptions{HeadBlockID: make([]byte, 32)})
+	compressed, _ := eos.NewSignedTransaction(tx).Pack(eos.CompressionZlib)
+	transactions := make(map[uint32]*eos.PackedTransaction)
+	for num := uint32(101); num <= 140; num++ {
+		transactions[num] = testPackedTransaction(uint16(num), testTransferAction("eosio.token", "bob", "alice", "1.0000 EOS", fmt.Sprint(num)))
+	}
+	transactions[140] = compressed
+	node.addChain(100, 140, 0, testBlockID(99, 0), transactions)
+
+	//压缩交易的ID与eos-go解压后重新编码的结果一致
+	data, _ := json.Marshal(compressed)
+	var want eos.TransactionWithID
+	if err := json.Unmarshal(data, &want); err != nil {
+		t.Fatalf("unmarshal compressed transaction failed: %v", err)
+	}
+
+	//没有设置BlockSource时通过节点客户端获取
+	wm := testNewMockWalletManager(node)
+	wm.Api = eos.New("http://127.0.0.1:1")
+	bs := wm.Blockscanner
+	bs.ScanTargetFunc = testScanTargetFunc(map[string]string{"alice": "account_alice"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for fetching := range bs.fetchBlocks(ctx, nil, 101, 140) {
+		fetched := <-fetching
+		if fetched.Err != nil {
+			t.Fatalf("get block: %d failed: %v", fetched.Height, fetched.Err)
+		}
+		id, _ := transactions[fetched.Height].ID()
+		if fetched.Height == 140 {
+			id = want.ID
+		}
+		if got := fetched.Block.Transactions[0].Transaction.ID.String(); got != id.String() {
+			t.Errorf("block: %d transaction id = %s, want %s", fetched.Height, got, id)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	//SHiP请求的最大区块号，表示持续推送
+	shipEndBlockNum = 0xffffffff
+)
+
+// ScanShipBlockTask 通过state history websocket推送的区块扫描，直到连接断开或停止扫描
+func (bs *EOSBlockScanner) ScanShipBlockTask() {
+
+	var (
+		ctx           = bs.context()
+		currentHeight uint32
+		currentHash   string
+		lastRetry     = time.Now()
+	)
+
+	// get local block header
+	currentHeight, currentHash, err := bs.GetLocalBlockHead()
+	if err != nil {
+		bs.wm.Log.Std.Error("", err)
+	}
+
+	if currentHeight == 0 {
+		currentHeight, currentHash, err = bs.initialBlockHead()
+		if err != nil {
+			bs.wm.Log.Std.Info("get start block error, err=%v", err)
+			return
+		}
+	}
+
+	client := NewShipClient(bs.wm.Config.ShipAPI)
+	if err := client.Connect(); err != nil {
+		bs.wm.Log.Std.Error("block scanner can not connect state history; unexpected error: %v", err)
+		return
+	}
+	defer client.Close()
+
+	//停止扫描时关闭底层连接，结束阻塞的读取
+	defer closeShipOnCancel(ctx, client)()
+
+	if err := client.RequestBlocks(bs.shipBlocksRequest(currentHeight, currentHash)); err != nil {
+		bs.wm.Log.Std.Error("block scanner can not request state history blocks; unexpected error: %v", err)
+		return
+	}
+
+	for {
+		result, err := client.ReadBlocksResult()
+		if ctx.Err() != nil {
+			// stop scan
+			return
+		}
+		if err != nil {
+			bs.wm.Log.Std.Info("block scanner can not read state history blocks; unexpected error: %v", err)
+			break
+		}
+
+		if err := client.AckBlocks(1); err != nil {
+			bs.wm.Log.Std.Info("block scanner can not ack state history blocks; unexpected error: %v", err)
+			break
+		}
+
+		if result.ThisBlock == nil || result.Block == nil {
+			continue
+		}
+
+		thisBlock := result.ThisBlock
+
+		//重新请求前已推送的区块
+		if thisBlock.BlockNum > currentHeight+1 {
+			continue
+		}
+
+		bs.wm.Log.Std.Info("block scanner scanning height: %d ...", thisBlock.BlockNum)
+
+		if result.PrevBlock != nil && result.PrevBlock.BlockID.String() != currentHash {
+
+			bs.wm.Log.Std.Info("block has been fork on height: %d.", thisBlock.BlockNum)
+			bs.wm.Log.Std.Info("block height: %d local hash = %s ", currentHeight, currentHash)
+			bs.wm.Log.Std.Info("block height: %d mainnet hash = %s ", result.PrevBlock.BlockNum, result.PrevBlock.BlockID.String())
+
+			if thisBlock.BlockNum > currentHeight {
+				//节点未重推分叉区块，查找共同祖先后从祖先之后重新请求
+				ancestorHeight, ancestorHash, err := bs.Reorganize(currentHeight, currentHash)
+				if err != nil {
+					bs.wm.Log.Std.Error("block scanner can not reorganize fork blocks; unexpected error: %v", err)
+					break
+				}
+				currentHeight, currentHash = ancestorHeight, ancestorHash
+				if err := client.RequestBlocks(bs.shipBlocksRequest(currentHeight, currentHash)); err != nil {
+					bs.wm.Log.Std.Info("block scanner can not request state history blocks; unexpected error: %v", err)
+					break
+				}
+				continue
+			}
+
+			//节点从分叉点重推区块，本地分叉区块全部回滚
+			bs.rollbackBlocks(thisBlock.BlockNum-1, currentHeight, currentHash)
+		}
+
+		block := shipBlockResp(result)
+
+		currentHeight = thisBlock.BlockNum
+		currentHash = thisBlock.BlockID.String()
+
+		err = bs.batchExtractBlock(block, result.TransactionTraces())
+		if err != nil {
+			bs.wm.Log.Std.Error("block scanner ran BatchExtractTransactions occured unexpected error: %v", err)
+		}
+
+		//保存本地新高度
+		bs.SaveLocalBlockHead(currentHeight, currentHash)
+		bs.SaveLocalBlock(ParseBlock(block))
+		//通知新区块给观测者，异步处理
+		bs.newBlockNotify(block)
+
+		//发送已进入不可逆区块的确认通知
+		bs.notifyFinalizedData(uint64(result.LastIrreversible.BlockNum))
+
+		//推送连接不会结束，按任务周期执行重扫、重试和交易跟踪
+		if time.Since(lastRetry) >= bs.PeriodOfTask {
+			bs.runRetryTasks()
+			lastRetry = time.Now()
+		}
+	}
+
+	bs.runRetryTasks()
+}
+
+//shipBlocksRequest 从本地高度之后持续推送区块的请求
+func (bs *EOSBlockScanner) shipBlocksRequest(currentHeight uint32, currentHash string) *ShipGetBlocksRequest {
+	request := &ShipGetBlocksRequest{
+		StartBlockNum:       currentHeight + 1,
+		EndBlockNum:         shipEndBlockNum,
+		MaxMessagesInFlight: bs.wm.Config.ShipMaxMessagesInFlight,
+		HavePositions:       make([]ShipBlockPosition, 0),
+		FetchBlock:          true,
+		FetchTraces:         true,
+		FetchDeltas:         bs.wm.Config.ShipFetchDeltas,
+		//不可逆模式只推送不可逆区块
+		IrreversibleOnly: bs.wm.Config.ScanMode == ScanModeIrreversible,
+	}
+
+	//告知节点本地已有的区块，节点发现分叉时会从分叉点开始推送
+	if id, err := hex.DecodeString(currentHash); err == nil && len(id) == 32 {
+		request.HavePositions = append(request.HavePositions, ShipBlockPosition{BlockNum: currentHeight, BlockID: id})
+	}
+	return request
+}
+
+//getShipBlock 通过state history获取单个区块及其交易追踪，同一轮重扫的多个区块复用同一连接，出错时关闭连接下次重连
+func (bs *EOSBlockScanner) getShipBlock(height uint32) (*eos.BlockResp, map[string][]*ActionTrace, error) {
+
+	bs.shipRescanLock.Lock()
+	defer bs.shipRescanLock.Unlock()
+
+	if bs.shipRescan == nil {
+		client := NewShipClient(bs.wm.Config.ShipAPI)
+		if err := client.Connect(); err != nil {
+			return nil, nil, err
+		}
+		bs.shipRescan = client
+	}
+	client := bs.shipRescan
+	defer closeShipOnCancel(bs.context(), client)()
+
+	block, traces, err := requestShipBlock(client, height)
+	if err != nil {
+		client.Close()
+		bs.shipRescan = nil
+		return nil, nil, err
+	}
+	return block, traces, nil
+}
+
+//requestShipBlock 请求单个区块，节点收到新的请求时从新的起点推送
+func requestShipBlock(client *ShipClient, height uint32) (*eos.BlockResp, map[string][]*ActionTrace, error) {
+
+	request := &ShipGetBlocksRequest{
+		StartBlockNum:       height,
+		EndBlockNum:         height + 1,
+		MaxMessagesInFlight: 1,
+		HavePositions:       make([]ShipBlockPosition, 0),
+		FetchBlock:          true,
+		FetchTraces:         true,
+	}
+	if err := client.RequestBlocks(request); err != nil {
+		return nil, nil, err
+	}
+
+	result, err := client.ReadBlocksResult()
+	if err != nil {
+		return nil, nil, err
+	}
+	if result.ThisBlock == nil || result.Block == nil || result.ThisBlock.BlockNum != height {
+		return nil, nil, fmt.Errorf("state history did not return block: %d", height)
+	}
+
+	return shipBlockResp(result), result.TransactionTraces(), nil
+}
+
+//closeShipRescan 一轮重扫结束后关闭复用的连接
+func (bs *EOSBlockScanner) closeShipRescan() {
+	bs.shipRescanLock.Lock()
+	defer bs.shipRescanLock.Unlock()
+	if bs.shipRescan != nil {
+		bs.shipRescan.Close()
+		bs.shipRescan = nil
+	}
+}
+
+//shipBlockResp 推送结果转换为区块，二进制区块中的打包交易没有ID，需要计算
+func shipBlockResp(result *ShipGetBlocksResult) *eos.BlockResp {
+	block := &eos.BlockResp{
+		SignedBlock: *result.Block,
+		ID:          result.ThisBlock.BlockID,
+		BlockNum:    result.ThisBlock.BlockNum,
+	}
+
+	for i, tx := range block.Transactions {
+		if len(tx.Transaction.ID) == 0 && tx.Transaction.Packed != nil {
+			block.Transactions[i].Transaction.ID, _ = packedTransactionID(tx.Transaction.Packed)
+		}
+	}
+
+	return block
+}
+
+//closeShipOnCancel 扫描任务取消时关闭连接，结束阻塞的读取，返回的函数结束监听
+func closeShipOnCancel(ctx context.Context, client *ShipClient) func() {
+	stop := make(chan struct{})
+	go func(conn *websocket.Conn) {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}(client.conn)
+	return func() { close(stop) }
+}
@@ -0,0 +1,668 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
+	"github.com/gorilla/websocket"
+)
+
+//testShipABI SHiP ABI中扫描需要的类型
+func testShipABI() *eos.ABI {
+	s := func(name string, fields ...string) eos.StructDef {
+		def := eos.StructDef{Name: name}
+		for i := 0; i < len(fields); i += 2 {
+			def.Fields = append(def.Fields, eos.FieldDef{Name: fields[i], Type: fields[i+1]})
+		}
+		return def
+	}
+	return &eos.ABI{
+		Version: "eosio::abi/1.1",
+		Structs: []eos.StructDef{
+			s("get_status_request_v0"),
+			s("block_position", "block_num", "uint32", "block_id", "checksum256"),
+			s("get_status_result_v0", "head", "block_position", "last_irreversible", "block_position"),
+			s("get_blocks_request_v0", "start_block_num", "uint32", "end_block_num", "uint32", "max_messages_in_flight", "uint32",
+				"have_positions", "block_position[]", "irreversible_only", "bool", "fetch_block", "bool", "fetch_traces", "bool", "fetch_deltas", "bool"),
+			s("get_blocks_ack_request_v0", "num_messages", "uint32"),
+			s("get_blocks_result_v0", "head", "block_position", "last_irreversible", "block_position", "this_block", "block_position?",
+				"prev_block", "block_position?", "block", "bytes?", "traces", "bytes?", "deltas", "bytes?"),
+			s("row", "present", "bool", "data", "bytes"),
+			s("table_delta_v0", "name", "string", "rows", "row[]"),
+			s("action", "account", "name", "name", "name", "authorization", "permission_level[]", "data", "bytes"),
+			s("permission_level", "actor", "name", "permission", "name"),
+			s("account_auth_sequence", "account", "name", "sequence", "uint64"),
+			s("action_receipt_v0", "receiver", "name", "act_digest", "checksum256", "global_sequence", "uint64", "recv_sequence", "uint64",
+				"auth_sequence", "account_auth_sequence[]", "code_sequence", "varuint32", "abi_sequence", "varuint32"),
+			s("account_delta", "account", "name", "delta", "int64"),
+			s("action_trace_v0", "action_ordinal", "varuint32", "creator_action_ordinal", "varuint32", "receipt", "action_receipt?",
+				"receiver", "name", "act", "action", "context_free", "bool", "elapsed", "int64", "console", "string",
+				"account_ram_deltas", "account_delta[]", "except", "string?", "error_code", "uint64?"),
+			s("extension", "type", "uint16", "data", "bytes"),
+			s("partial_transaction_v0", "expiration", "time_point_sec", "ref_block_num", "uint16", "ref_block_prefix", "uint32",
+				"max_net_usage_words", "varuint32", "max_cpu_usage_ms", "uint8", "delay_sec", "varuint32",
+				"transaction_extensions", "extension[]", "signatures", "signature[]", "context_free_data", "bytes[]"),
+			s("transaction_trace_v0", "id", "checksum256", "status", "uint8", "cpu_usage_us", "uint32", "net_usage_words", "varuint32",
+				"elapsed", "int64", "net_usage", "uint64", "scheduled", "bool", "action_traces", "action_trace[]",
+				"account_ram_delta", "account_delta?", "except", "string?", "error_code", "uint64?",
+				"failed_dtrx_trace", "transaction_trace?", "partial", "partial_transaction?"),
+		},
+		Variants: []eos.VariantDef{
+			{Name: "request", Types: []string{"get_status_request_v0", "get_blocks_request_v0", "get_blocks_ack_request_v0"}},
+			{Name: "result", Types: []string{"get_status_result_v0", "get_blocks_result_v0"}},
+			{Name: "action_receipt", Types: []string{"action_receipt_v0"}},
+			{Name: "action_trace", Types: []string{"action_trace_v0"}},
+			{Name: "partial_transaction", Types: []string{"partial_transaction_v0"}},
+			{Name: "transaction_trace", Types: []string{"transaction_trace_v0"}},
+			{Name: "table_delta", Types: []string{"table_delta_v0"}},
+		},
+	}
+}
+
+//shipEncoder 构建SHiP二进制帧
+type shipEncoder struct {
+	bytes.Buffer
+}
+
+func (e *shipEncoder) put(values ...interface{}) *shipEncoder {
+	for _, v := range values {
+		data, err := eos.MarshalBinary(v)
+		if err != nil {
+			panic(err)
+		}
+		e.Write(data)
+	}
+	return e
+}
+
+func (e *shipEncoder) varuint(v uint64) *shipEncoder {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, v)
+	e.Write(buf[:n])
+	return e
+}
+
+func (e *shipEncoder) bytesField(data []byte) *shipEncoder {
+	e.varuint(uint64(len(data)))
+	e.Write(data)
+	return e
+}
+
+//testShipBlock 构建包含一笔打包交易的区块二进制数据
+func testShipBlock(num uint32, prev eos.Checksum256, packed *eos.PackedTransaction) []byte {
+	header := eos.SignedBlockHeader{
+		BlockHeader: eos.BlockHeader{
+			Timestamp:        eos.BlockTimestamp{Time: time.Unix(1577836800, 0).UTC()},
+			Producer:         "producer1",
+			Previous:         prev,
+			TransactionMRoot: make([]byte, 32),
+			ActionMRoot:      make([]byte, 32),
+		},
+		ProducerSignature: testSignature(),
+	}
+	enc := &shipEncoder{}
+	enc.put(header.Timestamp, header.Producer, header.Confirmed, header.Previous, header.TransactionMRoot, header.ActionMRoot, header.ScheduleVersion)
+	enc.put(byte(0)) //new_producers
+	enc.varuint(0)   //header_extensions
+	enc.put(header.ProducerSignature)
+	if packed == nil {
+		enc.varuint(0)
+	} else {
+		enc.varuint(1)
+		enc.put(eos.TransactionStatusExecuted, uint32(100), eos.Varuint32(10))
+		enc.put(byte(1), packed)
+	}
+	enc.varuint(0) //block_extensions
+	return enc.Bytes()
+}
+
+//testShipActionTraces 按执行顺序的操作追踪，包含通知接收者的追踪，操作序号和全局序号依次递增
+func testShipActionTraces(actions []*eos.Action, receivers []string, globalSequence uint64) []ActionTrace {
+	traces := make([]ActionTrace, 0, len(actions))
+	for i, action := range actions {
+		traces = append(traces, testOrdinalTrace(uint32(i+1), receivers[i], globalSequence+uint64(i), action))
+	}
+	return traces
+}
+
+//testShipTraces 构建交易追踪二进制数据
+func testShipTraces(txid eos.Checksum256, traces []ActionTrace) []byte {
+	enc := &shipEncoder{}
+	enc.varuint(1)
+	enc.varuint(0) //transaction_trace_v0
+	enc.put(txid, uint8(0), uint32(100), eos.Varuint32(10), int64(0), uint64(80), false)
+	enc.varuint(uint64(len(traces)))
+	for _, trace := range traces {
+		action := trace.Action
+		receiver := trace.Receipt.Receiver
+		enc.varuint(0) //action_trace_v0
+		enc.put(eos.Varuint32(trace.ActionOrdinal), eos.Varuint32(trace.CreatorActionOrdinal))
+		enc.put(byte(1))
+		enc.varuint(0) //action_receipt_v0
+		enc.put(receiver, eos.Checksum256(make([]byte, 32)), uint64(trace.Receipt.GlobalSequence), uint64(1))
+		enc.varuint(0)
+		enc.put(eos.Varuint32(1), eos.Varuint32(1))
+		enc.put(receiver, action.Account, action.Name)
+		enc.put(action.Authorization)
+		enc.bytesField(action.HexData)
+		enc.put(false, int64(0), "")
+		enc.varuint(0)
+		enc.put(byte(0), byte(0))
+	}
+	enc.put(byte(0), byte(0), byte(0), byte(0), byte(0))
+	return enc.Bytes()
+}
+
+//testShipResult 构建get_blocks_result_v0帧
+func testShipResult(num uint32, id, prev eos.Checksum256, block, traces []byte) []byte {
+	enc := &shipEncoder{}
+	enc.varuint(shipGetBlocksResultIndex)
+	enc.put(num, id, num, id)
+	enc.put(byte(1), num, id)
+	enc.put(byte(1), num-1, prev)
+	enc.put(byte(1)).bytesField(block)
+	if traces == nil {
+		enc.put(byte(0))
+	} else {
+		enc.put(byte(1)).bytesField(traces)
+	}
+	enc.put(byte(0))
+	return enc.Bytes()
+}
+
+//testShipServer 回放录制帧的SHiP服务，hold不为空时推送完成后保持连接直到hold关闭
+func testShipServer(t *testing.T, frames [][]byte, requests chan<- []byte, hold <-chan struct{}) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade websocket failed: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		abi, _ := json.Marshal(testShipABI())
+		conn.WriteMessage(websocket.TextMessage, abi)
+
+		_, request, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		requests <- request
+
+		for _, frame := range frames {
+			conn.WriteMessage(websocket.BinaryMessage, frame)
+			//等待确认
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+		if hold != nil {
+			<-hold
+		}
+	}))
+}
+
+//testShipPayoutFrames 区块101的打包交易只有合约操作，追踪中包含给alice的内联转账，区块102为空
+func testShipPayoutFrames(node *mockNode) ([][]byte, eos.Checksum256) {
+	transfer := testTransferAction("eosio.token", "batchpayout1", "alice", "1.0000 EOS", "ship")
+	payout := &eos.Action{Account: "batchpayout1", Name: "payout", ActionData: eos.NewActionDataFromHexData([]byte{})}
+
+	tx := eos.NewTransaction([]*eos.Action{payout}, &eos.TxOptions{HeadBlockID: make([]byte, 32)})
+	packed, _ := eos.NewSignedTransaction(tx).Pack(eos.CompressionNone)
+	txid, _ := packed.ID()
+
+	id100 := testBlockID(100, 0)
+	id101 := testBlockID(101, 0)
+	id102 := testBlockID(102, 0)
+
+	//区块101包含内联转账，合约执行及接收者通知各有一条追踪
+	traces := testShipTraces(txid, testShipActionTraces([]*eos.Action{payout, transfer, transfer}, []string{"batchpayout1", "eosio.token", "alice"}, 1000))
+
+	frames := [][]byte{
+		testShipResult(101, id101, id100, testShipBlock(101, id100, packed), traces),
+		testShipResult(102, id102, id101, testShipBlock(102, id101, nil), nil),
+	}
+
+	//本地起始高度为区块100，节点RPC返回的区块101不包含追踪
+	node.info.HeadBlockNum = 102
+	node.blocks[101] = &eos.BlockResp{
+		SignedBlock: eos.SignedBlock{SignedBlockHeader: eos.SignedBlockHeader{BlockHeader: eos.BlockHeader{Previous: id100}, ProducerSignature: testSignature()}},
+		ID:          id101,
+		BlockNum:    101,
+	}
+	node.blocks[101].Transactions = []eos.TransactionReceipt{{
+		TransactionReceiptHeader: eos.TransactionReceiptHeader{Status: eos.TransactionStatusExecuted},
+		Transaction:              eos.TransactionWithID{ID: txid, Packed: packed},
+	}}
+
+	return frames, txid
+}
+
+func TestEOSBlockScanner_ScanShipBlockTask(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	frames, txid := testShipPayoutFrames(node)
+	id101 := testBlockID(101, 0)
+
+	requests := make(chan []byte, 1)
+	server := testShipServer(t, frames, requests, nil)
+	defer server.Close()
+
+	wm := testNewMockWalletManager(node)
+	wm.Config.ShipAPI = "ws" + strings.TrimPrefix(server.URL, "http")
+	bs := wm.Blockscanner
+	bs.ScanTargetFunc = testScanTargetFunc(map[string]string{"alice": "account_alice"})
+
+	observer := newTestObserver()
+	bs.AddObserver(observer)
+	bs.Scanning = true
+
+	done := make(chan struct{})
+	go func() {
+		bs.ScanShipBlockTask()
+		close(done)
+	}()
+
+	select {
+	case request := <-requests:
+		if request[0] != shipGetBlocksRequestIndex {
+			t.Errorf("request variant = %d, want %d", request[0], shipGetBlocksRequestIndex)
+		}
+		start := binary.LittleEndian.Uint32(request[1:5])
+		if start != 101 {
+			t.Errorf("start block num = %d, want 101", start)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("state history request timeout")
+	}
+
+	//服务端推送完成后断开连接，扫描结束
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan state history timeout")
+	}
+
+	extracted := observer.extractData("account_alice")
+	if len(extracted) != 1 {
+		t.Fatalf("alice extract data size = %d, want 1", len(extracted))
+	}
+	if extracted[0].Transaction.TxID != txid.String() || extracted[0].Transaction.BlockHeight != 101 {
+		t.Errorf("unexpected transaction: %+v", extracted[0].Transaction)
+	}
+	if extracted[0].Transaction.BlockHash != id101.String() {
+		t.Errorf("block hash = %s, want %s", extracted[0].Transaction.BlockHash, id101.String())
+	}
+}
+
+func TestEOSBlockScanner_ShipRescanFailedRecord(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	frames, txid := testShipPayoutFrames(node)
+	requests := make(chan []byte, 1)
+	server := testShipServer(t, frames, requests, nil)
+	defer server.Close()
+
+	wm := testNewMockWalletManager(node)
+	wm.Config.ShipAPI = "ws" + strings.TrimPrefix(server.URL, "http")
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	bs.ScanTargetFunc = testScanTargetFunc(map[string]string{"alice": "account_alice"})
+	observer := newTestObserver()
+	bs.AddObserver(observer)
+
+	bs.SaveUnscanRecord(openwallet.NewUnscanRecord(101, "", "save failed", wm.Symbol()))
+	bs.RescanFailedRecord()
+
+	//重扫通过state history获取区块101，提取追踪中的内联转账
+	request := <-requests
+	if start := binary.LittleEndian.Uint32(request[1:5]); start != 101 {
+		t.Errorf("start block num = %d, want 101", start)
+	}
+	extracted := observer.extractData("account_alice")
+	if len(extracted) != 1 || extracted[0].Transaction.TxID != txid.String() {
+		t.Fatalf("unexpected rescanned extract data: %d", len(extracted))
+	}
+	if list, _ := bs.GetUnscanRecords(); len(list) != 0 {
+		t.Errorf("unscan records = %d, want 0", len(list))
+	}
+}
+
+func TestEOSBlockScanner_ShipPeriodicTasks(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	frames, _ := testShipPayoutFrames(node)
+	requests := make(chan []byte, 4)
+	hold := make(chan struct{})
+	server := testShipServer(t, frames, requests, hold)
+	defer server.Close()
+
+	wm := testNewMockWalletManager(node)
+	wm.Config.ShipAPI = "ws" + strings.TrimPrefix(server.URL, "http")
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	bs.ScanTargetFunc = testScanTargetFunc(map[string]string{"alice": "account_alice"})
+	bs.AddObserver(newTestObserver())
+	bs.PeriodOfTask = 0
+	bs.Scanning = true
+
+	bs.SaveUnscanRecord(openwallet.NewUnscanRecord(101, "", "save failed", wm.Symbol()))
+
+	done := make(chan struct{})
+	go func() {
+		bs.ScanShipBlockTask()
+		close(done)
+	}()
+
+	//推送连接保持期间，按任务周期重扫失败区块
+	if !testWaitFor(func() bool {
+		list, _ := bs.GetUnscanRecords()
+		return len(list) == 0
+	}) {
+		t.Errorf("failed record was not rescanned while streaming")
+	}
+	select {
+	case <-done:
+		t.Errorf("scan task should keep streaming")
+	default:
+	}
+	if len(requests) != 2 {
+		t.Errorf("state history requests = %d, want 2", len(requests))
+	}
+
+	close(hold)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan state history timeout")
+	}
+}
+
+//testShipDecodeClient 已加载ABI的SHiP客户端，用于直接解析推送帧
+//testShipRequestServer 按请求推送区块的SHiP服务，同一连接可以多次请求，每次确认后推送下一个区块
+func testShipRequestServer(t *testing.T, frames map[uint32][]byte, requests chan<- []byte, connections *int32) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade websocket failed: %v", err)
+			return
+		}
+		defer conn.Close()
+		atomic.AddInt32(connections, 1)
+
+		abi, _ := json.Marshal(testShipABI())
+		conn.WriteMessage(websocket.TextMessage, abi)
+
+		var next, end uint32
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if message[0] == shipGetBlocksRequestIndex {
+				requests <- message
+				next, end = binary.LittleEndian.Uint32(message[1:5]), binary.LittleEndian.Uint32(message[5:9])
+			}
+			if frame, ok := frames[next]; ok && next < end {
+				conn.WriteMessage(websocket.BinaryMessage, frame)
+				next++
+			}
+		}
+	}))
+}
+
+func TestEOSBlockScanner_ShipRescanReuseConnection(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	frames, _ := testShipPayoutFrames(node)
+	var connections int32
+	requests := make(chan []byte, 4)
+	server := testShipRequestServer(t, map[uint32][]byte{101: frames[0], 102: frames[1]}, requests, &connections)
+	defer server.Close()
+
+	wm := testNewMockWalletManager(node)
+	wm.Config.ShipAPI = "ws" + strings.TrimPrefix(server.URL, "http")
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	bs.ScanTargetFunc = testScanTargetFunc(map[string]string{"alice": "account_alice"})
+	bs.AddObserver(newTestObserver())
+
+	bs.SaveUnscanRecord(openwallet.NewUnscanRecord(101, "", "save failed", wm.Symbol()))
+	bs.SaveUnscanRecord(openwallet.NewUnscanRecord(102, "", "save failed", wm.Symbol()))
+	bs.RescanFailedRecord()
+
+	//同一轮重扫的区块通过同一连接请求
+	if list, _ := bs.GetUnscanRecords(); len(list) != 0 {
+		t.Errorf("unscan records = %d, want 0", len(list))
+	}
+	if len(requests) != 2 || atomic.LoadInt32(&connections) != 1 {
+		t.Errorf("state history requests = %d, connections = %d, want 2 requests on 1 connection", len(requests), atomic.LoadInt32(&connections))
+	}
+	if bs.shipRescan != nil {
+		t.Errorf("rescan connection should be closed after the rescan")
+	}
+}
+
+func TestEOSBlockScanner_ShipForkRequestFromAncestor(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	//本地已扫描链A到区块102，节点切换到从区块101分叉的链B
+	chainA := node.addChain(100, 102, 0, testBlockID(99, 0), nil)
+	chainB := node.addChain(102, 104, 1, chainA[101].ID, nil)
+	node.info.HeadBlockNum = 104
+	node.info.LastIrreversibleBlockNum = 100
+
+	frames := make(map[uint32][]byte)
+	for height := uint32(102); height <= 104; height++ {
+		prev := chainB[height].Previous
+		frames[height] = testShipResult(height, chainB[height].ID, prev, testShipBlock(height, prev, nil), nil)
+	}
+	var connections int32
+	requests := make(chan []byte, 4)
+	server := testShipRequestServer(t, frames, requests, &connections)
+	defer server.Close()
+
+	wm := testNewMockWalletManager(node)
+	wm.Config.ShipAPI = "ws" + strings.TrimPrefix(server.URL, "http")
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	bs := wm.Blockscanner
+	bs.SetBlockchainDAI(dai)
+	bs.ScanTargetFunc = testScanTargetFunc(map[string]string{"alice": "account_alice"})
+	bs.Scanning = true
+	for _, height := range []uint32{101, 102} {
+		bs.SaveLocalBlock(&Block{BlockHeader: openwallet.BlockHeader{Hash: chainA[height].ID.String(), Height: uint64(height), Symbol: wm.Symbol()}, Height: height})
+	}
+	bs.SaveLocalBlockHead(102, chainA[102].ID.String())
+
+	done := make(chan struct{})
+	go func() {
+		bs.ScanShipBlockTask()
+		close(done)
+	}()
+
+	//分叉后在同一连接上从共同祖先之后重新请求，继续推送链B
+	if !testWaitFor(func() bool {
+		height, hash, _ := bs.GetLocalBlockHead()
+		return height == 104 && hash == chainB[104].ID.String()
+	}) {
+		height, hash, _ := bs.GetLocalBlockHead()
+		t.Errorf("local block head = %d %s, want chain B 104", height, hash)
+	}
+	if len(requests) != 2 || atomic.LoadInt32(&connections) != 1 {
+		t.Errorf("state history requests = %d, connections = %d, want 2 requests on 1 connection", len(requests), atomic.LoadInt32(&connections))
+	}
+	<-requests
+	if start := binary.LittleEndian.Uint32((<-requests)[1:5]); start != 102 {
+		t.Errorf("start block num after fork = %d, want 102", start)
+	}
+
+	bs.cancelContext()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop state history scan timeout")
+	}
+}
+
+func testShipDecodeClient() *ShipClient {
+	client := NewShipClient("")
+	client.abi = testShipABI()
+	client.abi.Structs = append(client.abi.Structs,
+		eos.StructDef{Name: shipTracesStruct, Fields: []eos.FieldDef{{Name: "traces", Type: "transaction_trace[]"}}},
+		eos.StructDef{Name: shipDeltasStruct, Fields: []eos.FieldDef{{Name: "deltas", Type: "table_delta[]"}}},
+	)
+	return client
+}
+
+func TestEOSBlockScanner_ActionOrdinalAcrossSources(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	//顶层操作payout和给alice的转账，payout执行时内联转账给carol
+	payout := &eos.Action{Account: "batchpayout1", Name: "payout", ActionData: eos.NewActionDataFromHexData([]byte{})}
+	deposit := testTransferAction("eosio.token", "bob", "alice", "1.0000 EOS", "deposit")
+	inline := testTransferAction("eosio.token", "batchpayout1", "carol", "2.0000 EOS", "payout")
+	packed := testPackedTransaction(1, payout, deposit)
+	block := node.addBlock(101, 0, testBlockID(100, 0), packed)
+	txid := block.Transactions[0].Transaction.ID
+
+	//节点先为顶层操作分配序号1~2，内联操作和通知在调度时分配之后的序号，全局序号按执行顺序
+	traces := []ActionTrace{
+		testOrdinalTrace(1, "batchpayout1", 100, payout),
+		testOrdinalTrace(3, "eosio.token", 101, inline),
+		testOrdinalTrace(4, "carol", 102, inline),
+		testOrdinalTrace(2, "eosio.token", 103, deposit),
+		testOrdinalTrace(5, "alice", 104, deposit),
+	}
+	node.transactions[txid.String()] = &TransactionTraceResp{
+		TransactionResp: eos.TransactionResp{ID: txid, BlockNum: 101},
+		Traces:          traces,
+	}
+
+	frame := testShipResult(101, block.ID, testBlockID(100, 0), testShipBlock(101, testBlockID(100, 0), packed), testShipTraces(txid, traces))
+	shipResult, err := testShipDecodeClient().DecodeBlocksResult(frame[1:])
+	if err != nil {
+		t.Fatalf("decode blocks result failed: %v", err)
+	}
+
+	//分别通过节点RPC打包交易、RPC交易追踪和SHiP推送扫描同一区块，返回每个账户的Sid和WxID
+	scan := func(scanActionTraces bool, block *eos.BlockResp, traces map[string][]*ActionTrace) map[string][]string {
+		wm := testNewMockWalletManager(node)
+		wm.Config.ScanActionTraces = scanActionTraces
+		bs := wm.Blockscanner
+		bs.ScanTargetFunc = testScanTargetFunc(map[string]string{"alice": "account_alice", "carol": "account_carol"})
+		observer := newTestObserver()
+		bs.AddObserver(observer)
+		if err := bs.batchExtractBlock(block, traces); err != nil {
+			t.Fatalf("extract block failed: %v", err)
+		}
+		ids := make(map[string][]string)
+		for _, key := range []string{"account_alice", "account_carol"} {
+			for _, data := range observer.extractData(key) {
+				ordinal := data.Transaction.GetExtParam().Get("actionOrdinal").String()
+				ids[key] = append(ids[key], data.TxOutputs[0].Sid, data.Transaction.WxID, ordinal)
+			}
+		}
+		return ids
+	}
+
+	packedIDs := scan(false, block, nil)
+	traceIDs := scan(true, block, nil)
+	shipIDs := scan(false, shipBlockResp(shipResult), shipResult.TransactionTraces())
+
+	alice := packedIDs["account_alice"]
+	if len(alice) != 3 || fmt.Sprint(alice) != fmt.Sprint(traceIDs["account_alice"]) || fmt.Sprint(alice) != fmt.Sprint(shipIDs["account_alice"]) {
+		t.Fatalf("alice ids differ: rpc %v, trace %v, ship %v", alice, traceIDs["account_alice"], shipIDs["account_alice"])
+	}
+	if alice[2] != "1" {
+		t.Errorf("alice actionOrdinal = %s, want 1", alice[2])
+	}
+
+	//内联转账只能通过追踪提取
+	carol := traceIDs["account_carol"]
+	if len(carol) != 3 || carol[2] != "2" || fmt.Sprint(carol) != fmt.Sprint(shipIDs["account_carol"]) || len(packedIDs["account_carol"]) != 0 {
+		t.Errorf("carol ids differ: rpc %v, trace %v, ship %v", packedIDs["account_carol"], carol, shipIDs["account_carol"])
+	}
+
+	//1.8之前的节点嵌套返回内联追踪，没有操作序号，补充的序号与其他方式一致
+	inlineTrace := testActionTrace("eosio.token", 101, inline, &traces[2].ActionTrace)
+	node.transactions[txid.String()] = &TransactionTraceResp{
+		TransactionResp: eos.TransactionResp{ID: txid, BlockNum: 101},
+		Traces: []ActionTrace{
+			testActionTrace("batchpayout1", 100, payout, &inlineTrace.ActionTrace),
+			testActionTrace("eosio.token", 103, deposit, &traces[4].ActionTrace),
+		},
+	}
+	nestedIDs := scan(true, block, nil)
+	if fmt.Sprint(nestedIDs["account_alice"]) != fmt.Sprint(alice) || fmt.Sprint(nestedIDs["account_carol"]) != fmt.Sprint(carol) {
+		t.Errorf("nested trace ids differ: alice %v, carol %v", nestedIDs["account_alice"], nestedIDs["account_carol"])
+	}
+}
+
+func TestShipClient_DecodeBlocksResult(t *testing.T) {
+	client := testShipDecodeClient()
+
+	transfer := testTransferAction("eosio.token", "alice", "bob", "1.0000 EOS", "")
+	txid := testBlockID(1, 1)
+	frame := testShipResult(11, testBlockID(11, 0), testBlockID(10, 0), testShipBlock(11, testBlockID(10, 0), nil),
+		testShipTraces(txid, testShipActionTraces([]*eos.Action{transfer, transfer}, []string{"eosio.token", "bob"}, 7)))
+
+	result, err := client.DecodeBlocksResult(frame[1:])
+	if err != nil {
+		t.Fatalf("decode blocks result failed: %v", err)
+	}
+
+	if result.ThisBlock == nil || result.ThisBlock.BlockNum != 11 || result.PrevBlock.BlockNum != 10 {
+		t.Errorf("unexpected block position: %+v %+v", result.ThisBlock, result.PrevBlock)
+	}
+	if result.Block == nil || result.Block.BlockNumber() != 11 {
+		t.Errorf("unexpected signed block: %+v", result.Block)
+	}
+
+	traces := result.TransactionTraces()[txid.String()]
+	if len(traces) != 1 {
+		t.Fatalf("traces size = %d, want 1", len(traces))
+	}
+	if traces[0].Receipt.GlobalSequence != 7 || string(traces[0].Action.Name) != "transfer" {
+		t.Errorf("unexpected trace: %+v", traces[0])
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/eoscanada/eos-go"
+)
+
+//initialBlockHead 本地没有区块记录时，按配置的起始高度或起始时间确定扫描起点，
+//都没有配置时从当前区块开始，返回起点前一个区块的高度和hash
+func (bs *EOSBlockScanner) initialBlockHead() (uint32, string, error) {
+
+	var (
+		startBlock *eos.BlockResp
+		err        error
+	)
+
+	switch {
+	case bs.wm.Config.ScanStartHeight > 0:
+		bs.wm.Log.Std.Info("No records found in local, scan from the start height: %d", bs.wm.Config.ScanStartHeight)
+		startBlock, err = bs.getBlockByNum(bs.wm.Config.ScanStartHeight)
+	case !bs.wm.Config.ScanStartTime.IsZero():
+		bs.wm.Log.Std.Info("No records found in local, scan from the start time: %s", bs.wm.Config.ScanStartTime.Format(time.RFC3339))
+		var height uint32
+		height, err = bs.FindBlockHeightByTime(bs.wm.Config.ScanStartTime)
+		if err != nil {
+			return 0, "", err
+		}
+		startBlock, err = bs.getBlockByNum(height)
+	case bs.wm.Config.ScanMode == ScanModeIrreversible:
+		bs.wm.Log.Std.Info("No records found in local, get current block as the local!")
+		startBlock, err = bs.GetGlobalIrreversibleBlock()
+	default:
+		bs.wm.Log.Std.Info("No records found in local, get current block as the local!")
+		startBlock, err = bs.GetGlobalHeadBlock()
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	return startBlock.BlockNum - 1, startBlock.Previous.String(), nil
+}
+
+//chainInfoExt get_info中eos-go没有解析的字段
+type chainInfoExt struct {
+	//节点保留的最早区块，低于它的区块已被裁剪，1.x版本的节点没有该字段
+	EarliestAvailableBlockNum uint32 `json:"earliest_available_block_num"`
+}
+
+//earliestAvailableBlockNum 节点可以获取的最早区块高度，节点没有返回时为1
+func (bs *EOSBlockScanner) earliestAvailableBlockNum() (uint32, error) {
+
+	if bs.wm.client == nil {
+		return 0, fmt.Errorf("API url is not setup. ")
+	}
+	data, err := bs.wm.client.Call("get_info", map[string]interface{}{})
+	if err != nil {
+		return 0, err
+	}
+
+	var info chainInfoExt
+	if err := json.Unmarshal(data, &info); err != nil {
+		return 0, err
+	}
+	if info.EarliestAvailableBlockNum == 0 {
+		return 1, nil
+	}
+	return info.EarliestAvailableBlockNum, nil
+}
+
+// FindBlockHeightByTime 按区块时间二分查找，返回时间不早于t的第一个区块高度。
+// 从节点保留的最早区块开始查找，t早于已裁剪节点的最早区块时返回错误
+func (bs *EOSBlockScanner) FindBlockHeightByTime(t time.Time) (uint32, error) {
+
+	infoResp, err := bs.GetChainInfo()
+	if err != nil {
+		return 0, err
+	}
+
+	earliest, err := bs.earliestAvailableBlockNum()
+	if err != nil {
+		return 0, err
+	}
+
+	headBlock, err := bs.getBlockByNum(infoResp.HeadBlockNum)
+	if err != nil {
+		return 0, err
+	}
+	if headBlock.Timestamp.Before(t) {
+		return 0, fmt.Errorf("no block found after time: %s, head block time: %s", t.Format(time.RFC3339), headBlock.Timestamp.Format(time.RFC3339))
+	}
+
+	if earliest > 1 {
+		earliestBlock, err := bs.getBlockByNum(earliest)
+		if err != nil {
+			return 0, err
+		}
+		if earliestBlock.Timestamp.After(t) {
+			return 0, fmt.Errorf("time: %s is before the earliest available block: %d at %s, the node has pruned older blocks", t.Format(time.RFC3339), earliest, earliestBlock.Timestamp.Format(time.RFC3339))
+		}
+	}
+
+	low, high := earliest, infoResp.HeadBlockNum
+	for low < high {
+		mid := low + (high-low)/2
+		block, err := bs.getBlockByNum(mid)
+		if err != nil {
+			return 0, err
+		}
+		if block.Timestamp.Before(t) {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
+
+	return low, nil
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eoscanada/eos-go"
+)
+
+//testStartNode 区块1到200，区块50有一笔给alice的转账
+func testStartNode() *mockNode {
+	node := newMockNode()
+	transactions := map[uint32]*eos.PackedTransaction{
+		50: testPackedTransaction(50, testTransferAction("eosio.token", "bob", "alice", "1.0000 EOS", "before deploy")),
+	}
+	node.addChain(1, 200, 0, testBlockID(0, 0), transactions)
+	node.info.HeadBlockNum = 200
+	node.info.LastIrreversibleBlockNum = 200
+	return node
+}
+
+func TestEOSBlockScanner_FindBlockHeightByTime(t *testing.T) {
+	node := testStartNode()
+	defer node.Close()
+
+	bs := testNewMockWalletManager(node).Blockscanner
+
+	//区块时间为1577836800 + 高度/2，每秒两个区块
+	tests := []struct {
+		time   int64
+		height uint32
+	}{
+		{1577836800, 1},
+		{1577836825, 50},
+		{1577836899, 198},
+		{1577836900, 200},
+	}
+	for _, test := range tests {
+		height, err := bs.FindBlockHeightByTime(time.Unix(test.time, 0))
+		if err != nil {
+			t.Fatalf("find block by time %d failed: %v", test.time, err)
+		}
+		if height != test.height {
+			t.Errorf("block height at %d = %d, want %d", test.time, height, test.height)
+		}
+	}
+
+	if _, err := bs.FindBlockHeightByTime(time.Unix(1577836901, 0)); err == nil {
+		t.Errorf("find block after head time should fail")
+	}
+
+	//节点裁剪了区块100之前的区块，从区块100开始查找
+	node.mu.Lock()
+	node.earliest = 100
+	for num := uint32(1); num < 100; num++ {
+		delete(node.blocks, num)
+	}
+	node.mu.Unlock()
+	if height, err := bs.FindBlockHeightByTime(time.Unix(1577836875, 0)); err != nil || height != 150 {
+		t.Errorf("block height on pruned node = %d, err = %v, want 150", height, err)
+	}
+	if _, err := bs.FindBlockHeightByTime(time.Unix(1577836825, 0)); err == nil {
+		t.Errorf("find block before the earliest available block should fail")
+	}
+}
+
+func TestEOSBlockScanner_ScanBlockTask_StartFrom(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(wc *WalletConfig)
+	}{
+		{"height", func(wc *WalletConfig) { wc.ScanStartHeight = 40 }},
+		{"time", func(wc *WalletConfig) { wc.ScanStartTime = time.Unix(1577836820, 0) }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := testStartNode()
+			defer node.Close()
+
+			wm := testNewMockWalletManager(node)
+			test.config(wm.Config)
+			dai, cleanup := testBlockchainDAI(t)
+			defer cleanup()
+			bs := wm.Blockscanner
+			bs.SetBlockchainDAI(dai)
+			bs.ScanTargetFunc = testScanTargetFunc(map[string]string{"alice": "account_alice"})
+			bs.RescanLastBlockCount = 0
+			bs.Scanning = true
+
+			observer := newTestObserver()
+			bs.AddObserver(observer)
+			bs.ScanBlockTask()
+
+			if len(observer.extractData("account_alice")) != 1 {
+				t.Errorf("deposit before deploy is not scanned")
+			}
+			if height, _, _ := bs.GetLocalBlockHead(); height != 200 {
+				t.Errorf("local block head = %d, want 200", height)
+			}
+		})
+	}
+}
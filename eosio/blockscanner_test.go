@@ -16,8 +16,12 @@
 package eosio
 
 import (
+	"encoding/hex"
 	"fmt"
 	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
 )
 
 //TestScanBlockTask
@@ -52,3 +56,127 @@ func TestGetCurrentBlockHeader(t *testing.T) {
 	header, _ := bs.GetCurrentBlockHeader()
 	fmt.Println(header)
 }
+
+func TestEOSBlockScanner_ExtractTransactionTraces(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	txid := "c7199c599098c3900fa6ff14813dca5becbaa8b4ca85fc4d8fdda94cd1005ab0"
+
+	//批量派发合约通过内联转账给用户打款
+	payout := &eos.Action{Account: "batchpayout1", Name: "payout"}
+	inline1 := testTransferAction("eosio.token", "batchpayout1", "alice", "1.0000 EOS", "payout 1")
+	inline2 := testTransferAction("eosio.token", "batchpayout1", "bob", "2.5000 EOS", "payout 2")
+
+	inlineTrace1 := testActionTrace("eosio.token", 101, inline1,
+		&eos.ActionTrace{Receipt: eos.ActionTraceReceipt{Receiver: "alice", GlobalSequence: 102}, Action: inline1})
+	inlineTrace2 := testActionTrace("eosio.token", 103, inline2,
+		&eos.ActionTrace{Receipt: eos.ActionTraceReceipt{Receiver: "bob", GlobalSequence: 104}, Action: inline2})
+
+	node.transactions[txid] = &TransactionTraceResp{
+		TransactionResp: eos.TransactionResp{BlockNum: 100},
+		Traces: []ActionTrace{
+			testActionTrace("batchpayout1", 100, payout, &inlineTrace1.ActionTrace, &inlineTrace2.ActionTrace),
+		},
+	}
+
+	wm := testNewMockWalletManager(node)
+	wm.Config.ScanActionTraces = true
+	bs := wm.Blockscanner
+
+	receipt := eos.TransactionReceipt{}
+	receipt.Status = eos.TransactionStatusExecuted
+	receipt.Transaction.ID, _ = hex.DecodeString(txid)
+
+	result := bs.ExtractTransaction(100, "blockhash", 0, receipt, testScanTargetFunc(map[string]string{
+		"alice": "account_alice",
+		"bob":   "account_bob",
+	}))
+
+	if !result.Success {
+		t.Fatalf("extract transaction failed")
+	}
+
+	alice := result.extractData["account_alice"]
+	if len(alice) != 1 {
+		t.Fatalf("alice extract data size = %d, want 1", len(alice))
+	}
+	if alice[0].Transaction.Amount != "10000" || alice[0].TxOutputs[0].Address != "alice" {
+		t.Errorf("unexpected alice transaction: %+v", alice[0].Transaction)
+	}
+
+	bob := result.extractData["account_bob"]
+	if len(bob) != 1 {
+		t.Fatalf("bob extract data size = %d, want 1", len(bob))
+	}
+	if bob[0].Transaction.GetExtParam().Get("memo").String() != "payout 2" {
+		t.Errorf("unexpected bob memo: %s", bob[0].Transaction.GetExtParam().Get("memo").String())
+	}
+	if bob[0].Transaction.GetExtParam().Get("globalSequence").Uint() != 103 {
+		t.Errorf("bob globalSequence = %d, want 103", bob[0].Transaction.GetExtParam().Get("globalSequence").Uint())
+	}
+}
+
+func TestEOSBlockScanner_ExtractMultiTransfers(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	wm := testNewMockWalletManager(node)
+	bs := wm.Blockscanner
+
+	//同一交易中给alice的多笔转账
+	packed := testPackedTransaction(1,
+		testTransferAction("eosio.token", "bob", "alice", "1.0000 EOS", "payout"),
+		testTransferAction("eosio.token", "bob", "alice", "1.0000 EOS", "payout"),
+		testTransferAction("eosio.token", "bob", "alice", "2.0000 EOS", "payout"),
+	)
+	block := testBlock(100, 0, testBlockID(99, 0), packed)
+
+	result := bs.ExtractTransaction(100, block.ID.String(), block.Timestamp.Unix(), block.Transactions[0], testScanTargetFunc(map[string]string{"alice": "account_alice"}))
+	alice := result.extractData["account_alice"]
+	if len(alice) != 3 {
+		t.Fatalf("alice extract data size = %d, want 3", len(alice))
+	}
+
+	sids := make(map[string]bool)
+	wxIDs := make(map[string]bool)
+	for i, data := range alice {
+		sids[data.TxOutputs[0].Sid] = true
+		wxIDs[data.Transaction.WxID] = true
+		if ordinal := data.Transaction.GetExtParam().Get("actionOrdinal").Uint(); ordinal != uint64(i) {
+			t.Errorf("transfer %d actionOrdinal = %d", i, ordinal)
+		}
+	}
+	if len(sids) != 3 || len(wxIDs) != 3 {
+		t.Errorf("sids = %d, wxIDs = %d, want 3 distinct records", len(sids), len(wxIDs))
+	}
+
+	//第一个操作与按交易生成的标识一致
+	tx := alice[0].Transaction
+	if tx.WxID != openwallet.GenTransactionWxID(tx) {
+		t.Errorf("first transfer wxID should be compatible with transaction wxID")
+	}
+	if alice[0].TxOutputs[0].Sid != openwallet.GenTxOutPutSID(tx.TxID, bs.wm.Symbol(), tx.Coin.ContractID, 0) {
+		t.Errorf("first transfer sid should be compatible with index 0")
+	}
+}
+
+func TestFlattenActionTraces(t *testing.T) {
+	action := testTransferAction("eosio.token", "alice", "bob", "1.0000 EOS", "")
+	notify := testActionTrace("bob", 2, action)
+	inline := testActionTrace("eosio.token", 2, action, &notify.ActionTrace)
+	root := testActionTrace("eosio.token", 1, action, &inline.ActionTrace)
+
+	//history插件会同时返回展开的追踪，需要去重
+	traces := FlattenActionTraces([]ActionTrace{root, inline, notify})
+	if len(traces) != 2 {
+		t.Fatalf("traces size = %d, want 2", len(traces))
+	}
+	if traces[0].Receipt.GlobalSequence != 1 || traces[1].Receipt.GlobalSequence != 2 {
+		t.Errorf("traces are not ordered by global sequence")
+	}
+	//展开返回的内联追踪仍排在顶层操作之后
+	if traces[0].ActionOrdinal != 1 || traces[1].ActionOrdinal != 2 {
+		t.Errorf("action ordinals = %d, %d, want 1, 2", traces[0].ActionOrdinal, traces[1].ActionOrdinal)
+	}
+}
@@ -0,0 +1,408 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/eoscanada/eos-go"
+)
+
+const (
+	//跟踪中的已广播交易
+	trackedTransactionBucket = "tracked_transactions"
+	//history插件查询不到交易时的错误码(tx_not_found)
+	txNotFoundErrorCode = 3040011
+)
+
+const (
+	//已广播，还没有被打包
+	TrackStatusPending = "pending"
+	//已被打包，所在区块还没有不可逆
+	TrackStatusIncluded = "included"
+	//所在区块已不可逆
+	TrackStatusIrreversible = "irreversible"
+	//过期前没有被打包
+	TrackStatusExpired = "expired"
+	//曾经被打包，区块分叉后过期前没有被重新打包
+	TrackStatusDropped = "dropped"
+)
+
+// TransactionTrackObserver 可选的观测者接口，跟踪的交易不可逆、过期或被丢弃后接收最终状态通知
+type TransactionTrackObserver interface {
+	TransactionTrackNotify(tx *TrackedTransaction) error
+}
+
+// TrackedTransaction 广播后跟踪的交易，直到所在区块不可逆或过期
+type TrackedTransaction struct {
+	TxID           string
+	AccountID      string
+	Symbol         string
+	Expiration     time.Time
+	RefBlockNum    uint16
+	RefBlockPrefix uint32
+	SubmittedAt    int64
+	Status         string
+	//打包交易的区块，被丢弃时为最后一次打包的区块
+	BlockHeight uint64
+	BlockHash   string
+	//交易回执的执行状态
+	ReceiptStatus string
+	//没有history API时已查找的区块高度
+	ScannedHeight uint64
+	//已接收最终状态通知的观测者
+	Notified []string
+}
+
+//isFinal 是否最终状态
+func (tx *TrackedTransaction) isFinal() bool {
+	switch tx.Status {
+	case TrackStatusIrreversible, TrackStatusExpired, TrackStatusDropped:
+		return true
+	}
+	return false
+}
+
+//isNotified 观测者是否已接收通知
+func (tx *TrackedTransaction) isNotified(id string) bool {
+	for _, notified := range tx.Notified {
+		if notified == id {
+			return true
+		}
+	}
+	return false
+}
+
+// TrackTransaction 记录已广播的交易，扫描任务每轮查询交易状态直到不可逆、过期或被丢弃
+func (bs *EOSBlockScanner) TrackTransaction(txid, accountID string, tx *eos.Transaction) error {
+
+	if len(txid) == 0 {
+		return fmt.Errorf("txid is empty")
+	}
+
+	tracked := &TrackedTransaction{
+		TxID:           txid,
+		AccountID:      accountID,
+		Symbol:         bs.wm.Symbol(),
+		Expiration:     tx.Expiration.Time,
+		RefBlockNum:    tx.RefBlockNum,
+		RefBlockPrefix: tx.RefBlockPrefix,
+		SubmittedAt:    time.Now().Unix(),
+		Status:         TrackStatusPending,
+	}
+	return bs.saveTrackedTransaction(tracked)
+}
+
+// GetTrackedTransactions 跟踪中的交易，包括等待通知的最终状态，按广播时间排序
+func (bs *EOSBlockScanner) GetTrackedTransactions() ([]*TrackedTransaction, error) {
+
+	bs.trackingLock.Lock()
+	defer bs.trackingLock.Unlock()
+
+	txs := make([]*TrackedTransaction, 0)
+	if store := bs.stateStore(); store != nil {
+		keys, err := store.Keys(trackedTransactionBucket)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			var tx TrackedTransaction
+			if err := store.GetValue(trackedTransactionBucket, key, &tx); err != nil {
+				return nil, err
+			}
+			txs = append(txs, &tx)
+		}
+	} else {
+		for _, tx := range bs.tracking {
+			copied := *tx
+			txs = append(txs, &copied)
+		}
+	}
+
+	sort.SliceStable(txs, func(i, j int) bool {
+		if txs[i].SubmittedAt != txs[j].SubmittedAt {
+			return txs[i].SubmittedAt < txs[j].SubmittedAt
+		}
+		return txs[i].TxID < txs[j].TxID
+	})
+	return txs, nil
+}
+
+//saveTrackedTransaction 保存跟踪记录，没有持久化存储时保存在内存
+func (bs *EOSBlockScanner) saveTrackedTransaction(tx *TrackedTransaction) error {
+	bs.trackingLock.Lock()
+	defer bs.trackingLock.Unlock()
+
+	if store := bs.stateStore(); store != nil {
+		return store.SetValue(trackedTransactionBucket, tx.TxID, tx)
+	}
+	copied := *tx
+	bs.tracking[tx.TxID] = &copied
+	return nil
+}
+
+//deleteTrackedTransaction 删除跟踪记录
+func (bs *EOSBlockScanner) deleteTrackedTransaction(txid string) error {
+	bs.trackingLock.Lock()
+	defer bs.trackingLock.Unlock()
+
+	if store := bs.stateStore(); store != nil {
+		return store.DeleteValue(trackedTransactionBucket, txid)
+	}
+	delete(bs.tracking, txid)
+	return nil
+}
+
+//startTrackedTransactionsCheck 在后台查询跟踪中的交易，不阻塞扫描任务，上一轮没有结束时跳过
+func (bs *EOSBlockScanner) startTrackedTransactionsCheck() {
+	if !atomic.CompareAndSwapInt32(&bs.trackingChecking, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&bs.trackingChecking, 0)
+		bs.CheckTrackedTransactions()
+	}()
+}
+
+// CheckTrackedTransactions 查询跟踪中的交易状态，到达最终状态后通知观测者，所有观测者接收后删除记录
+func (bs *EOSBlockScanner) CheckTrackedTransactions() {
+
+	txs, err := bs.GetTrackedTransactions()
+	if err != nil {
+		bs.wm.Log.Std.Error("block scanner can not get tracked transactions; unexpected error: %v", err)
+		return
+	}
+	if len(txs) == 0 {
+		return
+	}
+
+	infoResp, err := bs.GetChainInfo()
+	if err != nil {
+		bs.wm.Log.Std.Error("check tracked transactions failed, get chain info error: %v", err)
+		return
+	}
+
+	//不可逆区块的时间超过交易的过期时间后，交易不会再被打包
+	var lastIrreversibleTime time.Time
+	if bs.wm.Config.HasHistoryAPI {
+		if block, err := bs.getBlockByNum(infoResp.LastIrreversibleBlockNum); err == nil {
+			lastIrreversibleTime = block.Timestamp.Time
+		}
+	}
+
+	pending := make([]*TrackedTransaction, 0, len(txs))
+	status := make(map[string]string)
+	scannedHeight := make(map[string]uint64)
+	for _, tx := range txs {
+		if !tx.isFinal() {
+			pending = append(pending, tx)
+			status[tx.TxID], scannedHeight[tx.TxID] = tx.Status, tx.ScannedHeight
+		}
+	}
+
+	if bs.wm.Config.HasHistoryAPI {
+		for _, tx := range pending {
+			if err := bs.checkTrackedTransaction(tx, infoResp.LastIrreversibleBlockNum, lastIrreversibleTime); err != nil {
+				bs.wm.Log.Std.Error("check tracked transaction: %s unexpected error: %v", tx.TxID, err)
+			}
+		}
+	} else if len(pending) > 0 {
+		//失败时保存已查找的进度
+		if err := bs.findTrackedTransactions(pending, infoResp.HeadBlockNum, infoResp.LastIrreversibleBlockNum); err != nil {
+			bs.wm.Log.Std.Error("find tracked transactions unexpected error: %v", err)
+		}
+	}
+
+	for _, tx := range pending {
+		if tx.Status != status[tx.TxID] {
+			bs.wm.Log.Std.Info("tracked transaction: %s status: %s block height: %d", tx.TxID, tx.Status, tx.BlockHeight)
+		}
+		if tx.Status != status[tx.TxID] || tx.ScannedHeight != scannedHeight[tx.TxID] {
+			if err := bs.saveTrackedTransaction(tx); err != nil {
+				bs.wm.Log.Std.Error("save tracked transaction: %s failed. unexpected error: %v", tx.TxID, err)
+				tx.Status = status[tx.TxID]
+			}
+		}
+	}
+
+	for _, tx := range txs {
+		if tx.isFinal() {
+			bs.trackedTransactionNotify(tx)
+		}
+	}
+}
+
+//isTransactionNotFound 节点明确返回交易不存在
+func isTransactionNotFound(err error) bool {
+	apiErr, ok := err.(eos.APIError)
+	return ok && apiErr.ErrorStruct.Code == txNotFoundErrorCode
+}
+
+//checkTrackedTransaction 通过history API查询交易所在区块，确认区块中包含该交易，更新跟踪状态。
+//只有节点明确返回交易不存在时才按未打包处理，其他错误不改变状态
+func (bs *EOSBlockScanner) checkTrackedTransaction(tx *TrackedTransaction, lastIrreversibleHeight uint32, lastIrreversibleTime time.Time) error {
+
+	api := bs.wm.TraceApi
+	if api == nil {
+		api = bs.wm.Api
+	}
+
+	txResp, err := api.GetTransaction(tx.TxID)
+	if err != nil && !isTransactionNotFound(err) {
+		return fmt.Errorf("get transaction failed, err: %v", err)
+	}
+	if err == nil && txResp.BlockNum > 0 {
+		block, err := bs.getBlockByNum(txResp.BlockNum)
+		if err != nil {
+			return fmt.Errorf("get block: %d failed, err: %v", txResp.BlockNum, err)
+		}
+		for _, receipt := range block.Transactions {
+			if receipt.Transaction.ID.String() != tx.TxID {
+				continue
+			}
+			tx.BlockHeight = uint64(block.BlockNum)
+			tx.BlockHash = block.ID.String()
+			tx.ReceiptStatus = receipt.Status.String()
+			if block.BlockNum <= lastIrreversibleHeight {
+				tx.Status = TrackStatusIrreversible
+			} else {
+				tx.Status = TrackStatusIncluded
+			}
+			return nil
+		}
+		//交易所在的区块已分叉，等待重新打包
+	}
+
+	if tx.Status == TrackStatusIncluded {
+		tx.Status = TrackStatusPending
+	}
+
+	if lastIrreversibleTime.IsZero() || !lastIrreversibleTime.After(tx.Expiration) {
+		return nil
+	}
+
+	if tx.BlockHeight > 0 {
+		tx.Status = TrackStatusDropped
+	} else {
+		tx.Status = TrackStatusExpired
+	}
+	return nil
+}
+
+//findTrackedTransactions 没有history API时在不可逆区块中查找交易，每个区块只获取一次，已查找的高度记录在ScannedHeight。
+//交易只能被打包在引用区块之后、时间不超过过期时间的区块中，超过过期时间仍未找到时过期
+func (bs *EOSBlockScanner) findTrackedTransactions(txs []*TrackedTransaction, headHeight, lastIrreversibleHeight uint32) error {
+
+	//从查找进度最低的交易开始
+	pending := make(map[string]*TrackedTransaction)
+	from := uint64(lastIrreversibleHeight)
+	for _, tx := range txs {
+		if tx.ScannedHeight == 0 {
+			tx.ScannedHeight = uint64(refBlockHeight(tx.RefBlockNum, headHeight))
+		}
+		if tx.ScannedHeight < from {
+			from = tx.ScannedHeight
+		}
+		pending[tx.TxID] = tx
+	}
+
+	ctx := bs.context()
+	for height := from + 1; height <= uint64(lastIrreversibleHeight) && len(pending) > 0; height++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		block, err := bs.getBlockByNum(uint32(height))
+		if err != nil {
+			return fmt.Errorf("get block: %d failed, err: %v", height, err)
+		}
+		receipts := make(map[string]eos.TransactionReceipt)
+		for _, receipt := range block.Transactions {
+			receipts[receipt.Transaction.ID.String()] = receipt
+		}
+
+		for txid, tx := range pending {
+			if tx.ScannedHeight >= height {
+				continue
+			}
+			if block.Timestamp.After(tx.Expiration) {
+				tx.Status = TrackStatusExpired
+				delete(pending, txid)
+				continue
+			}
+			if receipt, ok := receipts[txid]; ok {
+				tx.BlockHeight = height
+				tx.BlockHash = block.ID.String()
+				tx.ReceiptStatus = receipt.Status.String()
+				tx.Status = TrackStatusIrreversible
+				delete(pending, txid)
+				continue
+			}
+			tx.ScannedHeight = height
+		}
+	}
+	return nil
+}
+
+//refBlockHeight 交易引用区块的高度，RefBlockNum为高度的低16位，引用区块不高于最新区块
+func refBlockHeight(refBlockNum uint16, headHeight uint32) uint32 {
+	height := headHeight&^0xffff | uint32(refBlockNum)
+	if height > headHeight && height >= 0x10000 {
+		height -= 0x10000
+	}
+	return height
+}
+
+//trackedTransactionNotify 发送最终状态通知，失败的观测者下一轮重试
+func (bs *EOSBlockScanner) trackedTransactionNotify(tx *TrackedTransaction) {
+
+	done := true
+	changed := false
+	for _, o := range bs.observers() {
+		to, ok := o.(TransactionTrackObserver)
+		if !ok {
+			continue
+		}
+		id := bs.observerID(o)
+		if tx.isNotified(id) {
+			continue
+		}
+		notified := *tx
+		if err := to.TransactionTrackNotify(&notified); err != nil {
+			bs.wm.Log.Std.Error("TransactionTrackNotify txid: %s unexpected error: %v", tx.TxID, err)
+			done = false
+			continue
+		}
+		tx.Notified = append(tx.Notified, id)
+		changed = true
+	}
+
+	if done {
+		if err := bs.deleteTrackedTransaction(tx.TxID); err != nil {
+			bs.wm.Log.Std.Error("delete tracked transaction: %s failed. unexpected error: %v", tx.TxID, err)
+		}
+		return
+	}
+
+	if changed {
+		if err := bs.saveTrackedTransaction(tx); err != nil {
+			bs.wm.Log.Std.Error("save tracked transaction: %s failed. unexpected error: %v", tx.TxID, err)
+		}
+	}
+}
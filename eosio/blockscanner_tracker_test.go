@@ -0,0 +1,300 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eoscanada/eos-go"
+)
+
+//testTrackObserver 接收跟踪交易最终状态的观测者，failures次通知返回错误
+type testTrackObserver struct {
+	*testObserver
+	mu       sync.Mutex
+	tracked  []*TrackedTransaction
+	failures int
+}
+
+func (o *testTrackObserver) TransactionTrackNotify(tx *TrackedTransaction) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.failures > 0 {
+		o.failures--
+		return fmt.Errorf("observer is unavailable")
+	}
+	o.tracked = append(o.tracked, tx)
+	return nil
+}
+
+func (o *testTrackObserver) trackedTransactions() map[string]*TrackedTransaction {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	txs := make(map[string]*TrackedTransaction)
+	for _, tx := range o.tracked {
+		txs[tx.TxID] = tx
+	}
+	return txs
+}
+
+//testTrackedStatus 跟踪中的交易状态
+func testTrackedStatus(t *testing.T, bs *EOSBlockScanner) map[string]string {
+	txs, err := bs.GetTrackedTransactions()
+	if err != nil {
+		t.Fatalf("get tracked transactions failed: %v", err)
+	}
+	status := make(map[string]string)
+	for _, tx := range txs {
+		status[tx.TxID] = tx.Status
+	}
+	return status
+}
+
+func TestEOSBlockScanner_TrackTransaction(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	included := testPackedTransaction(1, testTransferAction("eosio.token", "alice", "bob", "1.0000 EOS", ""))
+	forked := testPackedTransaction(2, testTransferAction("eosio.token", "alice", "carol", "1.0000 EOS", ""))
+	blocks := node.addChain(100, 110, 0, testBlockID(99, 0), map[uint32]*eos.PackedTransaction{101: included, 102: forked})
+	includedID := blocks[101].Transactions[0].Transaction.ID
+	forkedID := blocks[102].Transactions[0].Transaction.ID
+	node.transactions[includedID.String()] = &TransactionTraceResp{TransactionResp: eos.TransactionResp{ID: includedID, BlockNum: 101}}
+	node.transactions[forkedID.String()] = &TransactionTraceResp{TransactionResp: eos.TransactionResp{ID: forkedID, BlockNum: 102}}
+	node.info.HeadBlockNum = 110
+	node.info.LastIrreversibleBlockNum = 100
+
+	wm := testNewMockWalletManager(node)
+	wm.Config.HasHistoryAPI = true
+	bs := wm.Blockscanner
+	observer := &testTrackObserver{testObserver: newTestObserver(), failures: 1}
+	bs.AddObserver(observer)
+
+	//过期时间为高度104的区块时间
+	expiration := &eos.Transaction{TransactionHeader: eos.TransactionHeader{Expiration: eos.JSONTime{Time: blocks[104].Timestamp.Time}}}
+	expiredID := "00000000000000000000000000000000000000000000000000000000000000ff"
+	for _, txid := range []string{includedID.String(), forkedID.String(), expiredID} {
+		if err := bs.TrackTransaction(txid, "account_alice", expiration); err != nil {
+			t.Fatalf("track transaction failed: %v", err)
+		}
+	}
+
+	//已打包的交易等待区块不可逆
+	bs.CheckTrackedTransactions()
+	status := testTrackedStatus(t, bs)
+	if status[includedID.String()] != TrackStatusIncluded || status[forkedID.String()] != TrackStatusIncluded || status[expiredID] != TrackStatusPending {
+		t.Fatalf("unexpected tracked status: %v", status)
+	}
+
+	//区块102分叉后交易不在新区块中，区块101不可逆，第一次通知失败
+	node.addBlock(102, 1, blocks[101].ID)
+	node.mu.Lock()
+	node.info.LastIrreversibleBlockNum = 101
+	node.mu.Unlock()
+	bs.CheckTrackedTransactions()
+	status = testTrackedStatus(t, bs)
+	if status[includedID.String()] != TrackStatusIrreversible || status[forkedID.String()] != TrackStatusPending || status[expiredID] != TrackStatusPending {
+		t.Fatalf("unexpected tracked status: %v", status)
+	}
+	if len(observer.trackedTransactions()) != 0 {
+		t.Fatalf("failed notification should be retried")
+	}
+
+	//通知失败的交易在下一轮重新通知
+	bs.CheckTrackedTransactions()
+	tracked := observer.trackedTransactions()[includedID.String()]
+	if tracked == nil || tracked.Status != TrackStatusIrreversible || tracked.BlockHeight != 101 || tracked.BlockHash != blocks[101].ID.String() || tracked.ReceiptStatus != "executed" {
+		t.Fatalf("unexpected irreversible notification: %+v", tracked)
+	}
+	if _, ok := testTrackedStatus(t, bs)[includedID.String()]; ok {
+		t.Errorf("notified transaction should not be tracked")
+	}
+
+	//不可逆区块超过过期时间，节点查询出错时不改变状态
+	node.mu.Lock()
+	node.info.LastIrreversibleBlockNum = 106
+	node.mu.Unlock()
+	node.fail("/v1/history/get_transaction", 2)
+	bs.CheckTrackedTransactions()
+	status = testTrackedStatus(t, bs)
+	if status[forkedID.String()] != TrackStatusPending || status[expiredID] != TrackStatusPending {
+		t.Fatalf("unexpected tracked status after node error: %v", status)
+	}
+
+	//节点明确返回交易不存在，没有打包的交易过期，分叉丢弃的交易被丢弃
+	bs.CheckTrackedTransactions()
+	notified := observer.trackedTransactions()
+	if tx := notified[expiredID]; tx == nil || tx.Status != TrackStatusExpired || tx.BlockHeight != 0 {
+		t.Errorf("unexpected expired notification: %+v", tx)
+	}
+	if tx := notified[forkedID.String()]; tx == nil || tx.Status != TrackStatusDropped || tx.BlockHeight != 102 {
+		t.Errorf("unexpected dropped notification: %+v", tx)
+	}
+	if len(notified) != 3 || len(testTrackedStatus(t, bs)) != 0 {
+		t.Errorf("notified = %d, tracked = %v", len(notified), testTrackedStatus(t, bs))
+	}
+}
+
+func TestEOSBlockScanner_TrackSubmittedTransaction(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	wm := testNewMockWalletManager(node)
+	wm.Config.TrackSubmittedTransactions = true
+	dai, cleanup := testBlockchainDAI(t)
+	defer cleanup()
+	wm.Blockscanner.SetBlockchainDAI(dai)
+
+	wrapper := testTransferNode(t, node, wm, "10.0000 EOS", "bob")
+	key := wrapper.addPrivateKey(t, wm, "m/44'/194'/0'/0/1")
+	node.accounts["alice"].Permissions = append(node.accounts["alice"].Permissions, eos.Permission{PermName: "hot", Parent: "active", RequiredAuth: eos.Authority{
+		Threshold: 1,
+		Keys:      []eos.KeyWeight{{PublicKey: key.PublicKey(), Weight: 1}},
+	}})
+	node.info.HeadBlockTime = eos.JSONTime{Time: time.Unix(1577836800, 0).UTC()}
+
+	rawTx := testTransferRawTx(map[string]string{"bob": "1"}, `{"permission":"hot"}`)
+	if err := wm.TxDecoder.CreateRawTransaction(wrapper, rawTx); err != nil {
+		t.Fatalf("create raw transaction failed: %v", err)
+	}
+	for _, keySignature := range rawTx.Signatures["wallet-account"] {
+		wrapper.sign(t, keySignature)
+	}
+	if err := wm.TxDecoder.VerifyRawTransaction(wrapper, rawTx); err != nil {
+		t.Fatalf("verify raw transaction failed: %v", err)
+	}
+	if _, err := wm.TxDecoder.SubmitRawTransaction(wrapper, rawTx); err != nil {
+		t.Fatalf("submit raw transaction failed: %v", err)
+	}
+
+	//广播后的交易保存在持久化存储中
+	txs, err := wm.Blockscanner.GetTrackedTransactions()
+	if err != nil {
+		t.Fatalf("get tracked transactions failed: %v", err)
+	}
+	if len(txs) != 1 || txs[0].TxID != rawTx.TxID || txs[0].AccountID != "wallet-account" || txs[0].Status != TrackStatusPending {
+		t.Fatalf("unexpected tracked transactions: %+v", txs)
+	}
+	if !txs[0].Expiration.After(node.info.HeadBlockTime.Time) || txs[0].RefBlockNum != 100 {
+		t.Errorf("unexpected expiration: %v ref block: %d", txs[0].Expiration, txs[0].RefBlockNum)
+	}
+
+	//关闭跟踪
+	wm.Config.TrackSubmittedTransactions = false
+	rawTx.IsSubmit = false
+	if _, err := wm.TxDecoder.SubmitRawTransaction(wrapper, rawTx); err != nil {
+		t.Fatalf("submit raw transaction failed: %v", err)
+	}
+	if txs, _ := wm.Blockscanner.GetTrackedTransactions(); len(txs) != 1 {
+		t.Errorf("tracked transactions = %d, want 1", len(txs))
+	}
+}
+
+func TestEOSBlockScanner_TrackTransactionByBlocks(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	included := testPackedTransaction(1, testTransferAction("eosio.token", "alice", "bob", "1.0000 EOS", ""))
+	blocks := node.addChain(100, 110, 0, testBlockID(99, 0), map[uint32]*eos.PackedTransaction{103: included})
+	includedID := blocks[103].Transactions[0].Transaction.ID
+	node.info.HeadBlockNum = 110
+	node.info.LastIrreversibleBlockNum = 102
+
+	//没有history API，节点不提供get_transaction
+	wm := testNewMockWalletManager(node)
+	bs := wm.Blockscanner
+	observer := &testTrackObserver{testObserver: newTestObserver()}
+	bs.AddObserver(observer)
+
+	//引用区块100，过期时间为高度104的区块时间
+	header := &eos.Transaction{TransactionHeader: eos.TransactionHeader{Expiration: eos.JSONTime{Time: blocks[104].Timestamp.Time}, RefBlockNum: 100}}
+	expiredID := "00000000000000000000000000000000000000000000000000000000000000ff"
+	for _, txid := range []string{includedID.String(), expiredID} {
+		if err := bs.TrackTransaction(txid, "account_alice", header); err != nil {
+			t.Fatalf("track transaction failed: %v", err)
+		}
+	}
+
+	//只查找不可逆区块，记录已查找的高度
+	bs.CheckTrackedTransactions()
+	txs, _ := bs.GetTrackedTransactions()
+	if len(txs) != 2 || txs[0].Status != TrackStatusPending || txs[0].ScannedHeight != 102 || txs[1].ScannedHeight != 102 {
+		t.Fatalf("unexpected tracked transactions: %+v", txs)
+	}
+	if node.callCount("/v1/history/get_transaction") != 0 {
+		t.Errorf("history api should not be called")
+	}
+
+	blockCalls := node.callCount("/v1/chain/get_block")
+	node.mu.Lock()
+	node.info.LastIrreversibleBlockNum = 106
+	node.mu.Unlock()
+	bs.CheckTrackedTransactions()
+	notified := observer.trackedTransactions()
+	if tx := notified[includedID.String()]; tx == nil || tx.Status != TrackStatusIrreversible || tx.BlockHeight != 103 || tx.BlockHash != blocks[103].ID.String() {
+		t.Errorf("unexpected irreversible notification: %+v", tx)
+	}
+	if tx := notified[expiredID]; tx == nil || tx.Status != TrackStatusExpired {
+		t.Errorf("unexpected expired notification: %+v", tx)
+	}
+	//从已查找的高度继续，两笔交易共用区块103至106，每个区块只获取一次
+	if calls := node.callCount("/v1/chain/get_block") - blockCalls; calls != 4 {
+		t.Errorf("get_block calls = %d, want 4", calls)
+	}
+
+	if height := refBlockHeight(0xfff0, 0x20005); height != 0x1fff0 {
+		t.Errorf("ref block height = %x, want 1fff0", height)
+	}
+}
+
+func TestEOSBlockScanner_TrackTransactionInBackground(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	included := testPackedTransaction(1, testTransferAction("eosio.token", "alice", "bob", "1.0000 EOS", ""))
+	blocks := node.addChain(100, 110, 0, testBlockID(99, 0), map[uint32]*eos.PackedTransaction{103: included})
+	node.info.HeadBlockNum = 110
+	node.info.LastIrreversibleBlockNum = 110
+
+	wm := testNewMockWalletManager(node)
+	bs := wm.Blockscanner
+	observer := &testTrackObserver{testObserver: newTestObserver()}
+	bs.AddObserver(observer)
+	header := &eos.Transaction{TransactionHeader: eos.TransactionHeader{Expiration: eos.JSONTime{Time: blocks[110].Timestamp.Time}, RefBlockNum: 100}}
+	txid := blocks[103].Transactions[0].Transaction.ID.String()
+	bs.TrackTransaction(txid, "account_alice", header)
+
+	//查找区块较慢时不阻塞扫描任务，上一轮没有结束时不重复查找
+	node.mu.Lock()
+	node.delay = 50 * time.Millisecond
+	node.mu.Unlock()
+	started := time.Now()
+	bs.runRetryTasks()
+	bs.runRetryTasks()
+	if elapsed := time.Since(started); elapsed > 100*time.Millisecond {
+		t.Errorf("retry tasks took %v, tracked transactions should be checked in background", elapsed)
+	}
+
+	if !testWaitFor(func() bool { return observer.trackedTransactions()[txid] != nil }) {
+		t.Fatalf("tracked transaction is not notified")
+	}
+	if calls := node.callCount("/v1/chain/get_block"); calls != 3 {
+		t.Errorf("get_block calls = %d, want 3", calls)
+	}
+}
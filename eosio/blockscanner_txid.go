@@ -0,0 +1,125 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"fmt"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
+)
+
+//ExtractTransactionData 通过交易ID提取交易单数据，无需重扫区块
+func (bs *EOSBlockScanner) ExtractTransactionData(txid string, scanTargetFunc openwallet.BlockScanTargetFunc) (map[string][]*openwallet.TxExtractData, error) {
+	result, err := bs.extractTransactionByID(txid, scanTargetFunc, nil)
+	if err != nil {
+		return nil, err
+	}
+	return result.extractData, nil
+}
+
+//ExtractTransactionAndReceiptData 通过交易ID提取交易单及合约回执数据。
+//接口的每个源标识只能返回一个回执，同一源标识登记了多个合约时返回第一个合约的回执，其余的记录警告
+func (bs *EOSBlockScanner) ExtractTransactionAndReceiptData(txid string, scanTargetFunc openwallet.BlockScanTargetFuncV2) (map[string][]*openwallet.TxExtractData, map[string]*openwallet.SmartContractReceipt, error) {
+	if scanTargetFunc == nil {
+		return nil, nil, fmt.Errorf("scanTargetFunc is not configurated")
+	}
+	result, err := bs.extractTransactionByID(txid, scanTargetFuncFromV2(scanTargetFunc), scanTargetFunc)
+	if err != nil {
+		return nil, nil, err
+	}
+	receipts := make(map[string]*openwallet.SmartContractReceipt)
+	for sourceKey, array := range result.extractContractData {
+		receipts[sourceKey] = array[0]
+		for _, receipt := range array[1:] {
+			bs.wm.Log.Std.Warning("txid: %s source: %s contract: %s receipt is omitted, only one receipt can be returned for each source", txid, sourceKey, receipt.Coin.Contract.Address)
+		}
+	}
+	return result.extractData, receipts, nil
+}
+
+//extractTransactionByID 通过交易追踪获取交易所在区块，按区块扫描相同的逻辑提取交易，
+//配置了scanActionTraces时通过交易追踪提取，否则只提取打包交易中的操作
+func (bs *EOSBlockScanner) extractTransactionByID(txid string, scanTargetFunc openwallet.BlockScanTargetFunc, scanTargetFuncV2 openwallet.BlockScanTargetFuncV2) (*ExtractResult, error) {
+
+	if scanTargetFunc == nil {
+		return nil, fmt.Errorf("scanTargetFunc is not configurated")
+	}
+
+	txResp, err := bs.GetTransactionTraceResp(txid)
+	if err != nil {
+		return nil, fmt.Errorf("get transaction: %s failed, err: %v", txid, err)
+	}
+
+	block, err := bs.getBlockByNum(txResp.BlockNum)
+	if err != nil {
+		return nil, fmt.Errorf("get block: %d failed, err: %v", txResp.BlockNum, err)
+	}
+
+	for _, receipt := range block.Transactions {
+		if receipt.Transaction.ID.String() != txResp.ID.String() {
+			continue
+		}
+
+		result := ExtractResult{
+			BlockHash:        block.ID.String(),
+			BlockHeight:      uint64(block.BlockNum),
+			TxID:             txResp.ID.String(),
+			BlockTime:        block.Timestamp.Unix(),
+			BlockProducer:    string(block.Producer),
+			receipt:          receipt.TransactionReceiptHeader,
+			extractData:      make(map[string][]*openwallet.TxExtractData),
+			scanTargetFuncV2: scanTargetFuncV2,
+		}
+
+		//未执行的交易没有追踪，配置了上报失败交易时提取打包交易
+		if receipt.Status != eos.TransactionStatusExecuted {
+			result = bs.extractFailedTransaction(&result, receipt, scanTargetFunc)
+			if !result.Success {
+				return nil, fmt.Errorf("extract transaction: %s failed", txid)
+			}
+			return &result, nil
+		}
+
+		if bs.wm.Config.ScanActionTraces {
+			result = bs.ExtractTransactionTraces(&result, FlattenActionTraces(txResp.Traces), scanTargetFunc)
+		} else {
+			result = bs.extractPackedTransaction(&result, receipt, scanTargetFunc)
+		}
+		if !result.Success {
+			return nil, fmt.Errorf("extract transaction: %s failed", txid)
+		}
+		return &result, nil
+	}
+
+	return nil, fmt.Errorf("transaction: %s not found in block: %d", txid, txResp.BlockNum)
+}
+
+//scanTargetFuncFromV2 转换为按地址或别名查找的扫描对象方法
+func scanTargetFuncFromV2(scanTargetFuncV2 openwallet.BlockScanTargetFuncV2) openwallet.BlockScanTargetFunc {
+	return func(target openwallet.ScanTarget) (string, bool) {
+		param := openwallet.ScanTargetParam{Symbol: target.Symbol}
+		if target.BalanceModelType == openwallet.BalanceModelTypeAddress {
+			param.ScanTarget = target.Address
+			param.ScanTargetType = openwallet.ScanTargetTypeAccountAddress
+		} else {
+			param.ScanTarget = target.Alias
+			param.ScanTargetType = openwallet.ScanTargetTypeAccountAlias
+		}
+		result := scanTargetFuncV2(param)
+		return result.SourceKey, result.Exist
+	}
+}
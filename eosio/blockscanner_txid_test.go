@@ -0,0 +1,114 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"testing"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
+)
+
+func TestEOSBlockScanner_ExtractTransactionData(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	transfer := testTransferAction("eosio.token", "bob", "alice", "1.0000 EOS", "missed deposit")
+	inline := testTransferAction("eosio.token", "bob", "alice", "0.5000 EOS", "inline")
+	packed := testPackedTransaction(1, transfer)
+	block := node.addBlock(100, 0, testBlockID(99, 0), packed)
+	txid := block.Transactions[0].Transaction.ID.String()
+
+	inlineTrace := testActionTrace("eosio.token", 501, inline)
+	node.transactions[txid] = &TransactionTraceResp{
+		TransactionResp: eos.TransactionResp{ID: block.Transactions[0].Transaction.ID, BlockNum: 100},
+		Traces:          []ActionTrace{testActionTrace("eosio.token", 500, transfer, &inlineTrace.ActionTrace)},
+	}
+
+	wm := testNewMockWalletManager(node)
+	bs := wm.Blockscanner
+
+	//与区块扫描相同，没有配置scanActionTraces时只提取打包交易中的操作
+	extractData, err := bs.ExtractTransactionData(txid, testScanTargetFunc(map[string]string{"alice": "account_alice"}))
+	if err != nil {
+		t.Fatalf("extract transaction data failed: %v", err)
+	}
+	if len(extractData["account_alice"]) != 1 || extractData["account_alice"][0].Transaction.GetExtParam().Get("globalSequence").Uint() != 0 {
+		t.Fatalf("alice extract data size = %d, want packed transfer only", len(extractData["account_alice"]))
+	}
+
+	wm.Config.ScanActionTraces = true
+	extractData, err = bs.ExtractTransactionData(txid, testScanTargetFunc(map[string]string{"alice": "account_alice"}))
+	if err != nil {
+		t.Fatalf("extract transaction data failed: %v", err)
+	}
+
+	alice := extractData["account_alice"]
+	if len(alice) != 2 {
+		t.Fatalf("alice extract data size = %d, want 2", len(alice))
+	}
+	tx := alice[0].Transaction
+	if tx.TxID != txid || tx.BlockHeight != 100 || tx.BlockHash != block.ID.String() || tx.Amount != "10000" {
+		t.Errorf("unexpected transaction: %+v", tx)
+	}
+	if alice[1].Transaction.GetExtParam().Get("globalSequence").Uint() != 501 {
+		t.Errorf("inline transfer is not extracted")
+	}
+
+	if _, err := bs.ExtractTransactionData("0000000000000000000000000000000000000000000000000000000000000000", testScanTargetFunc(nil)); err == nil {
+		t.Errorf("extract unknown transaction should fail")
+	}
+}
+
+func TestEOSBlockScanner_ExtractTransactionAndReceiptData(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	transfer := testTransferAction("eosio.token", "bob", "alice", "1.0000 EOS", "")
+	packed := testPackedTransaction(1, transfer)
+	block := node.addBlock(100, 0, testBlockID(99, 0), packed)
+	txid := block.Transactions[0].Transaction.ID.String()
+
+	node.transactions[txid] = &TransactionTraceResp{
+		TransactionResp: eos.TransactionResp{ID: block.Transactions[0].Transaction.ID, BlockNum: 100},
+		Traces:          []ActionTrace{testActionTrace("eosio.token", 500, transfer)},
+	}
+
+	wm := testNewMockWalletManager(node)
+	bs := wm.Blockscanner
+	bs.MonitorContractActions = ParseContractActions("eosio.token::transfer")
+
+	scanTargetFunc := func(target openwallet.ScanTargetParam) openwallet.ScanTargetResult {
+		switch {
+		case target.ScanTargetType == openwallet.ScanTargetTypeAccountAlias && target.ScanTarget == "alice":
+			return openwallet.ScanTargetResult{SourceKey: "account_alice", Exist: true}
+		case target.ScanTargetType == openwallet.ScanTargetTypeContractAddress && target.ScanTarget == "eosio.token":
+			return openwallet.ScanTargetResult{SourceKey: "contract_token", Exist: true}
+		}
+		return openwallet.ScanTargetResult{}
+	}
+
+	extractData, receipts, err := bs.ExtractTransactionAndReceiptData(txid, scanTargetFunc)
+	if err != nil {
+		t.Fatalf("extract transaction and receipt data failed: %v", err)
+	}
+	if len(extractData["account_alice"]) != 1 {
+		t.Errorf("alice extract data size = %d, want 1", len(extractData["account_alice"]))
+	}
+	if receipt := receipts["contract_token"]; receipt == nil || len(receipt.Events) != 1 {
+		t.Errorf("contract receipt is not extracted: %+v", receipts)
+	}
+}
@@ -18,6 +18,7 @@ package eosio
 import (
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/blocktree/go-owcrypt"
 	"github.com/blocktree/openwallet/v2/common/file"
@@ -31,10 +32,68 @@ const (
 
 # RPC api url
 serverAPI = ""
+# broadcast tx api url
+broadcastAPI = ""
+# history/trace api url, default = serverAPI
+traceAPI = ""
+# scan action traces to extract inline transfers, every transaction is queried from the deprecated history plugin (traceAPI) unless shipAPI is set
+scanActionTraces = false
+# state history plugin websocket url, e.g. ws://127.0.0.1:8080, scan blocks and traces from SHiP if set
+shipAPI = ""
+# max unacknowledged messages sent by state history plugin
+shipMaxMessagesInFlight = 10
+# fetch table deltas from state history plugin
+shipFetchDeltas = false
+# scan mode: head = scan to head block, irreversible = scan to last irreversible block only,
+# hybrid = scan to head block and notify observers implementing FinalizedObserver again when the block becomes irreversible
+scanMode = "head"
+# number of blocks fetched concurrently when catching up
+blockFetchWindow = 10
+# monitored contract actions, separated by comma, e.g. atomicassets::transfer,eosio::delegatebw,myapp::*
+monitorContractActions = ""
+# trusted tokens, separated by comma, format: contract:symbol:precision, e.g. eosio.token:EOS:4,tethertether:USDT:4
+trustedTokens = ""
+# drop transfers of untrusted tokens, otherwise flag them with ext param untrusted, requires trustedTokens
+strictTokenMode = false
+# report failed (soft_fail, hard_fail, expired) transactions involving monitored accounts with status 0, otherwise they are dropped
+reportFailedTransactions = false
+# shared deposit account, deposits to it are routed to users by memo, and new addresses are issued as deposit memos
+memoDepositAccount = ""
+# use the bundled local blockchain database file (dataDir/<symbol>/db/blockchain.db) when no blockchain DAI is set by the host
+localBlockchainDB = false
+# number of recent block headers kept in the local blockchain database, older headers are pruned every 100 blocks
+maxBlockCache = 1000
+# start height of the first scan when there is no local block record, 0 = start from the current block
+scanStartHeight = 0
+# start time of the first scan (RFC3339, e.g. 2020-01-01T00:00:00Z), scan from the first block at or after it, used when scanStartHeight = 0,
+# must not be earlier than the earliest block the node still keeps (earliest_available_block_num of get_info)
+scanStartTime = ""
+# max delivery attempts of a failed observer notification before it is moved to the dead letter list
+notifyMaxAttempts = 10
+# seconds to wait before retrying a failed observer notification, doubled after each failure, up to 1 hour
+notifyRetryBackoff = 10
+# max retries of a scan cycle after a node request fails, 0 = retry until the scanner is stopped
+nodeMaxRetries = 5
+# seconds to wait before retrying a failed node request, doubled after each failure, up to 1 minute, at least 1
+nodeRetryBackoff = 1
+# max transfer actions of a withdrawal transaction, batch withdrawals are split into multiple transactions, 0 = no limit
+maxTransferActions = 0
+# track submitted transactions until they are irreversible, expired or dropped, and notify observers of the final status,
+# query transactions from traceAPI if it is set or scanActionTraces = true, otherwise scan irreversible blocks
+trackSubmittedTransactions = false
 
 `
 )
 
+const (
+	//扫描到最新区块
+	ScanModeHead = "head"
+	//只扫描不可逆区块
+	ScanModeIrreversible = "irreversible"
+	//扫描到最新区块，区块不可逆后再发送确认通知
+	ScanModeHybrid = "hybrid"
+)
+
 var (
 	//币种
 	Symbol = "EOS"
@@ -64,6 +123,48 @@ type WalletConfig struct {
 	DataDir string
 	//broadcast tx api url
 	BroadcastAPI string
+	//交易追踪API，默认与ServerAPI一致
+	TraceAPI string
+	//是否通过交易追踪提取内联转账
+	ScanActionTraces bool
+	//state history websocket地址，设置后通过SHiP扫描区块
+	ShipAPI string
+	//SHiP未确认消息的最大数量
+	ShipMaxMessagesInFlight uint32
+	//SHiP是否推送表数据变化
+	ShipFetchDeltas bool
+	//扫描模式
+	ScanMode string
+	//并发预取区块的窗口大小
+	BlockFetchWindow uint32
+	//是否丢弃不受信任的代币转账
+	StrictTokenMode bool
+	//是否上报涉及监控账户的失败交易，状态为0
+	ReportFailedTransactions bool
+	//按备注区分用户的共享充值账户
+	MemoDepositAccount string
+	//是否使用本地区块链数据库
+	LocalBlockchainDB bool
+	//本地区块链数据库保留的区块头数量
+	MaxBlockCache uint64
+	//首次扫描的起始高度
+	ScanStartHeight uint32
+	//首次扫描的起始时间，从该时间后的第一个区块开始扫描
+	ScanStartTime time.Time
+	//失败通知的最大投递次数
+	NotifyMaxAttempts uint32
+	//失败通知的重试间隔，每次失败后加倍
+	NotifyRetryBackoff time.Duration
+	//节点请求失败后扫描的最大重试次数，0为一直重试直到停止扫描
+	NodeMaxRetries uint32
+	//节点请求失败后的重试间隔，每次失败后加倍
+	NodeRetryBackoff time.Duration
+	//单笔提币交易的最大转账操作数，批量提币超过时拆分为多笔交易，0为不限制
+	MaxTransferActions uint32
+	//是否跟踪已广播的交易直到不可逆、过期或被丢弃
+	TrackSubmittedTransactions bool
+	//是否有history/trace API，没有时通过扫描不可逆区块跟踪已广播的交易
+	HasHistoryAPI bool
 }
 
 func NewConfig(symbol string) *WalletConfig {
@@ -88,6 +189,26 @@ func NewConfig(symbol string) *WalletConfig {
 	c.DBPath = filepath.Join("data", strings.ToLower(c.Symbol), "db")
 	//钱包服务API
 	c.ServerAPI = ""
+	//SHiP未确认消息的最大数量
+	c.ShipMaxMessagesInFlight = 10
+	//扫描模式
+	c.ScanMode = ScanModeHead
+	//并发预取区块的窗口大小
+	c.BlockFetchWindow = 10
+	//本地区块链数据库保留的区块头数量
+	c.MaxBlockCache = defaultMaxBlockCache
+	//失败通知的最大投递次数
+	c.NotifyMaxAttempts = defaultNotifyMaxAttempts
+	//失败通知的重试间隔
+	c.NotifyRetryBackoff = defaultNotifyRetryBackoff
+	//节点请求失败后的最大重试次数
+	c.NodeMaxRetries = defaultNodeMaxRetries
+	//节点请求失败后的重试间隔
+	c.NodeRetryBackoff = defaultNodeRetryBackoff
+	//单笔提币交易的最大转账操作数
+	c.MaxTransferActions = defaultMaxTransferActions
+	//跟踪已广播的交易
+	c.TrackSubmittedTransactions = false
 
 	//创建目录
 	//file.MkdirAll(c.DBPath)
@@ -118,6 +118,14 @@ func (decoder *ContractDecoder) GetABIInfo(address string) (*openwallet.ABIInfo,
 }
 
 // SetABIInfo set abi
+// 预先缓存合约ABI，离线重放区块时无需节点查询
 func (decoder *ContractDecoder) SetABIInfo(address string, abi openwallet.ABIInfo) error {
-	return fmt.Errorf("GetABIInfo not implement")
+	cache := decoder.wm.CacheManager
+	if cache == nil {
+		return fmt.Errorf("cache manager is not configurated")
+	}
+	if _, ok := abi.ABI.(*eos.ABI); !ok {
+		return fmt.Errorf("abi of %s is not eos ABI", address)
+	}
+	return cache.Add("ABI_"+address, abi.ABI, 0)
 }
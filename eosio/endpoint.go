@@ -16,8 +16,10 @@
 package eosio
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/blocktree/openwallet/v2/log"
+	"github.com/eoscanada/eos-go"
 	"github.com/imroc/req"
 )
 
@@ -34,6 +36,8 @@ func NewClient(url string, debug bool) *Client {
 	}
 
 	api := req.New()
+	//提前创建底层http客户端，req会在首次请求时创建，并发请求时存在竞争
+	api.Client()
 	c.client = api
 	return &c
 }
@@ -66,6 +70,39 @@ func (c *Client) SendRPCRequest(method string, request interface{}) ([]byte, err
 	return r.Bytes(), nil
 }
 
+//Call 调用节点的chain API，返回响应内容，HTTP状态码不是2xx时返回节点的错误信息
+func (c *Client) Call(method string, request interface{}) ([]byte, error) {
+
+	if c.client == nil {
+		return nil, fmt.Errorf("API url is not setup. ")
+	}
+
+	targetURL := fmt.Sprintf("%s/v1/chain/%s", c.BaseURL, method)
+	r, err := c.client.Post(targetURL, req.BodyJSON(&request))
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Response().StatusCode > 299 {
+		var apiErr eos.APIError
+		if err := json.Unmarshal(r.Bytes(), &apiErr); err != nil {
+			return nil, fmt.Errorf("%s: status code %d, response: %s", method, r.Response().StatusCode, r.String())
+		}
+		return nil, apiErr
+	}
+
+	return r.Bytes(), nil
+}
+
+//GetBlockByNum 获取区块，可并发调用
+func (c *Client) GetBlockByNum(num uint32) (*eos.BlockResp, error) {
+	data, err := c.Call("get_block", map[string]interface{}{"block_num_or_id": fmt.Sprintf("%d", num)})
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalBlock(data)
+}
+
 //SupportJsonRPCEndpoint 是否开放客户端直接调用全节点的JSON-RPC方法
 //@optional
 func (c *Client) SupportJsonRPCEndpoint() bool {
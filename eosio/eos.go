@@ -16,6 +16,10 @@
 package eosio
 
 import (
+	"fmt"
+	"path/filepath"
+	"time"
+
 	"github.com/astaxie/beego/config"
 	"github.com/blocktree/openwallet/v2/log"
 	"github.com/blocktree/openwallet/v2/openwallet"
@@ -76,11 +80,75 @@ func (wm *WalletManager) LoadAssetsConfig(c config.Configer) error {
 	wm.Config.BroadcastAPI = c.String("broadcastAPI")
 	wm.Api = eos.New(wm.Config.ServerAPI)
 	wm.BroadcastAPI = eos.New(wm.Config.BroadcastAPI)
+	wm.Config.TraceAPI = c.String("traceAPI")
+	if len(wm.Config.TraceAPI) == 0 {
+		wm.Config.TraceAPI = wm.Config.ServerAPI
+	}
+	wm.TraceApi = eos.New(wm.Config.TraceAPI)
+	wm.Config.ScanActionTraces, _ = c.Bool("scanActionTraces")
+	wm.Config.HasHistoryAPI = len(c.String("traceAPI")) > 0 || wm.Config.ScanActionTraces
+	wm.Config.ShipAPI = c.String("shipAPI")
+	if wm.Config.ScanActionTraces && len(wm.Config.ShipAPI) == 0 {
+		wm.Log.Std.Warning("scanActionTraces is enabled, every transaction of scanned blocks is queried from the deprecated history plugin: %s, set shipAPI to scan traces from state history instead", wm.Config.TraceAPI)
+	}
+	wm.Config.ShipMaxMessagesInFlight = uint32(c.DefaultInt("shipMaxMessagesInFlight", 10))
+	wm.Config.ShipFetchDeltas, _ = c.Bool("shipFetchDeltas")
+	wm.Config.ScanMode = c.DefaultString("scanMode", ScanModeHead)
+	switch wm.Config.ScanMode {
+	case ScanModeHead, ScanModeIrreversible, ScanModeHybrid:
+	default:
+		return fmt.Errorf("invalid scanMode: %s, must be %s, %s or %s", wm.Config.ScanMode, ScanModeHead, ScanModeIrreversible, ScanModeHybrid)
+	}
+	wm.Config.BlockFetchWindow = uint32(c.DefaultInt("blockFetchWindow", 10))
+	for key := range ParseContractActions(c.String("monitorContractActions")) {
+		wm.Blockscanner.MonitorContractActions[key] = true
+	}
+	registry, err := ParseTokenRegistry(c.String("trustedTokens"))
+	if err != nil {
+		return err
+	}
+	wm.Blockscanner.TokenRegistry = registry
+	wm.Config.StrictTokenMode, _ = c.Bool("strictTokenMode")
+	if wm.Config.StrictTokenMode && registry.Len() == 0 {
+		return fmt.Errorf("strictTokenMode requires trustedTokens")
+	}
+	wm.Config.ReportFailedTransactions, _ = c.Bool("reportFailedTransactions")
+	wm.Config.MemoDepositAccount = c.String("memoDepositAccount")
 	wm.Config.DataDir = c.String("dataDir")
 	wm.client = NewClient(wm.Config.ServerAPI, false)
 
+	wm.Config.LocalBlockchainDB, _ = c.Bool("localBlockchainDB")
+	wm.Config.MaxBlockCache = uint64(c.DefaultInt64("maxBlockCache", defaultMaxBlockCache))
+	wm.Config.ScanStartHeight = uint32(c.DefaultInt64("scanStartHeight", 0))
+	if startTime := c.String("scanStartTime"); len(startTime) > 0 {
+		wm.Config.ScanStartTime, err = time.Parse(time.RFC3339, startTime)
+		if err != nil {
+			return fmt.Errorf("invalid scanStartTime: %s, err: %v", startTime, err)
+		}
+	}
+
+	wm.Config.NotifyMaxAttempts = uint32(c.DefaultInt("notifyMaxAttempts", defaultNotifyMaxAttempts))
+	wm.Config.NotifyRetryBackoff = time.Duration(c.DefaultInt64("notifyRetryBackoff", int64(defaultNotifyRetryBackoff/time.Second))) * time.Second
+	wm.Config.NodeMaxRetries = uint32(c.DefaultInt("nodeMaxRetries", defaultNodeMaxRetries))
+	wm.Config.NodeRetryBackoff = time.Duration(c.DefaultInt64("nodeRetryBackoff", int64(defaultNodeRetryBackoff/time.Second))) * time.Second
+	if wm.Config.NodeRetryBackoff < time.Second {
+		return fmt.Errorf("invalid nodeRetryBackoff: %v, must be at least 1 second", wm.Config.NodeRetryBackoff)
+	}
+	wm.Config.MaxTransferActions = uint32(c.DefaultInt("maxTransferActions", defaultMaxTransferActions))
+	wm.Config.TrackSubmittedTransactions = c.DefaultBool("trackSubmittedTransactions", false)
+
 	//数据文件夹
 	wm.Config.makeDataDir()
+
+	//使用本地区块链数据库独立运行
+	if wm.Config.LocalBlockchainDB && wm.Blockscanner.BlockchainDAI == nil {
+		dai, err := NewLocalBlockchainDAI(filepath.Join(wm.Config.DBPath, wm.Config.BlockchainFile))
+		if err != nil {
+			return err
+		}
+		dai.SetMaxBlockCache(wm.Config.MaxBlockCache, wm.Symbol())
+		wm.Blockscanner.SetBlockchainDAI(dai)
+	}
 	return nil
 }
 
@@ -26,6 +26,7 @@ type WalletManager struct {
 
 	Api             *eos.API                        // 节点客户端
 	BroadcastAPI    *eos.API                        //广播交易节点
+	TraceApi        *eos.API                        //交易追踪节点
 	Config          *WalletConfig                   // 节点配置
 	Decoder         openwallet.AddressDecoder       //地址编码器
 	DecoderV2       openwallet.AddressDecoderV2     //地址编码器2
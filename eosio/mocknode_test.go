@@ -0,0 +1,393 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
+	"github.com/eoscanada/eos-go/ecc"
+	"github.com/eoscanada/eos-go/token"
+)
+
+//mockNode 本地模拟节点，用于离线测试
+type mockNode struct {
+	*httptest.Server
+	mu           sync.Mutex
+	info         *eos.InfoResp
+	earliest     uint32 //get_info的earliest_available_block_num，为0时不返回
+	blocks       map[uint32]*eos.BlockResp
+	transactions map[string]*TransactionTraceResp
+	abis         map[string]*eos.ABI
+	accounts     map[string]*eos.AccountResp
+	balances     map[string][]string //账户主币余额
+	calls        map[string]int
+	failures     map[string]int //请求路径剩余的失败次数
+	delay        time.Duration  //模拟网络延迟
+	inflight     int32
+	maxInflight  int32 //最大并发请求数
+}
+
+func newMockNode() *mockNode {
+	node := &mockNode{
+		info:         &eos.InfoResp{},
+		blocks:       make(map[uint32]*eos.BlockResp),
+		transactions: make(map[string]*TransactionTraceResp),
+		abis:         map[string]*eos.ABI{"eosio.token": testTokenABI()},
+		accounts:     make(map[string]*eos.AccountResp),
+		balances:     make(map[string][]string),
+		calls:        make(map[string]int),
+		failures:     make(map[string]int),
+	}
+	node.Server = httptest.NewServer(http.HandlerFunc(node.handle))
+	return node
+}
+
+func (node *mockNode) handle(w http.ResponseWriter, r *http.Request) {
+	var params map[string]interface{}
+	body, _ := ioutil.ReadAll(r.Body)
+	json.Unmarshal(body, &params)
+
+	inflight := atomic.AddInt32(&node.inflight, 1)
+	defer atomic.AddInt32(&node.inflight, -1)
+	for {
+		max := atomic.LoadInt32(&node.maxInflight)
+		if inflight <= max || atomic.CompareAndSwapInt32(&node.maxInflight, max, inflight) {
+			break
+		}
+	}
+	time.Sleep(node.delay)
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	node.calls[r.URL.Path]++
+
+	if node.failures[r.URL.Path] > 0 {
+		node.failures[r.URL.Path]--
+		http.Error(w, `{"code":503,"message":"node is unavailable"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	var out interface{}
+	switch r.URL.Path {
+	case "/v1/chain/get_info":
+		out = struct {
+			*eos.InfoResp
+			EarliestAvailableBlockNum uint32 `json:"earliest_available_block_num,omitempty"`
+		}{node.info, node.earliest}
+	case "/v1/chain/get_block":
+		var num uint32
+		fmt.Sscanf(fmt.Sprint(params["block_num_or_id"]), "%d", &num)
+		block, ok := node.blocks[num]
+		if !ok {
+			http.Error(w, `{"code":500,"message":"unknown block"}`, http.StatusInternalServerError)
+			return
+		}
+		out = newArchivedBlock(block)
+	case "/v1/history/get_transaction":
+		id, _ := params["id"].(string)
+		tx, ok := node.transactions[id]
+		if !ok {
+			http.Error(w, `{"code":500,"message":"Internal Service Error","error":{"code":3040011,"name":"tx_not_found","what":"The transaction can not be found"}}`, http.StatusInternalServerError)
+			return
+		}
+		//history插件的响应，receipt.trx为空
+		out = map[string]interface{}{
+			"id":                      tx.ID,
+			"block_num":               tx.BlockNum,
+			"block_time":              tx.BlockTime,
+			"last_irreversible_block": tx.LastIrreversibleBlock,
+			"traces":                  tx.Traces,
+		}
+	case "/v1/chain/get_account":
+		name, _ := params["account_name"].(string)
+		account, ok := node.accounts[name]
+		if !ok {
+			http.Error(w, `{"code":500,"message":"unknown key"}`, http.StatusInternalServerError)
+			return
+		}
+		out = account
+	case "/v1/chain/get_currency_balance":
+		name, _ := params["account"].(string)
+		balances, ok := node.balances[name]
+		if !ok {
+			balances = []string{}
+		}
+		out = balances
+	case "/v1/chain/get_abi":
+		name, _ := params["account_name"].(string)
+		abi, ok := node.abis[name]
+		if !ok {
+			abi = &eos.ABI{}
+		}
+		out = &eos.GetABIResp{AccountName: eos.AccountName(name), ABI: *abi}
+	case "/v1/chain/push_transaction":
+		//交易ID为打包交易的sha256
+		packed, _ := hex.DecodeString(fmt.Sprint(params["packed_trx"]))
+		id := sha256.Sum256(packed)
+		out = &eos.PushTransactionFullResp{
+			TransactionID: hex.EncodeToString(id[:]),
+			Processed:     eos.TransactionProcessed{ID: id[:]},
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	json.NewEncoder(w).Encode(out)
+}
+
+//addBlock 添加区块，fork用于生成不同分支的区块ID
+func (node *mockNode) addBlock(num uint32, fork byte, prev eos.Checksum256, transactions ...*eos.PackedTransaction) *eos.BlockResp {
+	block := testBlock(num, fork, prev, transactions...)
+	node.mu.Lock()
+	node.blocks[num] = block
+	node.mu.Unlock()
+	return block
+}
+
+//addChain 添加连续的区块，返回各高度的区块
+func (node *mockNode) addChain(from, to uint32, fork byte, prev eos.Checksum256, transactions map[uint32]*eos.PackedTransaction) map[uint32]*eos.BlockResp {
+	blocks := make(map[uint32]*eos.BlockResp)
+	for num := from; num <= to; num++ {
+		var block *eos.BlockResp
+		if tx, ok := transactions[num]; ok {
+			block = node.addBlock(num, fork, prev, tx)
+		} else {
+			block = node.addBlock(num, fork, prev)
+		}
+		blocks[num] = block
+		prev = block.ID
+	}
+	return blocks
+}
+
+//fail 请求路径接下来的times次请求失败
+func (node *mockNode) fail(path string, times int) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.failures[path] = times
+}
+
+func (node *mockNode) callCount(path string) int {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return node.calls[path]
+}
+
+//testNewMockWalletManager 连接本地模拟节点的钱包管理
+func testNewMockWalletManager(node *mockNode) *WalletManager {
+	wm := NewWalletManager(nil)
+	wm.Config.ServerAPI = node.URL
+	wm.Config.TraceAPI = node.URL
+	wm.Api = eos.New(node.URL)
+	wm.TraceApi = eos.New(node.URL)
+	wm.BroadcastAPI = eos.New(node.URL)
+	wm.client = NewClient(node.URL, false)
+	return wm
+}
+
+//testSignature 空内容的K1签名，区块JSON序列化需要有效的签名曲线
+func testSignature() ecc.Signature {
+	return ecc.MustNewSignatureFromData(make([]byte, 66))
+}
+
+//testBlockID 生成指定高度的区块ID，前4字节为高度
+func testBlockID(num uint32, fork byte) eos.Checksum256 {
+	id := make([]byte, 32)
+	binary.BigEndian.PutUint32(id, num)
+	id[31] = fork
+	return id
+}
+
+//testBlock 构建包含打包交易的区块
+func testBlock(num uint32, fork byte, prev eos.Checksum256, transactions ...*eos.PackedTransaction) *eos.BlockResp {
+	block := &eos.BlockResp{
+		ID:       testBlockID(num, fork),
+		BlockNum: num,
+	}
+	block.Timestamp = eos.BlockTimestamp{Time: time.Unix(1577836800+int64(num)/2, 0).UTC()}
+	block.Producer = "producer1"
+	block.Previous = prev
+	block.ProducerSignature = testSignature()
+	for _, packed := range transactions {
+		id, _ := packed.ID()
+		receipt := eos.TransactionReceipt{Transaction: eos.TransactionWithID{ID: id, Packed: packed}}
+		receipt.Status = eos.TransactionStatusExecuted
+		block.Transactions = append(block.Transactions, receipt)
+	}
+	return block
+}
+
+//testPackedTransaction 打包包含指定操作的交易，nonce用于生成不同的交易ID
+func testPackedTransaction(nonce uint16, actions ...*eos.Action) *eos.PackedTransaction {
+	tx := eos.NewTransaction(actions, &eos.TxOptions{HeadBlockID: make([]byte, 32)})
+	tx.RefBlockNum = nonce
+	packed, _ := eos.NewSignedTransaction(tx).Pack(eos.CompressionNone)
+	return packed
+}
+
+//testBlockchainDAI 临时目录中的区块链数据库，返回清理函数
+func testBlockchainDAI(t *testing.T) (*LocalBlockchainDAI, func()) {
+	dir, err := ioutil.TempDir("", "eosio-blockchain")
+	if err != nil {
+		t.Fatalf("create temp dir failed: %v", err)
+	}
+	dai, err := NewLocalBlockchainDAI(filepath.Join(dir, "blockchain.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("create blockchain db failed: %v", err)
+	}
+	return dai, func() {
+		dai.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+//testTokenABI eosio.token的transfer操作ABI
+func testTokenABI() *eos.ABI {
+	return &eos.ABI{
+		Version: "eosio::abi/1.1",
+		Structs: []eos.StructDef{
+			{
+				Name: "transfer",
+				Fields: []eos.FieldDef{
+					{Name: "from", Type: "name"},
+					{Name: "to", Type: "name"},
+					{Name: "quantity", Type: "asset"},
+					{Name: "memo", Type: "string"},
+				},
+			},
+		},
+		Actions: []eos.ActionDef{
+			{Name: "transfer", Type: "transfer"},
+		},
+	}
+}
+
+//testTransferAction 构建一个转账操作
+func testTransferAction(contract, from, to, quantity, memo string) *eos.Action {
+	asset, _ := eos.NewAsset(quantity)
+	action := token.NewTransfer(eos.AccountName(from), eos.AccountName(to), asset, memo)
+	action.Account = eos.AccountName(contract)
+	hexData, _ := eos.MarshalBinary(action.ActionData.Data)
+	action.ActionData = eos.NewActionDataFromHexData(hexData)
+	//与节点返回的格式一致，输出hex_data
+	action.ActionData.SetToServer(false)
+	return action
+}
+
+//testActionTrace 构建操作追踪
+func testActionTrace(receiver string, globalSequence uint64, action *eos.Action, inlines ...*eos.ActionTrace) ActionTrace {
+	return ActionTrace{ActionTrace: eos.ActionTrace{
+		Receipt: eos.ActionTraceReceipt{
+			Receiver:       eos.AccountName(receiver),
+			GlobalSequence: eos.Uint64(globalSequence),
+		},
+		Action:       action,
+		InlineTraces: inlines,
+	}}
+}
+
+//testOrdinalTrace 构建带有操作序号的展开追踪，与1.8之后的history插件和SHiP一致
+func testOrdinalTrace(ordinal uint32, receiver string, globalSequence uint64, action *eos.Action) ActionTrace {
+	trace := testActionTrace(receiver, globalSequence, action)
+	trace.ActionOrdinal = ordinal
+	return trace
+}
+
+//testScanTargetFunc 按账户别名匹配的扫描对象
+func testScanTargetFunc(accounts map[string]string) openwallet.BlockScanTargetFunc {
+	return func(target openwallet.ScanTarget) (string, bool) {
+		key, ok := accounts[target.Alias]
+		return key, ok
+	}
+}
+
+//testObserver 记录扫描通知的观测者
+type testObserver struct {
+	mu       sync.Mutex
+	headers  []*openwallet.BlockHeader
+	data     map[string][]*openwallet.TxExtractData
+	receipts map[string][]*openwallet.SmartContractReceipt
+}
+
+func newTestObserver() *testObserver {
+	return &testObserver{
+		data:     make(map[string][]*openwallet.TxExtractData),
+		receipts: make(map[string][]*openwallet.SmartContractReceipt),
+	}
+}
+
+func (o *testObserver) BlockScanNotify(header *openwallet.BlockHeader) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.headers = append(o.headers, header)
+	return nil
+}
+
+func (o *testObserver) BlockExtractDataNotify(sourceKey string, data *openwallet.TxExtractData) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.data[sourceKey] = append(o.data[sourceKey], data)
+	return nil
+}
+
+func (o *testObserver) BlockExtractSmartContractDataNotify(sourceKey string, data *openwallet.SmartContractReceipt) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.receipts[sourceKey] = append(o.receipts[sourceKey], data)
+	return nil
+}
+
+func (o *testObserver) blockHeaders() []*openwallet.BlockHeader {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]*openwallet.BlockHeader{}, o.headers...)
+}
+
+//testWaitFor 等待异步通知满足条件
+func testWaitFor(cond func() bool) bool {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func (o *testObserver) extractData(sourceKey string) []*openwallet.TxExtractData {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.data[sourceKey]
+}
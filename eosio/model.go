@@ -70,6 +70,31 @@ type Block struct {
 type TransferAction struct {
 	*eos.Action
 	TransferData
+	MemoAddress    string //按备注路由的充值地址
+	Ordinal        uint64 //操作在交易中的序号，为节点分配的action_ordinal减1，顶层操作依次为0~N-1
+	GlobalSequence uint64 //操作的全局序号，通过交易追踪提取时有效
+}
+
+// ActionTrace 操作追踪，包含eos-go没有解析的操作序号。节点在执行前为顶层操作依次分配1~N，
+// 内联操作和通知接收者在调度时分配之后的序号。1.8之前的节点没有该字段，由FlattenActionTraces补充
+type ActionTrace struct {
+	eos.ActionTrace
+	ActionOrdinal        uint32 `json:"action_ordinal"`
+	CreatorActionOrdinal uint32 `json:"creator_action_ordinal"`
+}
+
+//ordinal 操作在交易中的序号，与打包交易中顶层操作的下标一致
+func (trace *ActionTrace) ordinal() uint64 {
+	if trace.ActionOrdinal > 0 {
+		return uint64(trace.ActionOrdinal - 1)
+	}
+	return 0
+}
+
+// TransactionTraceResp history插件get_transaction的响应，操作追踪包含操作序号
+type TransactionTraceResp struct {
+	eos.TransactionResp
+	Traces []ActionTrace `json:"traces"`
 }
 
 // TransferData token contract transfer action data
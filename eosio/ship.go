@@ -0,0 +1,356 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/eoscanada/eos-go"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	//request variant 索引
+	shipGetStatusRequestIndex    = 0
+	shipGetBlocksRequestIndex    = 1
+	shipGetBlocksAckRequestIndex = 2
+
+	//result variant 索引
+	shipGetStatusResultIndex = 0
+	shipGetBlocksResultIndex = 1
+
+	//解析数组使用的辅助结构
+	shipTracesStruct = "__ship_traces"
+	shipDeltasStruct = "__ship_deltas"
+)
+
+// ShipBlockPosition 区块位置
+type ShipBlockPosition struct {
+	BlockNum uint32          `json:"block_num"`
+	BlockID  eos.Checksum256 `json:"block_id"`
+}
+
+// ShipGetBlocksRequest get_blocks_request_v0
+type ShipGetBlocksRequest struct {
+	StartBlockNum       uint32
+	EndBlockNum         uint32
+	MaxMessagesInFlight uint32
+	HavePositions       []ShipBlockPosition
+	IrreversibleOnly    bool
+	FetchBlock          bool
+	FetchTraces         bool
+	FetchDeltas         bool
+}
+
+// ShipGetBlocksAckRequest get_blocks_ack_request_v0
+type ShipGetBlocksAckRequest struct {
+	NumMessages uint32
+}
+
+// ShipGetBlocksResult get_blocks_result_v0
+type ShipGetBlocksResult struct {
+	Head             ShipBlockPosition
+	LastIrreversible ShipBlockPosition
+	ThisBlock        *ShipBlockPosition
+	PrevBlock        *ShipBlockPosition
+	Block            *eos.SignedBlock
+	Traces           []*ShipTransactionTrace
+	Deltas           []*ShipTableDelta
+}
+
+// ShipTransactionTrace transaction_trace_v0
+type ShipTransactionTrace struct {
+	ID            eos.Checksum256    `json:"id"`
+	Status        uint8              `json:"status"`
+	CPUUsageUS    uint32             `json:"cpu_usage_us"`
+	NetUsageWords uint32             `json:"net_usage_words"`
+	Elapsed       int64              `json:"elapsed"`
+	NetUsage      eos.Uint64         `json:"net_usage"`
+	Scheduled     bool               `json:"scheduled"`
+	ActionTraces  []*ShipActionTrace `json:"action_traces"`
+	Except        string             `json:"except"`
+}
+
+// ShipActionTrace action_trace_v0
+type ShipActionTrace struct {
+	ActionOrdinal        uint32             `json:"action_ordinal"`
+	CreatorActionOrdinal uint32             `json:"creator_action_ordinal"`
+	Receipt              *ShipActionReceipt `json:"receipt"`
+	Receiver             eos.AccountName    `json:"receiver"`
+	Act                  ShipAction         `json:"act"`
+	ContextFree          bool               `json:"context_free"`
+	Elapsed              int64              `json:"elapsed"`
+	Console              string             `json:"console"`
+	Except               string             `json:"except"`
+}
+
+// ShipActionReceipt action_receipt_v0
+type ShipActionReceipt struct {
+	Receiver       eos.AccountName `json:"receiver"`
+	ActDigest      eos.Checksum256 `json:"act_digest"`
+	GlobalSequence eos.Uint64      `json:"global_sequence"`
+	RecvSequence   eos.Uint64      `json:"recv_sequence"`
+	CodeSequence   uint32          `json:"code_sequence"`
+	ABISequence    uint32          `json:"abi_sequence"`
+}
+
+// ShipAction action
+type ShipAction struct {
+	Account       eos.AccountName       `json:"account"`
+	Name          eos.ActionName        `json:"name"`
+	Authorization []eos.PermissionLevel `json:"authorization"`
+	Data          eos.HexBytes          `json:"data"`
+}
+
+// ShipTableDelta table_delta_v0
+type ShipTableDelta struct {
+	Name string          `json:"name"`
+	Rows []*ShipTableRow `json:"rows"`
+}
+
+// ShipTableRow row
+type ShipTableRow struct {
+	Present bool         `json:"present"`
+	Data    eos.HexBytes `json:"data"`
+}
+
+//shipGetBlocksResultJSON ABI解析后的get_blocks_result_v0
+type shipGetBlocksResultJSON struct {
+	Head             ShipBlockPosition  `json:"head"`
+	LastIrreversible ShipBlockPosition  `json:"last_irreversible"`
+	ThisBlock        *ShipBlockPosition `json:"this_block"`
+	PrevBlock        *ShipBlockPosition `json:"prev_block"`
+	Block            eos.HexBytes       `json:"block"`
+	Traces           eos.HexBytes       `json:"traces"`
+	Deltas           eos.HexBytes       `json:"deltas"`
+}
+
+// ExecutedActionTraces 转换为合约自身执行的操作追踪，按执行顺序排列
+func (trace *ShipTransactionTrace) ExecutedActionTraces() []*ActionTrace {
+	traces := make([]ActionTrace, 0, len(trace.ActionTraces))
+	for _, at := range trace.ActionTraces {
+		//没有回执的操作未被执行
+		if at.Receipt == nil {
+			continue
+		}
+		action := &eos.Action{
+			Account:       at.Act.Account,
+			Name:          at.Act.Name,
+			Authorization: at.Act.Authorization,
+			ActionData:    eos.NewActionDataFromHexData(at.Act.Data),
+		}
+		traces = append(traces, ActionTrace{
+			ActionTrace: eos.ActionTrace{
+				Receipt: eos.ActionTraceReceipt{
+					Receiver:        at.Receipt.Receiver,
+					ActionDigest:    at.Receipt.ActDigest.String(),
+					GlobalSequence:  at.Receipt.GlobalSequence,
+					ReceiveSequence: at.Receipt.RecvSequence,
+					CodeSequence:    eos.Uint64(at.Receipt.CodeSequence),
+					ABISequence:     eos.Uint64(at.Receipt.ABISequence),
+				},
+				Action:        action,
+				Elapsed:       int(at.Elapsed),
+				Console:       at.Console,
+				TransactionID: trace.ID,
+			},
+			ActionOrdinal:        at.ActionOrdinal,
+			CreatorActionOrdinal: at.CreatorActionOrdinal,
+		})
+	}
+	return FlattenActionTraces(traces)
+}
+
+// ShipClient state history plugin websocket客户端
+type ShipClient struct {
+	URL  string
+	conn *websocket.Conn
+	abi  *eos.ABI
+}
+
+// NewShipClient 创建SHiP客户端
+func NewShipClient(url string) *ShipClient {
+	return &ShipClient{URL: url}
+}
+
+// Connect 连接节点，并读取节点发送的SHiP ABI
+func (c *ShipClient) Connect() error {
+	conn, _, err := websocket.DefaultDialer.Dial(c.URL, nil)
+	if err != nil {
+		return fmt.Errorf("dial state history: %v", err)
+	}
+	c.conn = conn
+
+	//连接后节点首先发送ABI
+	_, message, err := conn.ReadMessage()
+	if err != nil {
+		c.Close()
+		return fmt.Errorf("read state history abi: %v", err)
+	}
+
+	abi, err := eos.NewABI(bytes.NewReader(message))
+	if err != nil {
+		c.Close()
+		return fmt.Errorf("parse state history abi: %v", err)
+	}
+
+	//辅助结构用于解析traces和deltas数组
+	abi.Structs = append(abi.Structs,
+		eos.StructDef{Name: shipTracesStruct, Fields: []eos.FieldDef{{Name: "traces", Type: "transaction_trace[]"}}},
+		eos.StructDef{Name: shipDeltasStruct, Fields: []eos.FieldDef{{Name: "deltas", Type: "table_delta[]"}}},
+	)
+	c.abi = abi
+
+	return nil
+}
+
+// Close 关闭连接
+func (c *ShipClient) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// RequestBlocks 发送get_blocks_request_v0
+func (c *ShipClient) RequestBlocks(request *ShipGetBlocksRequest) error {
+	return c.sendRequest(shipGetBlocksRequestIndex, request)
+}
+
+// AckBlocks 确认已处理的消息数量
+func (c *ShipClient) AckBlocks(numMessages uint32) error {
+	return c.sendRequest(shipGetBlocksAckRequestIndex, &ShipGetBlocksAckRequest{NumMessages: numMessages})
+}
+
+func (c *ShipClient) sendRequest(index uint32, request interface{}) error {
+	if c.conn == nil {
+		return fmt.Errorf("state history is not connected")
+	}
+
+	data, err := marshalBinary(request)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, binary.MaxVarintLen32)
+	n := binary.PutUvarint(buf, uint64(index))
+
+	return c.conn.WriteMessage(websocket.BinaryMessage, append(buf[:n], data...))
+}
+
+// ReadBlocksResult 读取下一个get_blocks_result_v0
+func (c *ShipClient) ReadBlocksResult() (*ShipGetBlocksResult, error) {
+	if c.conn == nil {
+		return nil, fmt.Errorf("state history is not connected")
+	}
+
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		index, n := binary.Uvarint(message)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid state history result")
+		}
+
+		//状态结果不需要处理
+		if index != shipGetBlocksResultIndex {
+			continue
+		}
+
+		return c.DecodeBlocksResult(message[n:])
+	}
+}
+
+// DecodeBlocksResult 使用SHiP ABI解析get_blocks_result_v0
+func (c *ShipClient) DecodeBlocksResult(data []byte) (*ShipGetBlocksResult, error) {
+
+	var raw shipGetBlocksResultJSON
+
+	if err := c.decodeABI("get_blocks_result_v0", data, &raw); err != nil {
+		return nil, err
+	}
+
+	result := &ShipGetBlocksResult{
+		Head:             raw.Head,
+		LastIrreversible: raw.LastIrreversible,
+		ThisBlock:        raw.ThisBlock,
+		PrevBlock:        raw.PrevBlock,
+	}
+
+	if len(raw.Block) > 0 {
+		var block eos.SignedBlock
+		if err := eos.UnmarshalBinary(raw.Block, &block); err != nil {
+			return nil, fmt.Errorf("decode signed block: %v", err)
+		}
+		result.Block = &block
+	}
+
+	if len(raw.Traces) > 0 {
+		var traces struct {
+			Traces []*ShipTransactionTrace `json:"traces"`
+		}
+		if err := c.decodeABI(shipTracesStruct, raw.Traces, &traces); err != nil {
+			return nil, fmt.Errorf("decode traces: %v", err)
+		}
+		result.Traces = traces.Traces
+	}
+
+	if len(raw.Deltas) > 0 {
+		var deltas struct {
+			Deltas []*ShipTableDelta `json:"deltas"`
+		}
+		if err := c.decodeABI(shipDeltasStruct, raw.Deltas, &deltas); err != nil {
+			return nil, fmt.Errorf("decode deltas: %v", err)
+		}
+		result.Deltas = deltas.Deltas
+	}
+
+	return result, nil
+}
+
+func (c *ShipClient) decodeABI(structName string, data []byte, v interface{}) error {
+	if c.abi == nil {
+		return fmt.Errorf("state history abi is not loaded")
+	}
+
+	js, err := c.abi.DecodeTableRowTyped(structName, data)
+	if err != nil {
+		return fmt.Errorf("decode %s: %v", structName, err)
+	}
+
+	return json.Unmarshal(js, v)
+}
+
+// TransactionTraces 按交易ID索引已执行交易的操作追踪
+func (result *ShipGetBlocksResult) TransactionTraces() map[string][]*ActionTrace {
+	traces := make(map[string][]*ActionTrace)
+	for _, trace := range result.Traces {
+		if trace.Status != uint8(eos.TransactionStatusExecuted) {
+			continue
+		}
+		traces[hex.EncodeToString(trace.ID)] = trace.ExecutedActionTraces()
+	}
+	return traces
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/eoscanada/eos-go"
+)
+
+// TrustedToken 受信任的代币
+type TrustedToken struct {
+	Contract  string //合约账户
+	Symbol    string //代币符号
+	Precision uint8  //精度
+}
+
+// TokenRegistry 受信任的代币登记表，用于识别仿冒代币
+type TokenRegistry struct {
+	mu     sync.RWMutex
+	tokens map[string]*TrustedToken //contract:symbol -> token
+}
+
+// NewTokenRegistry 创建代币登记表
+func NewTokenRegistry() *TokenRegistry {
+	return &TokenRegistry{tokens: make(map[string]*TrustedToken)}
+}
+
+// ParseTokenRegistry 解析逗号分隔的代币配置，格式为 contract:symbol:precision，例如 eosio.token:EOS:4,tethertether:USDT:4
+func ParseTokenRegistry(value string) (*TokenRegistry, error) {
+	registry := NewTokenRegistry()
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		parts := strings.Split(item, ":")
+		if len(parts) != 3 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("invalid trusted token: %s", item)
+		}
+		precision, err := strconv.ParseUint(parts[2], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted token precision: %s", item)
+		}
+		registry.Add(&TrustedToken{Contract: parts[0], Symbol: strings.ToUpper(parts[1]), Precision: uint8(precision)})
+	}
+	return registry, nil
+}
+
+// Add 登记代币
+func (r *TokenRegistry) Add(token *TrustedToken) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tokens[token.Contract+":"+token.Symbol] = token
+}
+
+// Len 登记的代币数量
+func (r *TokenRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.tokens)
+}
+
+// Get 查询登记的代币
+func (r *TokenRegistry) Get(contract, symbol string) (*TrustedToken, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	token, ok := r.tokens[contract+":"+symbol]
+	return token, ok
+}
+
+// Check 检查合约发行的代币是否受信任，返回不受信任的原因
+func (r *TokenRegistry) Check(contract string, symbol eos.Symbol) error {
+	token, ok := r.Get(contract, symbol.Symbol)
+	if !ok {
+		//同名代币登记在其他合约，可能是仿冒代币
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		for _, t := range r.tokens {
+			if t.Symbol == symbol.Symbol {
+				return fmt.Errorf("token %s is issued by %s, not trusted contract %s", symbol.Symbol, contract, t.Contract)
+			}
+		}
+		return fmt.Errorf("token %s of contract %s is not registered", symbol.Symbol, contract)
+	}
+
+	if token.Precision != symbol.Precision {
+		return fmt.Errorf("token %s of contract %s precision %d mismatch, want %d", symbol.Symbol, contract, symbol.Precision, token.Precision)
+	}
+
+	return nil
+}
+
+//checkTrustedToken 检查转账代币是否受信任，没有登记代币时全部信任，严格模式下全部不信任
+func (bs *EOSBlockScanner) checkTrustedToken(contract string, symbol eos.Symbol) error {
+	if bs.TokenRegistry == nil || bs.TokenRegistry.Len() == 0 {
+		if bs.wm.Config.StrictTokenMode {
+			return fmt.Errorf("token %s of contract %s is not registered, trusted token registry is empty", symbol.Symbol, contract)
+		}
+		return nil
+	}
+	return bs.TokenRegistry.Check(contract, symbol)
+}
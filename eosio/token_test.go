@@ -0,0 +1,114 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"testing"
+
+	"github.com/astaxie/beego/config"
+	"github.com/eoscanada/eos-go"
+)
+
+func TestParseTokenRegistry(t *testing.T) {
+	registry, err := ParseTokenRegistry("eosio.token:EOS:4, tethertether:usdt:4")
+	if err != nil {
+		t.Fatalf("parse token registry failed: %v", err)
+	}
+	if registry.Len() != 2 {
+		t.Fatalf("registry size = %d, want 2", registry.Len())
+	}
+
+	tests := []struct {
+		contract string
+		symbol   eos.Symbol
+		trusted  bool
+	}{
+		{"eosio.token", eos.Symbol{Precision: 4, Symbol: "EOS"}, true},
+		{"tethertether", eos.Symbol{Precision: 4, Symbol: "USDT"}, true},
+		{"fakeeostoken", eos.Symbol{Precision: 4, Symbol: "EOS"}, false},
+		{"eosio.token", eos.Symbol{Precision: 2, Symbol: "EOS"}, false},
+		{"eosio.token", eos.Symbol{Precision: 4, Symbol: "ABC"}, false},
+	}
+	for _, test := range tests {
+		err := registry.Check(test.contract, test.symbol)
+		if (err == nil) != test.trusted {
+			t.Errorf("check %s %v trusted = %v, want %v", test.contract, test.symbol, err == nil, test.trusted)
+		}
+	}
+
+	if _, err := ParseTokenRegistry("eosio.token:EOS"); err == nil {
+		t.Errorf("invalid token config should fail")
+	}
+}
+
+func TestEOSBlockScanner_ExtractUntrustedToken(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+	node.abis["fakeeostoken"] = testTokenABI()
+
+	wm := testNewMockWalletManager(node)
+	bs := wm.Blockscanner
+	bs.TokenRegistry, _ = ParseTokenRegistry("eosio.token:EOS:4")
+
+	//仿冒合约发行的EOS与真实EOS在同一交易中转给alice
+	packed := testPackedTransaction(1,
+		testTransferAction("eosio.token", "bob", "alice", "1.0000 EOS", "real"),
+		testTransferAction("fakeeostoken", "bob", "alice", "1000.0000 EOS", "fake"),
+	)
+	block := testBlock(100, 0, testBlockID(99, 0), packed)
+	scanTargetFunc := testScanTargetFunc(map[string]string{"alice": "account_alice"})
+
+	result := bs.ExtractTransaction(100, block.ID.String(), block.Timestamp.Unix(), block.Transactions[0], scanTargetFunc)
+	alice := result.extractData["account_alice"]
+	if len(alice) != 2 {
+		t.Fatalf("alice extract data size = %d, want 2", len(alice))
+	}
+	if alice[0].Transaction.GetExtParam().Get("untrusted").Bool() {
+		t.Errorf("real EOS should be trusted")
+	}
+	if !alice[1].Transaction.GetExtParam().Get("untrusted").Bool() || len(alice[1].Transaction.GetExtParam().Get("untrustedReason").String()) == 0 {
+		t.Errorf("fake EOS should be flagged: %s", alice[1].Transaction.ExtParam)
+	}
+
+	//严格模式丢弃仿冒代币
+	wm.Config.StrictTokenMode = true
+	result = bs.ExtractTransaction(100, block.ID.String(), block.Timestamp.Unix(), block.Transactions[0], scanTargetFunc)
+	alice = result.extractData["account_alice"]
+	if len(alice) != 1 || alice[0].Transaction.Coin.Contract.Address != "eosio.token:EOS" {
+		t.Fatalf("alice extract data size = %d, want only real EOS", len(alice))
+	}
+
+	//严格模式没有登记代币时全部不信任
+	bs.TokenRegistry = NewTokenRegistry()
+	result = bs.ExtractTransaction(100, block.ID.String(), block.Timestamp.Unix(), block.Transactions[0], scanTargetFunc)
+	if len(result.extractData["account_alice"]) != 0 {
+		t.Fatalf("alice extract data size = %d, want none", len(result.extractData["account_alice"]))
+	}
+}
+
+func TestWalletManager_LoadAssetsConfigStrictTokenMode(t *testing.T) {
+	wm := NewWalletManager(nil)
+	c, _ := config.NewConfigData("ini", []byte("strictTokenMode = true"))
+	if err := wm.LoadAssetsConfig(c); err == nil {
+		t.Errorf("strict token mode without trusted tokens should fail")
+	}
+
+	wm = NewWalletManager(nil)
+	c, _ = config.NewConfigData("ini", []byte("strictTokenMode = true\ntrustedTokens = eosio.token:EOS:4\ndataDir = "+t.TempDir()))
+	if err := wm.LoadAssetsConfig(c); err != nil || !wm.Config.StrictTokenMode {
+		t.Errorf("load strict token mode failed: %v", err)
+	}
+}
@@ -16,11 +16,15 @@
 package eosio
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/blocktree/eosio-adapter/eos_txsigner"
+	"github.com/blocktree/go-owcdrivers/owkeychain"
 	"github.com/blocktree/go-owcrypt"
 
 	"github.com/eoscanada/eos-go/ecc"
@@ -32,98 +36,248 @@ import (
 	"github.com/shopspring/decimal"
 )
 
+const (
+	//单笔提币交易的默认最大转账操作数，0为不限制
+	defaultMaxTransferActions = 0
+)
+
 // TransactionDecoder 交易单解析器
 type TransactionDecoder struct {
 	openwallet.TransactionDecoderBase
-	wm *WalletManager //钱包管理者
+	wm         *WalletManager                                         //钱包管理者
+	signingKey func(wrapper openwallet.WalletDAI) (keyDeriver, error) //获取签名密钥，默认为钱包的HDKey
 	//TransferActionName string
 }
 
+//keyDeriver 按路径派生签名私钥，由hdkeystore.HDKey实现
+type keyDeriver interface {
+	DerivedKeyWithPath(path string, curveType uint32) (*owkeychain.ExtendedKey, error)
+}
+
+//walletHDKey 钱包的HDKey
+func walletHDKey(wrapper openwallet.WalletDAI) (keyDeriver, error) {
+	return wrapper.HDKey()
+}
+
 //NewTransactionDecoder 交易单解析器
 func NewTransactionDecoder(wm *WalletManager) *TransactionDecoder {
 	decoder := TransactionDecoder{}
 	decoder.wm = wm
+	decoder.signingKey = walletHDKey
 	//decoder.TransferActionName = "transfer"
 	return &decoder
 }
 
-//CreateRawTransaction 创建交易单
+//CreateRawTransaction 创建交易单，每个接收者一个transfer操作。
+//设置了maxTransferActions时接收者数量不能超过该值，超过时通过CreateBatchRawTransaction拆分
 func (decoder *TransactionDecoder) CreateRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) error {
 
-	var (
-		accountID      = rawTx.Account.AccountID
-		accountBalance eos.Asset
-		amountStr      string
-		to             string
-		codeAccount    string
-		tokenCoin      string
-	)
+	if max := decoder.wm.Config.MaxTransferActions; max > 0 && len(rawTx.To) > int(max) {
+		return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "too many recipients: %d, max transfer actions of a transaction: %d", len(rawTx.To), max)
+	}
 
-	addr := strings.Split(rawTx.Coin.Contract.Address, ":")
-	if len(addr) != 2 {
-		return fmt.Errorf("token contract's address is invalid: %s", rawTx.Coin.Contract.Address)
+	accountResp, codeAccount, outputs, err := decoder.prepareTransfer(wrapper, rawTx)
+	if err != nil {
+		return err
+	}
+
+	createTxErr := decoder.createRawTransaction(
+		wrapper,
+		rawTx,
+		accountResp,
+		codeAccount,
+		outputs)
+	if createTxErr != nil {
+		return createTxErr
+	}
+
+	return nil
+
+}
+
+// CreateBatchRawTransaction 创建批量转账交易单，接收者按最大操作数分成多笔交易，
+// 余额按所有接收者的总额检查
+func (decoder *TransactionDecoder) CreateBatchRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) ([]*openwallet.RawTransaction, error) {
+
+	accountResp, codeAccount, outputs, err := decoder.prepareTransfer(wrapper, rawTx)
+	if err != nil {
+		return nil, err
+	}
+
+	size := len(outputs)
+	if max := decoder.wm.Config.MaxTransferActions; max > 0 {
+		size = int(max)
+	}
+
+	rawTxArray := make([]*openwallet.RawTransaction, 0)
+	for i := 0; i < len(outputs); i += size {
+		end := i + size
+		if end > len(outputs) {
+			end = len(outputs)
+		}
+
+		batch := &openwallet.RawTransaction{
+			Coin:     rawTx.Coin,
+			Account:  rawTx.Account,
+			To:       make(map[string]string),
+			Required: rawTx.Required,
+			ExtParam: rawTx.ExtParam,
+		}
+		for _, output := range outputs[i:end] {
+			batch.To[string(output.To)] = rawTx.To[string(output.To)]
+		}
+
+		createTxErr := decoder.createRawTransaction(
+			wrapper,
+			batch,
+			accountResp,
+			codeAccount,
+			outputs[i:end])
+		if createTxErr != nil {
+			return nil, createTxErr
+		}
+		rawTxArray = append(rawTxArray, batch)
+	}
+
+	return rawTxArray, nil
+}
+
+//prepareTransfer 获取发送账户和代币合约，生成转账输出，检查代币余额是否足够支付所有接收者
+func (decoder *TransactionDecoder) prepareTransfer(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) (*eos.AccountResp, eos.AccountName, []transferOutput, error) {
+
+	codeAccount, tokenCoin, err := tokenContract(rawTx.Coin)
+	if err != nil {
+		return nil, "", nil, err
 	}
-	codeAccount = addr[0]
-	tokenCoin = strings.ToUpper(addr[1])
 
 	//获取wallet
+	accountResp, err := decoder.getSenderAccount(wrapper, rawTx.Account.AccountID)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	accountBalance, err := decoder.getTokenBalance(accountResp.AccountName, codeAccount, tokenCoin)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	outputs, total, err := decoder.transferOutputs(rawTx, accountBalance.Symbol)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	accountBalanceDec := decimal.New(int64(accountBalance.Amount), -int32(accountBalance.Precision))
+	if accountBalanceDec.LessThan(total) {
+		return nil, "", nil, fmt.Errorf("the balance: %s is not enough", total.String())
+	}
+
+	return accountResp, codeAccount, outputs, nil
+}
+
+//transferOutput 转账交易中的一个接收者
+type transferOutput struct {
+	To       eos.AccountName
+	Amount   decimal.Decimal
+	Quantity eos.Asset
+	Memo     string
+}
+
+//tokenContract 解析代币合约地址，格式为 合约账户:代币符号
+func tokenContract(coin openwallet.Coin) (eos.AccountName, string, error) {
+	addr := strings.Split(coin.Contract.Address, ":")
+	if len(addr) != 2 {
+		return "", "", fmt.Errorf("token contract's address is invalid: %s", coin.Contract.Address)
+	}
+	return eos.AccountName(addr[0]), strings.ToUpper(addr[1]), nil
+}
+
+//getSenderAccount 获取资产账户在链上的账户信息
+func (decoder *TransactionDecoder) getSenderAccount(wrapper openwallet.WalletDAI, accountID string) (*eos.AccountResp, error) {
+
 	account, err := wrapper.GetAssetsAccountInfo(accountID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if account.Alias == "" {
-		return fmt.Errorf("[%s] have not been created", accountID)
+		return nil, fmt.Errorf("[%s] have not been created", accountID)
 	}
 
 	//账户是否上链
 	accountResp, err := decoder.wm.Api.GetAccount(eos.AccountName(account.Alias))
 	if err != nil && accountResp == nil {
-		return fmt.Errorf("%s account of from not found on chain", decoder.wm.Symbol())
-	}
-	//fmt.Println("Permission for initn:", accountResp.Permissions[0].RequiredAuth.Keys[0])
-	for k, v := range rawTx.To {
-		amountStr = v
-		to = k
-		break
+		return nil, fmt.Errorf("%s account of from not found on chain", decoder.wm.Symbol())
 	}
 
-	// 检查目标账户是否存在
-	accountTo, err := decoder.wm.Api.GetAccount(eos.AccountName(to))
-	if err != nil && accountTo == nil {
-		return fmt.Errorf("%s account of to not found on chain", decoder.wm.Symbol())
-	}
+	return accountResp, nil
+}
 
-	accountAssets, err := decoder.wm.Api.GetCurrencyBalance(eos.AccountName(account.Alias), tokenCoin, eos.AccountName(codeAccount))
+//getTokenBalance 获取账户的代币余额
+func (decoder *TransactionDecoder) getTokenBalance(account, codeAccount eos.AccountName, tokenCoin string) (eos.Asset, error) {
+	accountAssets, err := decoder.wm.Api.GetCurrencyBalance(account, tokenCoin, codeAccount)
+	if err != nil {
+		return eos.Asset{}, fmt.Errorf("get account[%s] %s balance failed, err: %v", account, tokenCoin, err)
+	}
 	if len(accountAssets) == 0 {
-		return openwallet.Errorf(openwallet.ErrInsufficientBalanceOfAccount, "all address's balance of account is not enough")
+		return eos.Asset{}, openwallet.Errorf(openwallet.ErrInsufficientBalanceOfAccount, "all address's balance of account is not enough")
 	}
+	return accountAssets[0], nil
+}
 
-	accountBalance = accountAssets[0]
+//transferOutputs 按接收者排序生成转账输出，检查接收者账户是否存在和金额精度，返回转账总额。
+//扩展参数memos可为每个接收者指定备注，没有指定时使用memo
+func (decoder *TransactionDecoder) transferOutputs(rawTx *openwallet.RawTransaction, symbol eos.Symbol) ([]transferOutput, decimal.Decimal, error) {
 
-	accountBalanceDec := decimal.New(int64(accountBalance.Amount), -int32(accountBalance.Precision))
-	amountDec, _ := decimal.NewFromString(amountStr)
+	var (
+		total   = decimal.Zero
+		outputs = make([]transferOutput, 0, len(rawTx.To))
+		ext     = rawTx.GetExtParam()
+	)
 
-	if accountBalanceDec.LessThan(amountDec) {
-		return fmt.Errorf("the balance: %s is not enough", amountStr)
+	if len(rawTx.To) == 0 {
+		return nil, total, fmt.Errorf("receiver addresses is empty")
 	}
 
-	amountInt64 := amountDec.Shift(int32(accountBalance.Precision)).IntPart()
-	quantity := eos.Asset{Amount: eos.Int64(amountInt64), Symbol: accountBalance.Symbol}
-	memo := rawTx.GetExtParam().Get("memo").String()
+	for to, amountStr := range rawTx.To {
 
-	createTxErr := decoder.createRawTransaction(
-		wrapper,
-		rawTx,
-		accountResp,
-		quantity,
-		memo)
-	if createTxErr != nil {
-		return createTxErr
+		amountDec, err := decimal.NewFromString(amountStr)
+		if err != nil || amountDec.LessThanOrEqual(decimal.Zero) {
+			return nil, total, fmt.Errorf("invalid amount: %s to %s", amountStr, to)
+		}
+
+		//超出代币精度的部分无法转出，拒绝而不是截断
+		if !amountDec.Equal(amountDec.Truncate(int32(symbol.Precision))) {
+			return nil, total, fmt.Errorf("amount: %s to %s exceeds token precision: %d", amountStr, to, symbol.Precision)
+		}
+
+		// 检查目标账户是否存在
+		accountTo, err := decoder.wm.Api.GetAccount(eos.AccountName(to))
+		if err != nil && accountTo == nil {
+			return nil, total, fmt.Errorf("%s account of to: %s not found on chain", decoder.wm.Symbol(), to)
+		}
+
+		//账户名包含"."，不能作为gjson路径
+		memo := ext.Get("memo").String()
+		if m, ok := ext.Get("memos").Map()[to]; ok {
+			memo = m.String()
+		}
+
+		amountInt64 := amountDec.Shift(int32(symbol.Precision)).IntPart()
+		outputs = append(outputs, transferOutput{
+			To:       eos.AccountName(to),
+			Amount:   amountDec,
+			Quantity: eos.Asset{Amount: eos.Int64(amountInt64), Symbol: symbol},
+			Memo:     memo,
+		})
+		total = total.Add(amountDec)
 	}
 
-	return nil
+	//map无序，按接收者排序保证交易内容确定
+	sort.Slice(outputs, func(i, j int) bool {
+		return outputs[i].To < outputs[j].To
+	})
 
+	return outputs, total, nil
 }
 
 //SignRawTransaction 签名交易单
@@ -134,7 +288,7 @@ func (decoder *TransactionDecoder) SignRawTransaction(wrapper openwallet.WalletD
 		return fmt.Errorf("transaction signature is empty")
 	}
 
-	key, err := wrapper.HDKey()
+	key, err := decoder.signingKey(wrapper)
 	if err != nil {
 		return err
 	}
@@ -144,6 +298,9 @@ func (decoder *TransactionDecoder) SignRawTransaction(wrapper openwallet.WalletD
 		for _, keySignature := range keySignatures {
 
 			childKey, err := key.DerivedKeyWithPath(keySignature.Address.HDPath, keySignature.EccType)
+			if err != nil {
+				return err
+			}
 			keyBytes, err := childKey.GetPrivateKeyBytes()
 			if err != nil {
 				return err
@@ -155,12 +312,11 @@ func (decoder *TransactionDecoder) SignRawTransaction(wrapper openwallet.WalletD
 
 			//decoder.wm.Log.Debug("hash:", keySignature.Message)
 
-			//sig, err := eos_txsigner.Default.SignTransactionHash(hash, keyBytes, decoder.wm.CurveType())
-			signature, v, sigErr := owcrypt.Signature(keyBytes, nil, hash, decoder.wm.CurveType())
-			if sigErr == owcrypt.FAILURE {
-				return fmt.Errorf("sign transaction hash failed")
+			//节点只接受规范签名，签名格式为r+s+v
+			signature, err := eos_txsigner.Default.SignTransactionHash(hash, keyBytes, decoder.wm.CurveType())
+			if err != nil {
+				return fmt.Errorf("sign transaction hash failed, unexpected err: %v", err)
 			}
-			signature = append(signature, v)
 			keySignature.Signature = hex.EncodeToString(signature)
 
 			//decoder.wm.Log.Debug("signature:", keySignature.Signature)
@@ -192,28 +348,53 @@ func (decoder *TransactionDecoder) VerifyRawTransaction(wrapper openwallet.Walle
 		return fmt.Errorf("transaction decode failed, unexpected error: %v", err)
 	}
 
+	//重新计算交易哈希，不信任签名中的待签消息
+	info, err := decoder.wm.Api.GetInfo()
+	if err != nil {
+		return fmt.Errorf("get chain info failed, unexpected error: %v", err)
+	}
+	sigDigest := eos.SigDigest(info.ChainID, txHex, nil)
 	stx := eos.NewSignedTransaction(&tx)
 
 	//支持多重签名
+	signedKeys := make(map[string]bool)
 	for accountID, keySignatures := range rawTx.Signatures {
 		decoder.wm.Log.Debug("accountID Signatures:", accountID)
 		for _, keySignature := range keySignatures {
 
-			messsage, _ := hex.DecodeString(keySignature.Message)
-			signature, _ := hex.DecodeString(keySignature.Signature)
-			//publicKey, _ := hex.DecodeString(keySignature.Address.PublicKey)
+			if keySignature.Address == nil {
+				return fmt.Errorf("transaction verify failed: signature address is empty")
+			}
+			if keySignature.Message != hex.EncodeToString(sigDigest) {
+				return fmt.Errorf("transaction verify failed: message of %s is not the transaction digest", keySignature.Address.Address)
+			}
 
-			//验证签名，解压公钥，解压后首字节04要去掉
-			//uncompessedPublicKey := owcrypt.PointDecompress(publicKey, decoder.wm.CurveType())
+			signature, err := hex.DecodeString(keySignature.Signature)
+			if err != nil || len(signature) != 65 {
+				return fmt.Errorf("transaction verify failed: invalid signature of %s", keySignature.Address.Address)
+			}
+			if !isCanonicalSignature(signature) {
+				return fmt.Errorf("transaction verify failed: signature of %s is not canonical", keySignature.Address.Address)
+			}
 
-			_, valid := owcrypt.RecoverPubkey(signature, messsage, decoder.wm.CurveType())
-			//valid, compactSig, err := eos_txsigner.Default.VerifyAndCombineSignature(messsage, uncompessedPublicKey[1:], signature)
-			if valid == owcrypt.FAILURE {
-				return fmt.Errorf("transaction verify failed: %v", err)
+			//恢复的公钥必须是签名地址的公钥
+			pub, valid := owcrypt.RecoverPubkey(signature, sigDigest, decoder.wm.CurveType())
+			if valid != owcrypt.SUCCESS {
+				return fmt.Errorf("transaction verify failed: can not recover public key of %s", keySignature.Address.Address)
 			}
+			recovered := owcrypt.PointCompress(pub, decoder.wm.CurveType())
+			expected, err := hex.DecodeString(keySignature.Address.PublicKey)
+			if err != nil {
+				return fmt.Errorf("transaction verify failed: invalid public key of %s", keySignature.Address.Address)
+			}
+			if len(expected) != len(recovered) {
+				expected = owcrypt.PointCompress(expected, decoder.wm.CurveType())
+			}
+			if !bytes.Equal(recovered, expected) {
+				return fmt.Errorf("transaction verify failed: signature of %s does not match its public key", keySignature.Address.Address)
+			}
+			signedKeys[hex.EncodeToString(recovered)] = true
 
-			//decoder.wm.Log.Debug("recover pubkey:", hex.EncodeToString(pub))
-			//decoder.wm.Log.Debug("uncompessedPublicKey:", hex.EncodeToString(uncompessedPublicKey))
 			v := signature[len(signature)-1] //签名最后一字节是v
 
 			//验签通过后处理V值，符合节点验签
@@ -227,7 +408,12 @@ func (decoder *TransactionDecoder) VerifyRawTransaction(wrapper openwallet.Walle
 		}
 	}
 
-	bin, err := eos.MarshalBinary(stx)
+	//签名公钥需满足所有操作授权的权限阈值
+	if err := decoder.checkAuthorization(&tx, signedKeys); err != nil {
+		return fmt.Errorf("transaction verify failed: %v", err)
+	}
+
+	bin, err := marshalBinary(stx)
 	if err != nil {
 		return fmt.Errorf("signed transaction encode failed, unexpected error: %v", err)
 	}
@@ -238,6 +424,13 @@ func (decoder *TransactionDecoder) VerifyRawTransaction(wrapper openwallet.Walle
 	return nil
 }
 
+//isCanonicalSignature 是否节点接受的规范签名，r和s的最高位不能为1，且不能有多余的前导零
+func isCanonicalSignature(signature []byte) bool {
+	r, s := signature[:32], signature[32:64]
+	return r[0]&0x80 == 0 && !(r[0] == 0 && r[1]&0x80 == 0) &&
+		s[0]&0x80 == 0 && !(s[0] == 0 && s[1]&0x80 == 0)
+}
+
 // SubmitRawTransaction 广播交易单
 func (decoder *TransactionDecoder) SubmitRawTransaction(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) (*openwallet.Transaction, error) {
 
@@ -251,7 +444,9 @@ func (decoder *TransactionDecoder) SubmitRawTransaction(wrapper openwallet.Walle
 		return nil, fmt.Errorf("transaction decode failed, unexpected error: %v", err)
 	}
 
+	eosCodecLock.Lock()
 	packedTx, err := stx.Pack(eos.CompressionNone)
+	eosCodecLock.Unlock()
 	if err != nil {
 		return nil, err
 	}
@@ -266,6 +461,13 @@ func (decoder *TransactionDecoder) SubmitRawTransaction(wrapper openwallet.Walle
 	rawTx.TxID = hex.EncodeToString(response.Processed.ID)
 	rawTx.IsSubmit = true
 
+	//跟踪交易直到不可逆、过期或被微分叉丢弃
+	if decoder.wm.Config.TrackSubmittedTransactions && decoder.wm.Blockscanner != nil {
+		if err := decoder.wm.Blockscanner.TrackTransaction(rawTx.TxID, rawTx.Account.AccountID, stx.Transaction); err != nil {
+			decoder.wm.Log.Std.Error("track transaction: %s failed. unexpected error: %v", rawTx.TxID, err)
+		}
+	}
+
 	decimals := int32(rawTx.Coin.Contract.Decimals)
 	fees := "0"
 
@@ -320,47 +522,33 @@ func (decoder *TransactionDecoder) CreateSummaryRawTransactionWithError(wrapper
 		rawTxArray     = make([]*openwallet.RawTransactionWithError, 0)
 		accountID      = sumRawTx.Account.AccountID
 		accountBalance eos.Asset
-		codeAccount    string
-		tokenCoin      string
 	)
 
 	minTransfer, _ := decimal.NewFromString(sumRawTx.MinTransfer)
 	retainedBalance, _ := decimal.NewFromString(sumRawTx.RetainedBalance)
 
-	addr := strings.Split(sumRawTx.Coin.Contract.Address, ":")
-	if len(addr) != 2 {
-		return nil, fmt.Errorf("token contract's address is invalid: %s", sumRawTx.Coin.Contract.Address)
+	codeAccount, tokenCoin, err := tokenContract(sumRawTx.Coin)
+	if err != nil {
+		return nil, err
 	}
-	codeAccount = addr[0]
-	tokenCoin = strings.ToUpper(addr[1])
 
 	if minTransfer.LessThan(retainedBalance) {
 		return nil, fmt.Errorf("mini transfer amount must be greater than address retained balance")
 	}
 
 	//获取wallet
-	account, err := wrapper.GetAssetsAccountInfo(accountID)
+	accountResp, err := decoder.getSenderAccount(wrapper, accountID)
 	if err != nil {
 		return nil, err
 	}
 
-	if account.Alias == "" {
-		return nil, fmt.Errorf("[%s] have not been created", accountID)
-	}
-
-	//账户是否上链
-	accountResp, err := decoder.wm.Api.GetAccount(eos.AccountName(account.Alias))
-	if err != nil && accountResp == nil {
-		return nil, fmt.Errorf("%s account of from not found on chain", decoder.wm.Symbol())
-	}
-
 	// 检查目标账户是否存在
 	accountTo, err := decoder.wm.Api.GetAccount(eos.AccountName(sumRawTx.SummaryAddress))
 	if err != nil && accountTo == nil {
 		return nil, fmt.Errorf("%s account of to not found on chain", decoder.wm.Symbol())
 	}
 
-	accountAssets, err := decoder.wm.Api.GetCurrencyBalance(eos.AccountName(account.Alias), tokenCoin, eos.AccountName(codeAccount))
+	accountAssets, err := decoder.wm.Api.GetCurrencyBalance(accountResp.AccountName, tokenCoin, codeAccount)
 	if len(accountAssets) == 0 {
 		return rawTxArray, nil
 	}
@@ -397,8 +585,8 @@ func (decoder *TransactionDecoder) CreateSummaryRawTransactionWithError(wrapper
 		wrapper,
 		rawTx,
 		accountResp,
-		quantity,
-		memo)
+		codeAccount,
+		[]transferOutput{{To: eos.AccountName(sumRawTx.SummaryAddress), Amount: sumAmount, Quantity: quantity, Memo: memo}})
 	rawTxWithErr := &openwallet.RawTransactionWithError{
 		RawTx: rawTx,
 		Error: createTxErr,
@@ -410,93 +598,78 @@ func (decoder *TransactionDecoder) CreateSummaryRawTransactionWithError(wrapper
 	return rawTxArray, nil
 }
 
-//createRawTransaction
+//createRawTransaction 创建转账交易单，每个输出一个transfer操作
 func (decoder *TransactionDecoder) createRawTransaction(
 	wrapper openwallet.WalletDAI,
 	rawTx *openwallet.RawTransaction,
 	accountResp *eos.AccountResp,
-	quantity eos.Asset,
-	memo string) *openwallet.Error {
+	codeAccount eos.AccountName,
+	outputs []transferOutput) *openwallet.Error {
 
 	var (
-		to               eos.AccountName
 		accountTotalSent = decimal.Zero
+		totalAmount      = decimal.Zero
 		txFrom           = make([]string, 0)
 		txTo             = make([]string, 0)
 		keySignList      = make([]*openwallet.KeySignature, 0)
 		accountID        = rawTx.Account.AccountID
-		amountDec        = decimal.Zero
-		codeAccount      = eos.AccountName(rawTx.Coin.Contract.Address)
+		actions          = make([]*eos.Action, 0, len(outputs))
 	)
 
-	for k, v := range rawTx.To {
-		to = eos.AccountName(k)
-		amountDec, _ = decimal.NewFromString(v)
-		break
-	}
-
 	txOpts := &eos.TxOptions{}
 	if err := txOpts.FillFromChain(decoder.wm.Api); err != nil {
 		return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "filling tx opts: %s", err)
 	}
 
-	//action := &eos.Action{
-	//	Account: codeAccount,
-	//	Name:    token.ActN(decoder.TransferActionName),
-	//	Authorization: []eos.PermissionLevel{
-	//		{Actor: accountName, Permission: token.PN("active")},
-	//	},
-	//	ActionData: eos.NewActionData(token.Transfer{
-	//		From:     accountName,
-	//		To:       to,
-	//		Quantity: quantity,
-	//		Memo:     memo,
-	//	}),
-	//}
-	action := token.NewTransfer(accountResp.AccountName, to, quantity, memo)
-	if codeAccount != action.Account {
-		action.Account = codeAccount
-	}
-	tx := eos.NewTransaction([]*eos.Action{action}, txOpts)
+	//资产账户指定的签名权限，如linkauth限定的transfer权限
+	permName := transferPermission(wrapper, rawTx)
+	signers, err := decoder.selectPermissionKeys(wrapper, accountResp, permName)
+	if err != nil {
+		return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "[%s] %v", accountID, err)
+	}
+
+	for _, output := range outputs {
+		action := token.NewTransfer(accountResp.AccountName, output.To, output.Quantity, output.Memo)
+		if codeAccount != action.Account {
+			action.Account = codeAccount
+		}
+		action.Authorization = []eos.PermissionLevel{{Actor: accountResp.AccountName, Permission: permName}}
+		actions = append(actions, action)
+
+		//计算账户的实际转账amount，转给自己的不计入
+		if accountResp.AccountName != output.To {
+			accountTotalSent = accountTotalSent.Add(output.Amount)
+		}
+		totalAmount = totalAmount.Add(output.Amount)
+		txTo = append(txTo, fmt.Sprintf("%s:%s", output.To, output.Amount.String()))
+	}
+
+	tx := eos.NewTransaction(actions, txOpts)
 	stx := eos.NewSignedTransaction(tx)
+	eosCodecLock.Lock()
 	txdata, cfd, err := stx.PackedTransactionAndCFD()
+	eosCodecLock.Unlock()
 	if err != nil {
 		return openwallet.ConvertError(err)
 	}
 	//交易哈希
 	sigDigest := eos.SigDigest(txOpts.ChainID, txdata, cfd)
 
-	//查找账户的地址，填充待签消息
-	for _, permission := range accountResp.Permissions {
-		if permission.PermName == "active" {
-			for _, pubKey := range permission.RequiredAuth.Keys {
-				keyStr, _ := decoder.wm.Decoder.PublicKeyToAddress(pubKey.PublicKey.Content, false)
-				addr, err := wrapper.GetAddress(keyStr)
-				if err != nil {
-					return openwallet.Errorf(openwallet.ErrCreateRawTransactionFailed, "[%s] have not EOS public key: %s", accountID, keyStr)
-				}
-
-				signature := openwallet.KeySignature{
-					EccType: decoder.wm.Config.CurveType,
-					Nonce:   "",
-					Address: addr,
-					Message: hex.EncodeToString(sigDigest),
-					RSV:     true,
-				}
-				keySignList = append(keySignList, &signature)
-			}
+	//满足权限阈值的钱包公钥，填充待签消息
+	for _, addr := range signers {
+		signature := openwallet.KeySignature{
+			EccType: decoder.wm.Config.CurveType,
+			Nonce:   "",
+			Address: addr,
+			Message: hex.EncodeToString(sigDigest),
+			RSV:     true,
 		}
+		keySignList = append(keySignList, &signature)
 	}
 
-	//计算账户的实际转账amount
-	//accountTotalSentAddresses, findErr := wrapper.GetAddressList(0, -1, "AccountID", rawTx.Account.AccountID, "Address", to)
-	if accountResp.AccountName != to {
-		accountTotalSent = accountTotalSent.Add(amountDec)
-	}
 	accountTotalSent = decimal.Zero.Sub(accountTotalSent)
 
-	txFrom = []string{fmt.Sprintf("%s:%s", accountResp.AccountName, amountDec.String())}
-	txTo = []string{fmt.Sprintf("%s:%s", to, amountDec.String())}
+	txFrom = []string{fmt.Sprintf("%s:%s", accountResp.AccountName, totalAmount.String())}
 
 	if rawTx.Signatures == nil {
 		rawTx.Signatures = make(map[string][]*openwallet.KeySignature)
@@ -0,0 +1,497 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/blocktree/go-owcdrivers/owkeychain"
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
+	"github.com/eoscanada/eos-go/ecc"
+	"github.com/eoscanada/eos-go/token"
+)
+
+//testWalletDAI 只包含一个资产账户的钱包
+type testWalletDAI struct {
+	openwallet.WalletDAIBase
+	account   *openwallet.AssetsAccount
+	addresses map[string]*openwallet.Address
+	keys      map[string]*ecc.PrivateKey
+}
+
+func (wrapper *testWalletDAI) GetAssetsAccountInfo(accountID string) (*openwallet.AssetsAccount, error) {
+	if wrapper.account.AccountID != accountID {
+		return nil, fmt.Errorf("account: %s not found", accountID)
+	}
+	return wrapper.account, nil
+}
+
+func (wrapper *testWalletDAI) GetAddress(address string) (*openwallet.Address, error) {
+	addr, ok := wrapper.addresses[address]
+	if !ok {
+		return nil, fmt.Errorf("address: %s not found", address)
+	}
+	return addr, nil
+}
+
+//addKey 添加钱包持有的公钥，返回链上的公钥
+func (wrapper *testWalletDAI) addKey(t *testing.T, wm *WalletManager, hdPath string) ecc.PublicKey {
+	return wrapper.addPrivateKey(t, wm, hdPath).PublicKey()
+}
+
+//addPrivateKey 添加钱包持有的私钥，返回私钥用于签名
+func (wrapper *testWalletDAI) addPrivateKey(t *testing.T, wm *WalletManager, hdPath string) *ecc.PrivateKey {
+	key, err := ecc.NewRandomPrivateKey()
+	if err != nil {
+		t.Fatalf("create private key failed: %v", err)
+	}
+	pub := key.PublicKey()
+	address, _ := wm.Decoder.PublicKeyToAddress(pub.Content, false)
+	wrapper.addresses[address] = &openwallet.Address{AccountID: wrapper.account.AccountID, Address: address, HDPath: hdPath, PublicKey: hex.EncodeToString(pub.Content)}
+	if wrapper.keys == nil {
+		wrapper.keys = make(map[string]*ecc.PrivateKey)
+	}
+	wrapper.keys[address] = key
+	return key
+}
+
+//sign 用钱包私钥签名待签消息，签名格式为r+s+v
+func (wrapper *testWalletDAI) sign(t *testing.T, keySignature *openwallet.KeySignature) {
+	key := wrapper.keys[keySignature.Address.Address]
+	hash, _ := hex.DecodeString(keySignature.Message)
+	sig, err := key.Sign(hash)
+	if err != nil {
+		t.Fatalf("sign failed: %v", err)
+	}
+	keySignature.Signature = hex.EncodeToString(append(sig.Content[1:65], sig.Content[0]-27-4))
+}
+
+//testTransferNode 模拟节点中创建发送账户和接收账户，返回钱包
+func testTransferNode(t *testing.T, node *mockNode, wm *WalletManager, balance string, receivers ...string) *testWalletDAI {
+	wrapper := &testWalletDAI{
+		account:   &openwallet.AssetsAccount{AccountID: "wallet-account", Alias: "alice"},
+		addresses: make(map[string]*openwallet.Address),
+	}
+	pub := wrapper.addKey(t, wm, "m/44'/194'/0'/0/0")
+
+	node.info.ChainID = make(eos.Checksum256, 32)
+	node.info.HeadBlockID = testBlockID(100, 0)
+	node.accounts["alice"] = &eos.AccountResp{
+		AccountName: "alice",
+		Permissions: []eos.Permission{
+			{PermName: "owner", RequiredAuth: eos.Authority{Threshold: 1, Keys: []eos.KeyWeight{{PublicKey: pub, Weight: 1}}}},
+			{PermName: "active", Parent: "owner", RequiredAuth: eos.Authority{Threshold: 1, Keys: []eos.KeyWeight{{PublicKey: pub, Weight: 1}}}},
+		},
+	}
+	node.balances["alice"] = []string{balance}
+	for _, name := range receivers {
+		node.accounts[name] = &eos.AccountResp{AccountName: eos.AccountName(name)}
+	}
+	return wrapper
+}
+
+//testDecodeTransfers 解析交易单中的转账操作
+func testDecodeTransfers(t *testing.T, rawHex string) []token.Transfer {
+	data, _ := hex.DecodeString(rawHex)
+	var tx eos.Transaction
+	if err := eos.UnmarshalBinary(data, &tx); err != nil {
+		t.Fatalf("decode transaction failed: %v", err)
+	}
+	transfers := make([]token.Transfer, 0, len(tx.Actions))
+	for _, action := range tx.Actions {
+		if action.Account != "eosio.token" || action.Name != "transfer" {
+			t.Fatalf("unexpected action: %s::%s", action.Account, action.Name)
+		}
+		var transfer token.Transfer
+		if err := eos.UnmarshalBinary(action.HexData, &transfer); err != nil {
+			t.Fatalf("decode transfer failed: %v", err)
+		}
+		transfers = append(transfers, transfer)
+	}
+	return transfers
+}
+
+func testTransferRawTx(to map[string]string, ext string) *openwallet.RawTransaction {
+	rawTx := &openwallet.RawTransaction{
+		Coin: openwallet.Coin{
+			Symbol:     "EOS",
+			IsContract: true,
+			Contract:   openwallet.SmartContract{Address: "eosio.token:EOS", Decimals: 4},
+		},
+		Account: &openwallet.AssetsAccount{AccountID: "wallet-account", Alias: "alice"},
+		To:      to,
+	}
+	rawTx.ExtParam = ext
+	return rawTx
+}
+
+func TestTransactionDecoder_CreateMultiRecipientTransaction(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	wm := testNewMockWalletManager(node)
+	wrapper := testTransferNode(t, node, wm, "10.0000 EOS", "bob", "carol", "dave.exchange")
+
+	rawTx := testTransferRawTx(map[string]string{"carol": "2.5", "bob": "1", "dave.exchange": "0.0001"},
+		`{"memo":"withdraw","memos":{"dave.exchange":"10086"}}`)
+	if err := wm.TxDecoder.CreateRawTransaction(wrapper, rawTx); err != nil {
+		t.Fatalf("create raw transaction failed: %v", err)
+	}
+
+	transfers := testDecodeTransfers(t, rawTx.RawHex)
+	want := []struct {
+		to, quantity, memo string
+	}{
+		{"bob", "1.0000 EOS", "withdraw"},
+		{"carol", "2.5000 EOS", "withdraw"},
+		{"dave.exchange", "0.0001 EOS", "10086"},
+	}
+	if len(transfers) != len(want) {
+		t.Fatalf("transfer actions = %d, want %d", len(transfers), len(want))
+	}
+	for i, w := range want {
+		if transfers[i].From != "alice" || string(transfers[i].To) != w.to || transfers[i].Quantity.String() != w.quantity || transfers[i].Memo != w.memo {
+			t.Errorf("transfer %d = %+v, want %+v", i, transfers[i], w)
+		}
+	}
+
+	if rawTx.TxAmount != "-3.5001" {
+		t.Errorf("tx amount = %s, want -3.5001", rawTx.TxAmount)
+	}
+	if len(rawTx.TxFrom) != 1 || rawTx.TxFrom[0] != "alice:3.5001" {
+		t.Errorf("tx from = %v", rawTx.TxFrom)
+	}
+	if len(rawTx.TxTo) != 3 || rawTx.TxTo[0] != "bob:1" || rawTx.TxTo[2] != "dave.exchange:0.0001" {
+		t.Errorf("tx to = %v", rawTx.TxTo)
+	}
+	if len(rawTx.Signatures["wallet-account"]) != 1 {
+		t.Errorf("key signatures = %d, want 1", len(rawTx.Signatures["wallet-account"]))
+	}
+
+	//余额按总额检查
+	rawTx = testTransferRawTx(map[string]string{"bob": "6", "carol": "5"}, "")
+	if err := wm.TxDecoder.CreateRawTransaction(wrapper, rawTx); err == nil {
+		t.Errorf("total amount above balance should fail")
+	}
+
+	//查询余额失败时返回节点错误，而不是余额不足
+	node.fail("/v1/chain/get_currency_balance", 1)
+	rawTx = testTransferRawTx(map[string]string{"bob": "1"}, "")
+	err := wm.TxDecoder.CreateRawTransaction(wrapper, rawTx)
+	if err == nil || !strings.Contains(err.Error(), "balance failed") {
+		t.Errorf("balance query failure err = %v", err)
+	}
+
+	//金额超出代币精度
+	rawTx = testTransferRawTx(map[string]string{"bob": "1.00001"}, "")
+	if err := wm.TxDecoder.CreateRawTransaction(wrapper, rawTx); err == nil {
+		t.Errorf("amount above token precision should fail")
+	}
+	rawTx = testTransferRawTx(map[string]string{"bob": "1.000000"}, "")
+	if err := wm.TxDecoder.CreateRawTransaction(wrapper, rawTx); err != nil {
+		t.Errorf("amount with trailing zeros failed: %v", err)
+	}
+
+	//默认不限制单笔交易的操作数
+	if wm.Config.MaxTransferActions != 0 {
+		t.Errorf("default max transfer actions = %d, want 0", wm.Config.MaxTransferActions)
+	}
+
+	//超过单笔交易的最大操作数
+	wm.Config.MaxTransferActions = 2
+	rawTx = testTransferRawTx(map[string]string{"bob": "1", "carol": "1", "dave.exchange": "1"}, "")
+	if err := wm.TxDecoder.CreateRawTransaction(wrapper, rawTx); err == nil {
+		t.Errorf("recipients above max transfer actions should fail")
+	}
+}
+
+func TestTransactionDecoder_CreateBatchRawTransaction(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	wm := testNewMockWalletManager(node)
+	wm.Config.MaxTransferActions = 2
+	receivers := []string{"bob", "carol", "dave", "erin", "frank"}
+	wrapper := testTransferNode(t, node, wm, "5.0000 EOS", receivers...)
+	decoder := wm.TxDecoder.(*TransactionDecoder)
+
+	to := make(map[string]string)
+	for _, name := range receivers {
+		to[name] = "1"
+	}
+	rawTxs, err := decoder.CreateBatchRawTransaction(wrapper, testTransferRawTx(to, `{"memo":"batch"}`))
+	if err != nil {
+		t.Fatalf("create batch raw transaction failed: %v", err)
+	}
+	if len(rawTxs) != 3 {
+		t.Fatalf("raw transactions = %d, want 3", len(rawTxs))
+	}
+
+	received := make([]string, 0)
+	for _, rawTx := range rawTxs {
+		transfers := testDecodeTransfers(t, rawTx.RawHex)
+		if len(transfers) != len(rawTx.To) || len(rawTx.TxTo) != len(rawTx.To) {
+			t.Errorf("transfer actions = %d, recipients = %d", len(transfers), len(rawTx.To))
+		}
+		for _, transfer := range transfers {
+			received = append(received, string(transfer.To))
+			if transfer.Memo != "batch" {
+				t.Errorf("memo = %s, want batch", transfer.Memo)
+			}
+		}
+	}
+	for i, name := range receivers {
+		if received[i] != name {
+			t.Fatalf("received = %v, want %v", received, receivers)
+		}
+	}
+
+	//总额超过余额时不创建任何交易
+	to["george"] = "1"
+	node.accounts["george"] = &eos.AccountResp{AccountName: "george"}
+	if _, err := decoder.CreateBatchRawTransaction(wrapper, testTransferRawTx(to, "")); err == nil {
+		t.Errorf("total amount above balance should fail")
+	}
+}
+
+//testAuthorization 解析交易单中第一个操作的授权
+func testAuthorization(t *testing.T, rawHex string) []eos.PermissionLevel {
+	data, _ := hex.DecodeString(rawHex)
+	var tx eos.Transaction
+	if err := eos.UnmarshalBinary(data, &tx); err != nil {
+		t.Fatalf("decode transaction failed: %v", err)
+	}
+	return tx.Actions[0].Authorization
+}
+
+func TestTransactionDecoder_CreatePermissionTransaction(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	wm := testNewMockWalletManager(node)
+	wrapper := testTransferNode(t, node, wm, "10.0000 EOS", "bob")
+	wrapper.account.ExtParam = `{"permission":"transfer"}`
+
+	light1 := wrapper.addKey(t, wm, "m/44'/194'/0'/0/1")
+	light2 := wrapper.addKey(t, wm, "m/44'/194'/0'/0/2")
+	heavy := wrapper.addKey(t, wm, "m/44'/194'/0'/0/3")
+	opsKey := wrapper.addKey(t, wm, "m/44'/194'/0'/0/4")
+	foreign, _ := ecc.NewRandomPrivateKey()
+
+	alice := node.accounts["alice"]
+	alice.Permissions = append(alice.Permissions, eos.Permission{PermName: "transfer", Parent: "active", RequiredAuth: eos.Authority{
+		Threshold: 3,
+		Keys: []eos.KeyWeight{
+			{PublicKey: light1, Weight: 1},
+			{PublicKey: light2, Weight: 1},
+			{PublicKey: heavy, Weight: 3},
+			{PublicKey: foreign.PublicKey(), Weight: 3},
+		},
+	}})
+
+	//资产账户指定权限，只选取满足阈值的最少公钥
+	rawTx := testTransferRawTx(map[string]string{"bob": "1"}, "")
+	if err := wm.TxDecoder.CreateRawTransaction(wrapper, rawTx); err != nil {
+		t.Fatalf("create raw transaction failed: %v", err)
+	}
+	auth := testAuthorization(t, rawTx.RawHex)
+	if len(auth) != 1 || auth[0].Actor != "alice" || auth[0].Permission != "transfer" {
+		t.Errorf("authorization = %v, want alice@transfer", auth)
+	}
+	heavyAddr, _ := wm.Decoder.PublicKeyToAddress(heavy.Content, false)
+	keySignatures := rawTx.Signatures["wallet-account"]
+	if len(keySignatures) != 1 || keySignatures[0].Address.Address != heavyAddr {
+		t.Errorf("key signatures = %d, want only the heavy key", len(keySignatures))
+	}
+
+	//交易单扩展参数指定的权限优先，由其他账户的权限满足阈值
+	node.accounts["alice.ops"] = &eos.AccountResp{
+		AccountName: "alice.ops",
+		Permissions: []eos.Permission{
+			{PermName: "active", RequiredAuth: eos.Authority{Threshold: 1, Keys: []eos.KeyWeight{{PublicKey: opsKey, Weight: 1}}}},
+		},
+	}
+	alice.Permissions = append(alice.Permissions, eos.Permission{PermName: "withdraw", Parent: "active", RequiredAuth: eos.Authority{
+		Threshold: 2,
+		Keys:      []eos.KeyWeight{{PublicKey: light1, Weight: 1}, {PublicKey: foreign.PublicKey(), Weight: 1}},
+		Accounts: []eos.PermissionLevelWeight{
+			{Permission: eos.PermissionLevel{Actor: "alice.ops", Permission: "active"}, Weight: 1},
+			{Permission: eos.PermissionLevel{Actor: "nobody", Permission: "active"}, Weight: 1},
+		},
+	}})
+	rawTx = testTransferRawTx(map[string]string{"bob": "1"}, `{"permission":"withdraw"}`)
+	if err := wm.TxDecoder.CreateRawTransaction(wrapper, rawTx); err != nil {
+		t.Fatalf("create raw transaction failed: %v", err)
+	}
+	if auth := testAuthorization(t, rawTx.RawHex); auth[0].Permission != "withdraw" {
+		t.Errorf("authorization = %v, want alice@withdraw", auth)
+	}
+	if len(rawTx.Signatures["wallet-account"]) != 2 {
+		t.Errorf("key signatures = %d, want 2", len(rawTx.Signatures["wallet-account"]))
+	}
+
+	//钱包公钥不能满足阈值或权限不存在
+	alice.Permissions = append(alice.Permissions, eos.Permission{PermName: "cold", Parent: "owner", RequiredAuth: eos.Authority{
+		Threshold: 2,
+		Keys:      []eos.KeyWeight{{PublicKey: light1, Weight: 1}, {PublicKey: foreign.PublicKey(), Weight: 1}},
+	}})
+	for _, perm := range []string{"cold", "missing"} {
+		rawTx = testTransferRawTx(map[string]string{"bob": "1"}, fmt.Sprintf(`{"permission":"%s"}`, perm))
+		if err := wm.TxDecoder.CreateRawTransaction(wrapper, rawTx); err == nil {
+			t.Errorf("permission %s should fail", perm)
+		}
+	}
+}
+
+func TestTransactionDecoder_VerifyRawTransaction(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	wm := testNewMockWalletManager(node)
+	wrapper := testTransferNode(t, node, wm, "10.0000 EOS", "bob")
+	first := wrapper.addPrivateKey(t, wm, "m/44'/194'/0'/0/1")
+	second := wrapper.addPrivateKey(t, wm, "m/44'/194'/0'/0/2")
+	node.accounts["alice"].Permissions = append(node.accounts["alice"].Permissions, eos.Permission{PermName: "multisig", Parent: "active", RequiredAuth: eos.Authority{
+		Threshold: 2,
+		Keys:      []eos.KeyWeight{{PublicKey: first.PublicKey(), Weight: 1}, {PublicKey: second.PublicKey(), Weight: 1}},
+	}})
+
+	//创建并签名交易单，tamper修改签名后再验证
+	verify := func(tamper func(keySignatures []*openwallet.KeySignature) []*openwallet.KeySignature) (*openwallet.RawTransaction, error) {
+		rawTx := testTransferRawTx(map[string]string{"bob": "1"}, `{"permission":"multisig"}`)
+		if err := wm.TxDecoder.CreateRawTransaction(wrapper, rawTx); err != nil {
+			t.Fatalf("create raw transaction failed: %v", err)
+		}
+		keySignatures := rawTx.Signatures["wallet-account"]
+		for _, keySignature := range keySignatures {
+			wrapper.sign(t, keySignature)
+		}
+		if tamper != nil {
+			rawTx.Signatures["wallet-account"] = tamper(keySignatures)
+		}
+		return rawTx, wm.TxDecoder.VerifyRawTransaction(wrapper, rawTx)
+	}
+
+	rawTx, err := verify(nil)
+	if err != nil {
+		t.Fatalf("verify raw transaction failed: %v", err)
+	}
+	data, _ := hex.DecodeString(rawTx.RawHex)
+	var stx eos.SignedTransaction
+	if err := eos.UnmarshalBinary(data, &stx); err != nil {
+		t.Fatalf("decode signed transaction failed: %v", err)
+	}
+	if !rawTx.IsCompleted || len(stx.Signatures) != 2 {
+		t.Errorf("completed = %v, signatures = %d, want 2", rawTx.IsCompleted, len(stx.Signatures))
+	}
+
+	cases := map[string]func(keySignatures []*openwallet.KeySignature) []*openwallet.KeySignature{
+		//签名数量不满足权限阈值
+		"below threshold": func(keySignatures []*openwallet.KeySignature) []*openwallet.KeySignature {
+			return keySignatures[:1]
+		},
+		//用其他私钥签名
+		"wrong key": func(keySignatures []*openwallet.KeySignature) []*openwallet.KeySignature {
+			other := *keySignatures[0]
+			other.Address = keySignatures[1].Address
+			return []*openwallet.KeySignature{keySignatures[0], &other}
+		},
+		//待签消息不是交易哈希
+		"stale message": func(keySignatures []*openwallet.KeySignature) []*openwallet.KeySignature {
+			keySignatures[0].Message = hex.EncodeToString(make([]byte, 32))
+			wrapper.sign(t, keySignatures[0])
+			return keySignatures
+		},
+		//非规范签名
+		"non canonical": func(keySignatures []*openwallet.KeySignature) []*openwallet.KeySignature {
+			sig, _ := hex.DecodeString(keySignatures[0].Signature)
+			sig[0] |= 0x80
+			keySignatures[0].Signature = hex.EncodeToString(sig)
+			return keySignatures
+		},
+	}
+	for name, tamper := range cases {
+		rawTx, err := verify(tamper)
+		if err == nil || rawTx.IsCompleted {
+			t.Errorf("%s: verify should fail", name)
+		}
+	}
+}
+
+//testSeedKey 按种子派生签名私钥，与hdkeystore.HDKey的派生方式一致。
+//hdkeystore.NewHDKey计算KeyID时的sha3实现不能通过race模式的checkptr检查，测试不创建HDKey
+type testSeedKey []byte
+
+func (seed testSeedKey) DerivedKeyWithPath(path string, curveType uint32) (*owkeychain.ExtendedKey, error) {
+	return owkeychain.DerivedPrivateKeyWithPath(seed, path, curveType)
+}
+
+//addSeedKey 添加种子派生的公钥，交易单由SignRawTransaction签名
+func (wrapper *testWalletDAI) addSeedKey(t *testing.T, wm *WalletManager, seed testSeedKey, hdPath string) ecc.PublicKey {
+	childKey, err := seed.DerivedKeyWithPath(hdPath, wm.CurveType())
+	if err != nil {
+		t.Fatalf("derive key failed: %v", err)
+	}
+	pub, _ := ecc.NewPublicKeyFromData(append([]byte{byte(ecc.CurveK1)}, childKey.GetPublicKeyBytes()...))
+	address, _ := wm.Decoder.PublicKeyToAddress(pub.Content, false)
+	wrapper.addresses[address] = &openwallet.Address{AccountID: wrapper.account.AccountID, Address: address, HDPath: hdPath, PublicKey: hex.EncodeToString(pub.Content)}
+	return pub
+}
+
+func TestTransactionDecoder_SignRawTransaction(t *testing.T) {
+	node := newMockNode()
+	defer node.Close()
+
+	wm := testNewMockWalletManager(node)
+	wrapper := testTransferNode(t, node, wm, "100.0000 EOS", "bob")
+	seed := testSeedKey(make([]byte, 32))
+	wm.TxDecoder.(*TransactionDecoder).signingKey = func(openwallet.WalletDAI) (keyDeriver, error) {
+		return seed, nil
+	}
+	pub := wrapper.addSeedKey(t, wm, seed, "m/44'/194'/0'/0/1")
+	node.accounts["alice"].Permissions = append(node.accounts["alice"].Permissions, eos.Permission{PermName: "hot", Parent: "active", RequiredAuth: eos.Authority{
+		Threshold: 1,
+		Keys:      []eos.KeyWeight{{PublicKey: pub, Weight: 1}},
+	}})
+
+	//不同交易的签名都是节点接受的规范签名
+	for i := 1; i <= 20; i++ {
+		rawTx := testTransferRawTx(map[string]string{"bob": fmt.Sprintf("0.%04d", i)}, `{"permission":"hot"}`)
+		if err := wm.TxDecoder.CreateRawTransaction(wrapper, rawTx); err != nil {
+			t.Fatalf("create raw transaction failed: %v", err)
+		}
+		if err := wm.TxDecoder.SignRawTransaction(wrapper, rawTx); err != nil {
+			t.Fatalf("sign raw transaction failed: %v", err)
+		}
+		if err := wm.TxDecoder.VerifyRawTransaction(wrapper, rawTx); err != nil {
+			t.Fatalf("verify raw transaction %d failed: %v", i, err)
+		}
+
+		data, _ := hex.DecodeString(rawTx.RawHex)
+		var stx eos.SignedTransaction
+		if err := eos.UnmarshalBinary(data, &stx); err != nil {
+			t.Fatalf("decode signed transaction failed: %v", err)
+		}
+		digest, _ := hex.DecodeString(rawTx.Signatures["wallet-account"][0].Message)
+		if len(stx.Signatures) != 1 || !stx.Signatures[0].Verify(digest, pub) {
+			t.Fatalf("signature of transaction %d does not verify", i)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2018 The openwallet Authors
+ * This file is part of the openwallet library.
+ *
+ * The openwallet library is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Lesser General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * The openwallet library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Lesser General Public License for more details.
+ */
+
+package eosio
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/blocktree/openwallet/v2/openwallet"
+	"github.com/eoscanada/eos-go"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	//资产账户默认使用的签名权限
+	defaultTransferPermission = "active"
+	//权限引用其他账户权限的最大深度，与链上max_authority_depth一致
+	maxPermissionDepth = 6
+)
+
+//transferPermission 资产账户签名使用的权限，交易单扩展参数permission优先，
+//其次是资产账户扩展参数permission，都没有时使用active
+func transferPermission(wrapper openwallet.WalletDAI, rawTx *openwallet.RawTransaction) eos.PermissionName {
+	if perm := rawTx.GetExtParam().Get("permission").String(); perm != "" {
+		return eos.PermissionName(perm)
+	}
+	account, err := wrapper.GetAssetsAccountInfo(rawTx.Account.AccountID)
+	if err == nil && account != nil {
+		if perm := gjson.Get(account.ExtParam, "permission").String(); perm != "" {
+			return eos.PermissionName(perm)
+		}
+	}
+	return defaultTransferPermission
+}
+
+//permissionSigner 满足权限阈值的候选签名者，一个钱包持有的公钥或一个可满足的账户权限
+type permissionSigner struct {
+	weight    uint16
+	addresses []*openwallet.Address
+}
+
+//permissionKeySelector 选择满足权限阈值的钱包公钥，缓存查询过的账户
+type permissionKeySelector struct {
+	decoder  *TransactionDecoder
+	wrapper  openwallet.WalletDAI
+	accounts map[eos.AccountName]*eos.AccountResp
+}
+
+//selectPermissionKeys 选择满足账户权限阈值的最少钱包公钥
+func (decoder *TransactionDecoder) selectPermissionKeys(wrapper openwallet.WalletDAI, accountResp *eos.AccountResp, permName eos.PermissionName) ([]*openwallet.Address, error) {
+	selector := &permissionKeySelector{
+		decoder:  decoder,
+		wrapper:  wrapper,
+		accounts: map[eos.AccountName]*eos.AccountResp{accountResp.AccountName: accountResp},
+	}
+	if findPermission(accountResp, permName) == nil {
+		return nil, fmt.Errorf("permission %s@%s not found on chain", accountResp.AccountName, permName)
+	}
+	addresses, ok := selector.satisfy(accountResp.AccountName, permName, 0)
+	if !ok {
+		return nil, fmt.Errorf("wallet keys can not satisfy the threshold of permission %s@%s", accountResp.AccountName, permName)
+	}
+	return addresses, nil
+}
+
+//findPermission 查找账户的权限
+func findPermission(accountResp *eos.AccountResp, permName eos.PermissionName) *eos.Permission {
+	for i, permission := range accountResp.Permissions {
+		if permission.PermName == string(permName) {
+			return &accountResp.Permissions[i]
+		}
+	}
+	return nil
+}
+
+//account 查询账户信息，账户不存在或没有权限信息时返回nil。
+//节点返回的部分字段可能解析失败，只要权限信息完整仍可使用
+func (selector *permissionKeySelector) account(name eos.AccountName) *eos.AccountResp {
+	if accountResp, ok := selector.accounts[name]; ok {
+		return accountResp
+	}
+	accountResp, _ := selector.decoder.wm.Api.GetAccount(name)
+	if accountResp != nil && len(accountResp.Permissions) == 0 {
+		accountResp = nil
+	}
+	selector.accounts[name] = accountResp
+	return accountResp
+}
+
+//satisfy 按权重从高到低选取钱包持有的公钥和可满足的账户权限，直到达到权限阈值。
+//权重相同时优先需要签名少的，返回去重后的公钥地址
+func (selector *permissionKeySelector) satisfy(actor eos.AccountName, permName eos.PermissionName, depth int) ([]*openwallet.Address, bool) {
+
+	if depth > maxPermissionDepth {
+		return nil, false
+	}
+
+	accountResp := selector.account(actor)
+	if accountResp == nil {
+		return nil, false
+	}
+	permission := findPermission(accountResp, permName)
+	if permission == nil {
+		return nil, false
+	}
+
+	signers := make([]permissionSigner, 0)
+	for _, key := range permission.RequiredAuth.Keys {
+		keyStr, err := selector.decoder.wm.Decoder.PublicKeyToAddress(key.PublicKey.Content, false)
+		if err != nil {
+			continue
+		}
+		addr, err := selector.wrapper.GetAddress(keyStr)
+		if err != nil || addr == nil {
+			continue
+		}
+		signers = append(signers, permissionSigner{weight: key.Weight, addresses: []*openwallet.Address{addr}})
+	}
+	for _, level := range permission.RequiredAuth.Accounts {
+		addresses, ok := selector.satisfy(level.Permission.Actor, level.Permission.Permission, depth+1)
+		if !ok {
+			continue
+		}
+		signers = append(signers, permissionSigner{weight: level.Weight, addresses: addresses})
+	}
+
+	sort.SliceStable(signers, func(i, j int) bool {
+		if signers[i].weight != signers[j].weight {
+			return signers[i].weight > signers[j].weight
+		}
+		return len(signers[i].addresses) < len(signers[j].addresses)
+	})
+
+	var (
+		weight    uint32
+		addresses = make([]*openwallet.Address, 0)
+		selected  = make(map[string]bool)
+	)
+	for _, signer := range signers {
+		if weight >= permission.RequiredAuth.Threshold {
+			break
+		}
+		weight += uint32(signer.weight)
+		for _, addr := range signer.addresses {
+			if !selected[addr.Address] {
+				selected[addr.Address] = true
+				addresses = append(addresses, addr)
+			}
+		}
+	}
+
+	if weight < permission.RequiredAuth.Threshold || len(addresses) == 0 {
+		return nil, false
+	}
+	return addresses, true
+}
+
+//checkAuthorization 检查签名公钥是否满足交易中所有操作的授权权限阈值，signedKeys为压缩公钥的hex
+func (decoder *TransactionDecoder) checkAuthorization(tx *eos.Transaction, signedKeys map[string]bool) error {
+	selector := &permissionKeySelector{
+		decoder:  decoder,
+		accounts: make(map[eos.AccountName]*eos.AccountResp),
+	}
+	for _, action := range tx.Actions {
+		for _, level := range action.Authorization {
+			if !selector.satisfiedBy(level.Actor, level.Permission, signedKeys, 0) {
+				return fmt.Errorf("signatures can not satisfy the threshold of permission %s@%s", level.Actor, level.Permission)
+			}
+		}
+	}
+	return nil
+}
+
+//satisfiedBy 已签名的公钥和可满足的账户权限的权重之和是否达到权限阈值
+func (selector *permissionKeySelector) satisfiedBy(actor eos.AccountName, permName eos.PermissionName, signedKeys map[string]bool, depth int) bool {
+
+	if depth > maxPermissionDepth {
+		return false
+	}
+
+	accountResp := selector.account(actor)
+	if accountResp == nil {
+		return false
+	}
+	permission := findPermission(accountResp, permName)
+	if permission == nil {
+		return false
+	}
+
+	var weight uint32
+	for _, key := range permission.RequiredAuth.Keys {
+		if signedKeys[hex.EncodeToString(key.PublicKey.Content)] {
+			weight += uint32(key.Weight)
+		}
+	}
+	for _, level := range permission.RequiredAuth.Accounts {
+		if weight >= permission.RequiredAuth.Threshold {
+			break
+		}
+		if selector.satisfiedBy(level.Permission.Actor, level.Permission.Permission, signedKeys, depth+1) {
+			weight += uint32(level.Weight)
+		}
+	}
+
+	return weight >= permission.RequiredAuth.Threshold
+}
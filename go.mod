@@ -3,12 +3,17 @@ module github.com/blocktree/eosio-adapter
 go 1.12
 
 require (
+	github.com/asdine/storm v2.1.2+incompatible
 	github.com/astaxie/beego v1.12.0
 	github.com/blocktree/go-owcdrivers v1.2.0
 	github.com/blocktree/go-owcrypt v1.1.1
 	github.com/blocktree/openwallet/v2 v2.0.4
 	github.com/eoscanada/eos-go v0.8.16
+	github.com/gorilla/websocket v1.4.1
 	github.com/imroc/req v0.2.4
 	github.com/shopspring/decimal v0.0.0-20200105231215-408a2507e114
+	github.com/tidwall/gjson v1.3.5
+	go.etcd.io/bbolt v1.3.5
 	go.uber.org/zap v1.13.0 // indirect
+	golang.org/x/sys v0.7.0 // indirect
 )